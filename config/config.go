@@ -27,6 +27,8 @@ type config struct {
 	Line     lineConfig
 	Telegram string
 	Sentry   string
+	// path to record orderbook websocket messages to, see exchange.WSRecorder
+	WSRecord string
 }
 
 func Load(fileName, tag string) config {
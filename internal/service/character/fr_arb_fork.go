@@ -12,11 +12,17 @@ import (
 	util "crypto-flash/internal/service/util"
 )
 
+func init() {
+	RegisterStrategy("fr_arbitrage_fork", func(c StrategyConfig) Strategy {
+		return NewFRArbFork(c.Exchange, c.Notifier, c.Owner, c.Orderbooks)
+	}, false)
+}
+
 type FRArbFork struct {
 	FRArb
 }
 
-func NewFRArbFork(ftx *exchange.FTX, notifier *Notifier, owner string, orderbooks map[string]*util.Orderbook) *FRArbFork {
+func NewFRArbFork(ex exchange.Exchange, notifier *Notifier, owner string, orderbooks *exchange.OrderbookStore) *FRArbFork {
 	return &FRArbFork{
 		FRArb: FRArb{
 			SignalProvider: SignalProvider{
@@ -31,10 +37,10 @@ func NewFRArbFork(ftx *exchange.FTX, notifier *Notifier, owner string, orderbook
 				takeProfitCount: 0,
 				stopLossCount:   0,
 			},
-			ftx:        ftx,
+			exchange:   ex,
 			orderbooks: orderbooks,
 			// config
-			quarterContractName:  "0326",
+			rollBefore:           24 * time.Hour,
 			blacklistFutureNames: []string{},
 			// perp and quarter have 1/2 pairPortion and leverage
 			leverage: 5,
@@ -63,6 +69,9 @@ func NewFRArbFork(ftx *exchange.FTX, notifier *Notifier, owner string, orderbook
 		},
 	}
 }
+func (fra *FRArbFork) Name() string {
+	return "fr_arbitrage_fork"
+}
 func (fra *FRArbFork) genSignal(future *future) (bool, bool) {
 	util.Error(fra.tag, "implement you strategy here")
 	return false, false
@@ -70,17 +79,27 @@ func (fra *FRArbFork) genSignal(future *future) (bool, bool) {
 func (fra *FRArbFork) Start() {
 	//value, exist := os.LookupEnv("ENV")
 	//isTestEnv := exist && value == "test"
-	fra.createFutures()
+	fra.loadFutures()
 	fra.startFuturesInThisHour = make(map[string]bool)
+	go fra.watchFills()
 	go fra.updateFundingRateProfit()
 	go fra.updateNextFundingRates()
 	prev := time.Now()
-	for {
+	var expiryChecked time.Time
+	for !fra.stopped() && fra.waitOrderbook() {
 		now := time.Now()
 		duration := now.Sub(prev)
 		util.Info(fra.tag, fmt.Sprintf("time used: %s", duration))
 		prev = now
+		fra.futuresMutex.Lock()
+		if now.Sub(expiryChecked) >= expiryCheckPeriod {
+			fra.rollQuarters(now)
+			expiryChecked = now
+		}
 		for _, future := range fra.futures {
+			if !future.hedgeable() {
+				continue
+			}
 			shouldStop, shouldStart := fra.genSignal(future)
 			if shouldStop {
 				fra.startFuturesInThisHour[future.name] = false
@@ -88,6 +107,7 @@ func (fra *FRArbFork) Start() {
 				fra.startFuturesInThisHour[future.name] = true
 			}
 		}
+		fra.futuresMutex.Unlock()
 		//timeToNextCycle := fra.updatePeriod - time.Now().Unix()%fra.updatePeriod
 		//sleepDuration := util.Duration{Second: timeToNextCycle}
 		//time.Sleep(sleepDuration.GetTimeDuration())
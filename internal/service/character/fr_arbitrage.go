@@ -8,7 +8,7 @@ import (
 	"fmt"
 	"math"
 	"sort"
-	"strings"
+	"sync"
 	"time"
 
 	exchange "crypto-flash/internal/service/exchange"
@@ -16,6 +16,14 @@ import (
 	util "crypto-flash/internal/service/util"
 )
 
+func init() {
+	// Backtest is not implemented, funding rates and orderbooks are not
+	// replayed
+	RegisterStrategy("fr_arbitrage", func(c StrategyConfig) Strategy {
+		return NewFRArb(c.Exchange, c.Notifier, c.Owner, c.Orderbooks)
+	}, false)
+}
+
 type future struct {
 	name           string
 	spotPair       string
@@ -41,13 +49,23 @@ type future struct {
 	totalProfit     float64
 	perpEnterPrice  float64
 	hedgeEnterPrice float64
+	// quarterPair expires at quarterExpiry and is rolled to nextQuarterPair
+	quarterExpiry   time.Time
+	nextQuarterPair string
+}
+
+// hedgeable tells whether future has a pair to hedge with, it has none once
+// its last quarter expires if it has no spot pair.
+func (f *future) hedgeable() bool {
+	return f.hedgePair != ""
 }
+
 type FRArb struct {
 	SignalProvider
-	ftx        *exchange.FTX
-	orderbooks map[string]*util.Orderbook
+	exchange   exchange.Exchange
+	orderbooks *exchange.OrderbookStore
 	// strategy config
-	quarterContractName       string
+	rollBefore                time.Duration
 	blacklistFutureNames      []string
 	leverage                  float64
 	longTime                  int
@@ -64,9 +82,14 @@ type FRArb struct {
 	freeBalance            float64
 	futures                map[string]*future
 	startFuturesInThisHour map[string]bool
+	// guards the data above, which is changed by Start and the goroutines it
+	// starts
+	futuresMutex sync.Mutex
+	// futures are created once by RequiredMarkets or Start
+	futuresOnce sync.Once
 }
 
-func NewFRArb(ftx *exchange.FTX, notifier *Notifier, owner string, orderbooks map[string]*util.Orderbook) *FRArb {
+func NewFRArb(ex exchange.Exchange, notifier *Notifier, owner string, orderbooks *exchange.OrderbookStore) *FRArb {
 	return &FRArb{
 		SignalProvider: SignalProvider{
 			tag:             "FRArb-" + owner,
@@ -80,10 +103,11 @@ func NewFRArb(ftx *exchange.FTX, notifier *Notifier, owner string, orderbooks ma
 			takeProfitCount: 0,
 			stopLossCount:   0,
 		},
-		ftx:        ftx,
+		exchange:   ex,
 		orderbooks: orderbooks,
 		// config
-		quarterContractName:  "0326",
+		// roll quarter hedges to the next quarter a day before expiry
+		rollBefore:           24 * time.Hour,
 		blacklistFutureNames: []string{},
 		// perp and quarter have 1/2 pairPortion and leverage
 		leverage: 5,
@@ -113,13 +137,16 @@ func NewFRArb(ftx *exchange.FTX, notifier *Notifier, owner string, orderbooks ma
 		freeBalance: 10000,
 	}
 }
+func (fra *FRArb) Name() string {
+	return "fr_arbitrage"
+}
 func (fra *FRArb) fundingRateToAPR(fundingRate float64) float64 {
 	return math.Abs(fundingRate) * 365 * 24 * fra.leverage / 2
 }
 func (fra *FRArb) Backtest(startTime, endTime int64) float64 {
 	/*
 		candles :=
-			sh.ftx.GetHistoryCandles(sh.market, 300, startTime, endTime)
+			sh.exchange.GetHistoryCandles(sh.market, 300, startTime, endTime)
 		util.Info(sh.tag, "start backtesting")
 		for _, candle := range candles {
 			sh.genSignal(candle.GetAvg(), candle.GetAvg())
@@ -132,9 +159,13 @@ func (fra *FRArb) Backtest(startTime, endTime int64) float64 {
 }
 func (fra *FRArb) getOrderbook(marketPair string) *util.Orderbook {
 	// restful
-	//return fra.ftx.GetOrderbook(marketPair, 1)
+	//return fra.exchange.GetOrderbook(marketPair, 1)
 	// ws
-	return fra.orderbooks[marketPair]
+	snapshot := fra.orderbooks.Get(marketPair)
+	if snapshot == nil {
+		return &util.Orderbook{}
+	}
+	return &snapshot.Orderbook
 }
 func (fra *FRArb) calculateSpreadRate(marketPair string) (float64, error) {
 	ob := fra.getOrderbook(marketPair)
@@ -148,25 +179,28 @@ func (fra *FRArb) calculateSpreadRate(marketPair string) (float64, error) {
 	}
 	return (sellPrice - buyPrice) / buyPrice, nil
 }
-func (fra *FRArb) calculateInnerSpreadRate(highOrderbook, lowOrderbook *util.Orderbook) (float64, error) {
+
+// calculateInnerSpreadRate returns the spread rate to enter a pair of size in
+// USD, at the average prices of market orders.
+func (fra *FRArb) calculateInnerSpreadRate(highOrderbook, lowOrderbook *util.Orderbook, size float64) (float64, error) {
 	// high pair is the one we want to short
-	highPrice, err := highOrderbook.GetMarketSellPrice()
+	highPrice, err := highOrderbook.GetMarketSellPriceForValue(size)
 	if err != nil {
 		return -1, err
 	}
-	lowPrice, err := lowOrderbook.GetMarketBuyPrice()
+	lowPrice, err := lowOrderbook.GetMarketBuyPriceForValue(size)
 	if err != nil {
 		return -1, err
 	}
 	return (highPrice - lowPrice) / lowPrice, nil
 }
-func (fra *FRArb) calculateOuterSpreadRate(highOrderbook, lowOrderbook *util.Orderbook) (float64, error) {
+func (fra *FRArb) calculateOuterSpreadRate(highOrderbook, lowOrderbook *util.Orderbook, size float64) (float64, error) {
 	// high pair is the one we want to buy back
-	highPrice, err := highOrderbook.GetMarketBuyPrice()
+	highPrice, err := highOrderbook.GetMarketBuyPriceForValue(size)
 	if err != nil {
 		return -1, err
 	}
-	lowPrice, err := lowOrderbook.GetMarketSellPrice()
+	lowPrice, err := lowOrderbook.GetMarketSellPriceForValue(size)
 	if err != nil {
 		return -1, err
 	}
@@ -189,7 +223,8 @@ func (fra *FRArb) genSignal(future *future) (bool, bool) {
 	}
 	highOrderbook := fra.getOrderbook(highPair)
 	lowOrderbook := fra.getOrderbook(lowPair)
-	outerSpreadRate, err := fra.calculateOuterSpreadRate(highOrderbook, lowOrderbook)
+	outerSpreadRate, err := fra.calculateOuterSpreadRate(highOrderbook, lowOrderbook,
+		math.Abs(future.size))
 	shouldStop, shouldStart := false, false
 	nextFundingAPR := fra.fundingRateToAPR(nextFundingRate)
 	if err == nil {
@@ -215,7 +250,9 @@ func (fra *FRArb) genSignal(future *future) (bool, bool) {
 			return shouldStop, shouldStart
 		}
 	}
-	innerSpreadRate, err := fra.calculateInnerSpreadRate(highOrderbook, lowOrderbook)
+	allocatedBalance := fra.freeBalance * fra.freeBalanceAllocateRate
+	size := allocatedBalance / 2 * fra.leverage
+	innerSpreadRate, err := fra.calculateInnerSpreadRate(highOrderbook, lowOrderbook, size)
 	if err == nil {
 		//util.Info(fra.tag, fmt.Sprintf("%s inner spread rate %.4f\n", future.name, innerSpreadRate))
 		canPerfectLeverage := nextFundingRate < 0 || future.isCollaterable
@@ -225,8 +262,6 @@ func (fra *FRArb) genSignal(future *future) (bool, bool) {
 		shouldIncrease := future.size != 0 && nextFundingAPR >= fra.startAPRThreshold &&
 			innerSpreadRate >= enterSpreadRate*fra.increaseSizeTimes && canPerfectLeverage
 		if shouldStart || shouldIncrease {
-			allocatedBalance := fra.freeBalance * fra.freeBalanceAllocateRate
-			size := allocatedBalance / 2 * fra.leverage
 			fra.increasePairSize(future, size)
 			fra.freeBalance -= allocatedBalance
 			msg := fmt.Sprintf("profitable: %s\navgAPR: %.2f%%\nnextAPR: %.2f%%\nincrease: %t",
@@ -332,13 +367,13 @@ func (fra *FRArb) startPair(future *future, size float64) {
 	perpOrderbook := fra.getOrderbook(future.perpPair)
 	hedgeOrderbook := fra.getOrderbook(future.hedgePair)
 	if perpSide == "long" {
-		future.perpEnterPrice, _ = perpOrderbook.GetMarketBuyPrice()
-		future.hedgeEnterPrice, _ = hedgeOrderbook.GetMarketSellPrice()
+		future.perpEnterPrice, _ = perpOrderbook.GetMarketBuyPriceForValue(size)
+		future.hedgeEnterPrice, _ = hedgeOrderbook.GetMarketSellPriceForValue(size)
 	} else {
-		future.perpEnterPrice, _ = perpOrderbook.GetMarketSellPrice()
-		future.hedgeEnterPrice, _ = hedgeOrderbook.GetMarketBuyPrice()
+		future.perpEnterPrice, _ = perpOrderbook.GetMarketSellPriceForValue(size)
+		future.hedgeEnterPrice, _ = hedgeOrderbook.GetMarketBuyPriceForValue(size)
 	}
-	future.totalProfit -= math.Abs(future.size) * fra.ftx.Fee * 2
+	future.totalProfit -= math.Abs(future.size) * fra.exchange.GetFee() * 2
 	util.Info(fra.tag, fmt.Sprintf("start earning on %s, size %f", future.name, future.size))
 	fra.send(fmt.Sprintf("start earning on %s, size %f", future.name, future.size))
 }
@@ -372,11 +407,11 @@ func (fra *FRArb) increasePairSize(future *future, size float64) {
 	hedgeOrderbook := fra.getOrderbook(future.hedgePair)
 	var curPerpPrice, curHedgePrice float64
 	if perpSide == "long" {
-		curPerpPrice, _ = perpOrderbook.GetMarketBuyPrice()
-		curHedgePrice, _ = hedgeOrderbook.GetMarketSellPrice()
+		curPerpPrice, _ = perpOrderbook.GetMarketBuyPriceForValue(size)
+		curHedgePrice, _ = hedgeOrderbook.GetMarketSellPriceForValue(size)
 	} else {
-		curPerpPrice, _ = perpOrderbook.GetMarketSellPrice()
-		curHedgePrice, _ = hedgeOrderbook.GetMarketBuyPrice()
+		curPerpPrice, _ = perpOrderbook.GetMarketSellPriceForValue(size)
+		curHedgePrice, _ = hedgeOrderbook.GetMarketBuyPriceForValue(size)
 	}
 	util.Info(fra.tag, fmt.Sprintf("increase size %f on %s", size, future.name))
 	fra.send(fmt.Sprintf("increase size %f on %s", size, future.name))
@@ -389,20 +424,28 @@ func (fra *FRArb) increasePairSize(future *future, size float64) {
 	msg += fmt.Sprintf("npPrice %f, nhPrice %f\n", future.perpEnterPrice, future.hedgeEnterPrice)
 	msg += fmt.Sprintf("new size: %f, new enter spread %f", future.size, fra.calculateEnterSpreadRate(future))
 	fra.send(msg)
-	future.totalProfit -= math.Abs(size) * fra.ftx.Fee * 2
+	future.totalProfit -= math.Abs(size) * fra.exchange.GetFee() * 2
 }
 func (fra *FRArb) calculateHedgeProfit(future *future) (float64, error) {
 	perpOrderbook := fra.getOrderbook(future.perpPair)
 	hedgeOrderbook := fra.getOrderbook(future.hedgePair)
 	var perpPrice, hedgePrice, perpProfit, hedgePairProfit float64
+	var perpErr, hedgeErr error
+	// at the prices closing the whole size
+	size := math.Abs(future.size)
 	if future.size > 0 {
-		perpPrice, _ = perpOrderbook.GetMarketSellPrice()
-		hedgePrice, _ = hedgeOrderbook.GetMarketBuyPrice()
+		perpPrice, perpErr = perpOrderbook.GetMarketSellPriceForValue(size)
+		hedgePrice, hedgeErr = hedgeOrderbook.GetMarketBuyPriceForValue(size)
 	} else {
-		perpPrice, _ = perpOrderbook.GetMarketBuyPrice()
-		hedgePrice, _ = hedgeOrderbook.GetMarketSellPrice()
+		perpPrice, perpErr = perpOrderbook.GetMarketBuyPriceForValue(size)
+		hedgePrice, hedgeErr = hedgeOrderbook.GetMarketSellPriceForValue(size)
+	}
+	if perpErr != nil {
+		return 0, perpErr
+	}
+	if hedgeErr != nil {
+		return 0, hedgeErr
 	}
-	size := math.Abs(future.size)
 	perpProfit = size*(perpPrice/future.perpEnterPrice) - size
 	hedgePairProfit = size*(hedgePrice/future.hedgeEnterPrice) - size
 	if future.size > 0 {
@@ -417,7 +460,9 @@ func (fra *FRArb) updateFutureProfit(future *future) {
 	future.totalProfit += future.hourlyFundingRateProfit
 	currentHedgeProfit, err := fra.calculateHedgeProfit(future)
 	if err != nil {
-		util.Error("cannot calculate hedge profit")
+		// keep the last hedge profit
+		util.Error(fra.tag, "cannot calculate hedge profit", err.Error())
+		return
 	}
 	future.currentHedgeProfit = currentHedgeProfit
 }
@@ -434,7 +479,7 @@ func (fra *FRArb) stopPair(future *future) {
 			Reason: "Not profitable",
 		})
 	*/
-	future.totalProfit -= math.Abs(future.size) * fra.ftx.Fee * 2
+	future.totalProfit -= math.Abs(future.size) * fra.exchange.GetFee() * 2
 	fra.updateFutureProfit(future)
 	util.Info(fra.tag, fmt.Sprintf("stop earning on %s, size %f", future.name, future.size))
 	util.Info(fra.tag, fmt.Sprintf("final hedge profit: %f", future.currentHedgeProfit))
@@ -447,35 +492,169 @@ func (fra *FRArb) stopPair(future *future) {
 	future.currentHedgeProfit = 0
 	future.hourlyFundingRateProfit = 0
 }
-func (fra *FRArb) createFutures() {
-	marketPairs, _ := fra.ftx.GetMarketPairs()
-	quarterPairs := make(map[string]bool)
-	spotPairs := make(map[string]bool)
-	for _, name := range marketPairs.Quarters {
-		existIndex := strings.Index(name, fra.quarterContractName)
-		if existIndex != -1 {
-			quarterPairs[name] = true
+
+// rollPair closes the hedge of future on its quarter and opens it again on
+// newQuarter. The realized profit of the closed hedge and the fees of the
+// roll go to totalProfit.
+func (fra *FRArb) rollPair(future *future, newQuarter string) error {
+	oldOrderbook := fra.getOrderbook(future.hedgePair)
+	newOrderbook := fra.getOrderbook(newQuarter)
+	var closePrice, openPrice float64
+	var closeErr, openErr error
+	size := math.Abs(future.size)
+	// the hedge is short if the perp is long
+	if future.size > 0 {
+		closePrice, closeErr = oldOrderbook.GetMarketBuyPriceForValue(size)
+		openPrice, openErr = newOrderbook.GetMarketSellPriceForValue(size)
+	} else {
+		closePrice, closeErr = oldOrderbook.GetMarketSellPriceForValue(size)
+		openPrice, openErr = newOrderbook.GetMarketBuyPriceForValue(size)
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+	if openErr != nil {
+		return openErr
+	}
+	hedgeProfit := size*(closePrice/future.hedgeEnterPrice) - size
+	if future.size > 0 {
+		hedgeProfit *= -1
+	}
+	rollCost := size * fra.exchange.GetFee() * 2
+	future.totalProfit += hedgeProfit - rollCost
+	future.hedgeEnterPrice = openPrice
+	msg := fmt.Sprintf("roll %s from %s to %s, hedge profit: %.2f, roll cost: %.2f",
+		future.name, future.hedgePair, newQuarter, hedgeProfit, rollCost)
+	util.Info(fra.tag, msg)
+	fra.send(msg)
+	return nil
+}
+
+// rollQuarters moves pairs to the next quarter once their quarter expires
+// within rollBefore. Pairs without a next quarter are stopped if hedged with
+// the quarter. futuresMutex must be held.
+func (fra *FRArb) rollQuarters(now time.Time) {
+	markets := fra.exchange.Markets()
+	for _, future := range fra.futures {
+		if future.quarterPair == "" ||
+			now.Before(future.quarterExpiry.Add(-fra.rollBefore)) {
+			continue
+		}
+		quarterExpiry, nextQuarterExpiry, err := fra.quarterExpiries(now)
+		if err != nil {
+			util.Error(fra.tag, "cannot get quarterly expiries", err.Error())
+			return
+		}
+		isQuarterHedged := future.hedgePair == future.quarterPair
+		quarter, err := markets.Quarterly(future.name, quarterExpiry)
+		if err != nil {
+			util.Warning(fra.tag, future.name, "no next quarter", err.Error())
+			if isQuarterHedged && future.size != 0 {
+				fra.stopPair(future)
+			}
+			if isQuarterHedged {
+				future.hedgePair = future.spotPair
+			}
+			if !future.hedgeable() {
+				util.Warning(fra.tag, future.name, "no pair to hedge with, stop trading")
+			}
+			future.quarterPair, future.nextQuarterPair = "", ""
+			continue
+		}
+		if isQuarterHedged && future.size != 0 {
+			if err := fra.rollPair(future, quarter.Name); err != nil {
+				// retried on the next check
+				util.Error(fra.tag, future.name, "cannot roll", err.Error())
+				continue
+			}
+		}
+		if isQuarterHedged {
+			future.hedgePair = quarter.Name
+		}
+		future.quarterPair = quarter.Name
+		future.quarterExpiry = quarter.Expiry
+		future.nextQuarterPair = ""
+		if next, err := markets.Quarterly(future.name, nextQuarterExpiry); err == nil {
+			future.nextQuarterPair = next.Name
+		}
+		// to roll into next time, see RequiredMarkets
+		if isQuarterHedged && future.nextQuarterPair != "" {
+			if err := fra.orderbooks.Subscribe(future.nextQuarterPair); err != nil {
+				util.Error(fra.tag, future.name, "cannot subscribe orderbook",
+					err.Error())
+			}
 		}
 	}
-	for _, name := range marketPairs.Spots {
-		usdExistIndex := strings.Index(name, "/USD")
-		usdtExistIndex := strings.Index(name, "/USDT")
-		if usdExistIndex != -1 && usdtExistIndex == -1 {
-			spotPairs[name] = true
+}
+
+// quarterExpiries returns the expiry of the quarter pairs are hedged with and
+// the next one, zero if there is none. Quarters expiring within rollBefore
+// are skipped since they are about to be rolled.
+func (fra *FRArb) quarterExpiries(now time.Time) (time.Time, time.Time, error) {
+	expiries, err := fra.exchange.Markets().QuarterlyExpiries(
+		now.Add(fra.rollBefore))
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	var current, next time.Time
+	if len(expiries) > 0 {
+		current = expiries[0]
+	}
+	if len(expiries) > 1 {
+		next = expiries[1]
+	}
+	return current, next, nil
+}
+
+// loadFutures creates futures on first call.
+func (fra *FRArb) loadFutures() {
+	fra.futuresOnce.Do(fra.createFutures)
+}
+func (fra *FRArb) createFutures() {
+	markets, err := fra.exchange.Markets().Markets()
+	if err != nil {
+		util.Error(fra.tag, "cannot get markets", err.Error())
+		return
+	}
+	quarterExpiry, nextQuarterExpiry, err := fra.quarterExpiries(time.Now())
+	if err != nil {
+		util.Warning(fra.tag, "cannot get quarterly expiries", err.Error())
+	}
+	// pairs of underlyings, markets orders cannot be made on are skipped
+	quarterPairs := make(map[string]string)
+	nextQuarterPairs := make(map[string]string)
+	spotPairs := make(map[string]string)
+	var perps []*exchange.Market
+	for _, m := range markets {
+		if !m.Tradable() {
+			continue
+		}
+		if m.IsSpot() && m.QuoteCurrency == "USD" {
+			spotPairs[m.BaseCurrency] = m.Name
+		} else if m.IsQuarterly() && m.Expiry.Equal(quarterExpiry) {
+			quarterPairs[m.Underlying] = m.Name
+		} else if m.IsQuarterly() && m.Expiry.Equal(nextQuarterExpiry) {
+			nextQuarterPairs[m.Underlying] = m.Name
+		} else if m.IsPerpetual() {
+			perps = append(perps, m)
 		}
 	}
 	// get previous funding rate
 	now := time.Now().Unix()
 	end := now - now%(60*60)
 	start := end - fra.prevRateDays*24*60*60
-	for _, perpPairName := range marketPairs.Perps {
-		spotName := strings.Split(perpPairName, "-")[0]
-		quarterPair := spotName + "-" + fra.quarterContractName
-		spotPair := spotName + "/USD"
-		_, isSpotPairExist := spotPairs[spotPair]
-		_, isQuarterPairExist := quarterPairs[quarterPair]
-		if isSpotPairExist {
-			_, isCollaterable := fra.ftx.CollaterableSpots[spotName]
+	for _, perp := range perps {
+		perpPairName := perp.Name
+		spotName := perp.Underlying
+		spotPair, isSpotPairExist := spotPairs[spotName]
+		quarterPair, isQuarterPairExist := quarterPairs[spotName]
+		if isSpotPairExist || isQuarterPairExist {
+			fundingRates, err := fra.exchange.GetFundingRates(start, end, perpPairName)
+			if err != nil {
+				util.Error(fra.tag, fmt.Sprintf("%s cannot get funding rates", spotName), err.Error())
+				continue
+			}
+			_, isCollaterable := fra.exchange.GetCollaterableSpots()[spotName]
 			f := &future{
 				name:           spotName,
 				perpPair:       perpPairName,
@@ -486,25 +665,39 @@ func (fra *FRArb) createFutures() {
 			}
 			if isQuarterPairExist {
 				f.quarterPair = quarterPair
+				f.quarterExpiry = quarterExpiry
+				f.nextQuarterPair = nextQuarterPairs[spotName]
 			}
 			if f.spotPair != "" {
 				f.hedgePair = spotPair
 			} else {
 				f.hedgePair = quarterPair
 			}
-			f.fundingRates = fra.ftx.GetFundingRates(start, end, perpPairName)
+			f.fundingRates = fundingRates
 			fra.futures[spotName] = f
 		} else {
 			util.Info(fra.tag, fmt.Sprintf("%s cannot be used", spotName))
 		}
 	}
 }
-func (fra *FRArb) GetRequiredPairs() []string {
-	fra.createFutures()
+
+// RequiredMarkets returns perps and hedges of pairs, and next quarters of
+// pairs hedged with quarters to roll into.
+func (fra *FRArb) RequiredMarkets() []string {
+	fra.loadFutures()
+	fra.futuresMutex.Lock()
+	defer fra.futuresMutex.Unlock()
 	var pairs []string
 	for _, future := range fra.futures {
+		if !future.hedgeable() {
+			continue
+		}
 		pairs = append(pairs, future.perpPair)
-		pairs = append(pairs, future.spotPair)
+		pairs = append(pairs, future.hedgePair)
+		// to roll into
+		if future.hedgePair == future.quarterPair && future.nextQuarterPair != "" {
+			pairs = append(pairs, future.nextQuarterPair)
+		}
 	}
 	return pairs
 }
@@ -519,94 +712,187 @@ func (fra *FRArb) updateFundingRateProfit() {
 			timeToNextCycle += 3600
 		}
 		sleepDuration := util.Duration{Second: timeToNextCycle}
-		time.Sleep(sleepDuration.GetTimeDuration())
-		for _, future := range fra.futures {
-			resp := fra.ftx.GetFutureStats(future.perpPair)
-			future.nextFundingRate = resp.NextFundingRate
-			end := int(24*fra.prevRateDays - 1)
-			if end > len(future.fundingRates) {
-				end = len(future.fundingRates)
-			}
-			future.fundingRates = append([]float64{future.nextFundingRate}, future.fundingRates[:end]...)
-			fundingRates := future.fundingRates
-			nextFundingAPR := fra.fundingRateToAPR(future.nextFundingRate)
-			util.Info(fra.tag, future.name, fmt.Sprintf("next funding rate: %f", future.nextFundingRate))
-			util.Info(fra.tag, future.name, fmt.Sprintf("next equivalent APR: %.2f%%", nextFundingAPR*100))
-			future.consCount = 1
-			for i := 1; i < len(fundingRates); i++ {
-				if fundingRates[i]*future.nextFundingRate <= 0 {
-					break
-				}
-				future.consCount++
-			}
-			totalRate := 0.0
-			for _, rate := range fundingRates {
-				totalRate += rate
-			}
-			toAnnual := float64(365*24) / float64(len(fundingRates))
-			future.avgAPR = math.Abs(totalRate) * toAnnual * fra.leverage / 2
-			util.Info(fra.tag, future.name, fmt.Sprintf("avgAPR: %.2f%%", future.avgAPR*100))
+		if !fra.sleep(sleepDuration.GetTimeDuration()) {
+			return
 		}
-		// update profit and current hedge profit
-		for name, future := range fra.futures {
-			_, isStartInThisHour := fra.startFuturesInThisHour[future.name]
-			// do not update profit if future just starts in this hour
-			if isStartInThisHour {
-				continue
-			}
-			if future.size != 0 {
-				fra.updateFutureProfit(future)
-				msg := fmt.Sprintf("earned %.2f USD on %s", future.hourlyFundingRateProfit, name)
-				util.Info(fra.tag, msg)
-				fra.send(msg)
+		fra.settleHour(fra.getNextFundingRates())
+	}
+}
+
+// getNextFundingRates returns next funding rates of futures by name, futures
+// whose rates cannot be got are left out. Stats are requested without holding
+// futuresMutex.
+func (fra *FRArb) getNextFundingRates() map[string]float64 {
+	perpPairs := make(map[string]string)
+	fra.futuresMutex.Lock()
+	for name, future := range fra.futures {
+		perpPairs[name] = future.perpPair
+	}
+	fra.futuresMutex.Unlock()
+	rates := make(map[string]float64)
+	for name, perpPair := range perpPairs {
+		resp, err := fra.exchange.GetFutureStats(perpPair)
+		if err != nil {
+			util.Error(fra.tag, name, "cannot get future stats", err.Error())
+			continue
+		}
+		rates[name] = resp.NextFundingRate
+	}
+	return rates
+}
+
+// settleHour records funding rates of the hour, adds the funding profit of
+// pairs and reports them.
+func (fra *FRArb) settleHour(nextFundingRates map[string]float64) {
+	fra.futuresMutex.Lock()
+	defer fra.futuresMutex.Unlock()
+	for name, nextFundingRate := range nextFundingRates {
+		future := fra.futures[name]
+		future.nextFundingRate = nextFundingRate
+		end := int(24*fra.prevRateDays - 1)
+		if end > len(future.fundingRates) {
+			end = len(future.fundingRates)
+		}
+		future.fundingRates = append([]float64{future.nextFundingRate}, future.fundingRates[:end]...)
+		fundingRates := future.fundingRates
+		nextFundingAPR := fra.fundingRateToAPR(future.nextFundingRate)
+		util.Info(fra.tag, future.name, fmt.Sprintf("next funding rate: %f", future.nextFundingRate))
+		util.Info(fra.tag, future.name, fmt.Sprintf("next equivalent APR: %.2f%%", nextFundingAPR*100))
+		future.consCount = 1
+		for i := 1; i < len(fundingRates); i++ {
+			if fundingRates[i]*future.nextFundingRate <= 0 {
+				break
 			}
+			future.consCount++
+		}
+		totalRate := 0.0
+		for _, rate := range fundingRates {
+			totalRate += rate
+		}
+		toAnnual := float64(365*24) / float64(len(fundingRates))
+		future.avgAPR = math.Abs(totalRate) * toAnnual * fra.leverage / 2
+		util.Info(fra.tag, future.name, fmt.Sprintf("avgAPR: %.2f%%", future.avgAPR*100))
+	}
+	// update profit and current hedge profit
+	for name, future := range fra.futures {
+		_, isStartInThisHour := fra.startFuturesInThisHour[future.name]
+		// do not update profit if future just starts in this hour
+		if isStartInThisHour {
+			continue
 		}
-		fra.sendFutureStatusReport()
-		fra.startFuturesInThisHour = make(map[string]bool)
-		// log rank
-		names := fra.sortAPR()
-		util.Info(fra.tag, "avgAPR Rank:")
-		for _, name := range names {
-			future := fra.futures[name]
-			msg := fmt.Sprintf(
-				"future: %s, avgAPR: %.2f%%, nextAPR: %.2f%%, consCount: %d",
-				name, future.avgAPR*100, fra.fundingRateToAPR(future.nextFundingRate)*100, future.consCount)
+		if future.size != 0 {
+			fra.updateFutureProfit(future)
+			msg := fmt.Sprintf("earned %.2f USD on %s", future.hourlyFundingRateProfit, name)
 			util.Info(fra.tag, msg)
+			fra.send(msg)
 		}
-		// generate ROI report
-		fra.sendTotalROIReport()
 	}
+	fra.sendFutureStatusReport()
+	fra.startFuturesInThisHour = make(map[string]bool)
+	// log rank
+	names := fra.sortAPR()
+	util.Info(fra.tag, "avgAPR Rank:")
+	for _, name := range names {
+		future := fra.futures[name]
+		msg := fmt.Sprintf(
+			"future: %s, avgAPR: %.2f%%, nextAPR: %.2f%%, consCount: %d",
+			name, future.avgAPR*100, fra.fundingRateToAPR(future.nextFundingRate)*100, future.consCount)
+		util.Info(fra.tag, msg)
+	}
+	// generate ROI report
+	fra.sendTotalROIReport()
 }
 func (fra *FRArb) updateNextFundingRates() {
 	// runs every 30 sec
 	updatePeriod := int64(30)
 	for {
 		sleepDuration := util.Duration{Second: updatePeriod}
-		time.Sleep(sleepDuration.GetTimeDuration())
+		if !fra.sleep(sleepDuration.GetTimeDuration()) {
+			return
+		}
 		now := time.Now().Unix() % 3600
 		if now >= 1800 {
 			util.Info(fra.tag, "updating funding rate")
-			for _, future := range fra.futures {
-				resp := fra.ftx.GetFutureStats(future.perpPair)
-				future.nextFundingRate = resp.NextFundingRate
+			rates := fra.getNextFundingRates()
+			fra.futuresMutex.Lock()
+			for name, rate := range rates {
+				fra.futures[name].nextFundingRate = rate
 			}
+			fra.futuresMutex.Unlock()
+		}
+	}
+}
+
+// waitOrderbook blocks while orderbooks are stale, it returns false if
+// stopped meanwhile.
+func (fra *FRArb) waitOrderbook() bool {
+	state := fra.orderbooks.State()
+	if state == exchange.WSConnected {
+		return true
+	}
+	util.Warning(fra.tag, "orderbook is "+state.String()+", pause")
+	for fra.orderbooks.State() != exchange.WSConnected {
+		if !fra.sleep(time.Second) {
+			return false
+		}
+	}
+	util.Info(fra.tag, "orderbook is live, resume")
+	return true
+}
+
+// watchFills reports executions on markets of the pairs as they happen.
+func (fra *FRArb) watchFills() {
+	fills := make(chan *util.Fill)
+	if err := fra.exchange.SubFills(fills); err != nil {
+		util.Warning(fra.tag, "cannot subscribe fills", err.Error())
+		return
+	}
+	for fill := range fills {
+		fra.reportFill(fill)
+	}
+}
+func (fra *FRArb) reportFill(fill *util.Fill) {
+	fra.futuresMutex.Lock()
+	defer fra.futuresMutex.Unlock()
+	for _, future := range fra.futures {
+		if fill.Market != future.perpPair && fill.Market != future.hedgePair {
+			continue
 		}
+		msg := fmt.Sprintf("%s %s %f @ %f for %s", fill.Side, fill.Market,
+			fill.Size, fill.Price, future.name)
+		util.Info(fra.tag, msg)
+		fra.send(msg)
+		return
 	}
 }
+
+// expiryCheckPeriod is how often Start checks quarters to roll.
+const expiryCheckPeriod = time.Minute
+
 func (fra *FRArb) Start() {
 	//value, exist := os.LookupEnv("ENV")
 	//isTestEnv := exist && value == "test"
-	fra.createFutures()
+	fra.loadFutures()
 	fra.startFuturesInThisHour = make(map[string]bool)
+	go fra.watchFills()
 	go fra.updateFundingRateProfit()
 	go fra.updateNextFundingRates()
 	prev := time.Now()
-	for {
+	var expiryChecked time.Time
+	for !fra.stopped() && fra.waitOrderbook() {
 		now := time.Now()
 		duration := now.Sub(prev)
 		util.Info(fra.tag, fmt.Sprintf("time used: %s", duration))
 		prev = now
+		fra.futuresMutex.Lock()
+		if now.Sub(expiryChecked) >= expiryCheckPeriod {
+			fra.rollQuarters(now)
+			expiryChecked = now
+		}
 		for _, future := range fra.futures {
+			if !future.hedgeable() {
+				continue
+			}
 			shouldStop, shouldStart := fra.genSignal(future)
 			if shouldStop {
 				fra.startFuturesInThisHour[future.name] = false
@@ -614,6 +900,7 @@ func (fra *FRArb) Start() {
 				fra.startFuturesInThisHour[future.name] = true
 			}
 		}
+		fra.futuresMutex.Unlock()
 		//timeToNextCycle := fra.updatePeriod - time.Now().Unix()%fra.updatePeriod
 		//sleepDuration := util.Duration{Second: timeToNextCycle}
 		//time.Sleep(sleepDuration.GetTimeDuration())
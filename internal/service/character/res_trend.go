@@ -7,6 +7,7 @@ package character
 
 import (
 	exchange "crypto-flash/internal/service/exchange"
+	"errors"
 	"fmt"
 	"math"
 	"time"
@@ -16,9 +17,15 @@ import (
 	util "crypto-flash/internal/service/util"
 )
 
+func init() {
+	RegisterStrategy("res_trend", func(c StrategyConfig) Strategy {
+		return NewResTrend(c.Exchange, c.Notifier)
+	}, true)
+}
+
 type ResTrend struct {
 	SignalProvider
-	ftx *exchange.FTX
+	exchange exchange.Exchange
 	// strategy config
 	market          string
 	mul             float64
@@ -41,9 +48,10 @@ type ResTrend struct {
 	mainCandle      *util.Candle
 	stopLossPrice   float64
 	takeProfitPrice float64
+	warmedUp        bool
 }
 
-func NewResTrend(ftx *exchange.FTX, notifier *Notifier) *ResTrend {
+func NewResTrend(ex exchange.Exchange, notifier *Notifier) *ResTrend {
 	return &ResTrend{
 		SignalProvider: SignalProvider{
 			tag:             "ResTrendProvider",
@@ -56,7 +64,7 @@ func NewResTrend(ftx *exchange.FTX, notifier *Notifier) *ResTrend {
 			takeProfitCount: 0,
 			stopLossCount:   0,
 		},
-		ftx: ftx,
+		exchange: ex,
 		// config
 		market:          "BTC-PERP",
 		mul:             1,
@@ -72,21 +80,28 @@ func NewResTrend(ftx *exchange.FTX, notifier *Notifier) *ResTrend {
 		mainCandle: nil,
 	}
 }
+func (rt *ResTrend) Name() string {
+	return "res_trend"
+}
+func (rt *ResTrend) RequiredMarkets() []string {
+	return []string{rt.market}
+}
+
+// Backtest runs the strategy on a backtest of its exchange with a trader
+// following the signals, and returns the ROI of the trader.
 func (rt *ResTrend) Backtest(startTime, endTime int64) float64 {
-	candles :=
-		rt.ftx.GetHistoryCandles(rt.market, rt.res, startTime, endTime)
-	rt.warmUp(startTime)
+	bt := exchange.NewBacktest(rt.exchange, backtestBalance, startTime, endTime)
+	s := NewResTrend(bt, nil)
 	util.Info(rt.tag, "start backtesting")
-	for _, candle := range candles {
-		rt.genSignal(candle)
-	}
-	roi := util.CalcROI(rt.initBalance, rt.balance)
+	roi := traderBacktest(s, bt, s.market, s.res, func(candle *util.Candle) {
+		s.handleCandle(candle)
+	})
 	util.Info(rt.tag,
-		fmt.Sprintf("balance: %.2f, total ROI: %.2f%%", rt.balance, roi*100))
-	winRate := float64(rt.takeProfitCount) /
-		float64(rt.takeProfitCount+rt.stopLossCount)
+		fmt.Sprintf("balance: %.2f, total ROI: %.2f%%", s.balance, roi*100))
+	winRate := float64(s.takeProfitCount) /
+		float64(s.takeProfitCount+s.stopLossCount)
 	util.Info(rt.tag, fmt.Sprintf("win rate: %.2f%%", winRate*100))
-	rt.showChart()
+	s.showChart()
 	return roi
 }
 func (rt *ResTrend) genSignal(candle *util.Candle) {
@@ -315,19 +330,22 @@ func (rt *ResTrend) AdjustParams() {
 	sp.sMul = bSMul
 	sp.period = bPeriod
 }*/
-func (rt *ResTrend) getCandles(from int64, res int) []*util.Candle {
+func (rt *ResTrend) getCandles(from int64, res int) ([]*util.Candle, error) {
 	res64 := int64(res)
 	last := from - from%res64
 	startTime := last - res64*(int64(rt.warmUpCandleNum)+1) + 1
 	endTime := last - res64
-	return rt.ftx.GetHistoryCandles(rt.market, res, startTime, endTime)
+	return rt.exchange.GetHistoryCandles(rt.market, res, startTime, endTime)
 }
-func (rt *ResTrend) warmUp(from int64) {
+func (rt *ResTrend) warmUp(from int64) error {
 	rt.st = indicator.NewSupertrend(rt.mul, rt.period)
 	rt.st.Tag = "Supertrend"
 	rt.mainST = indicator.NewSupertrend(rt.mainMul, rt.period)
 	rt.mainST.Tag = "Main Supertrend"
-	candles := rt.getCandles(from, rt.res)
+	candles, err := rt.getCandles(from, rt.res)
+	if err != nil {
+		return err
+	}
 	if len(candles) != rt.warmUpCandleNum {
 		util.Error(rt.tag, "Error on getting warmup candles")
 	}
@@ -347,11 +365,17 @@ func (rt *ResTrend) warmUp(from int64) {
 			break
 		}
 	}
+	if mainCandleStart < 0 {
+		return errors.New("no candle starts a main candle")
+	}
 	rt.mainCandle = candles[mainCandleStart]
 	for i := mainCandleStart + 1; i < len(candles); i++ {
 		rt.mainCandle.Update(candles[i])
 	}
-	candles = rt.getCandles(from, rt.mainRes)
+	candles, err = rt.getCandles(from, rt.mainRes)
+	if err != nil {
+		return err
+	}
 	for _, candle := range candles {
 		mainSupertrend := rt.mainST.Update(candle)
 		rt.prevMainTrend = rt.mainTrend
@@ -361,12 +385,43 @@ func (rt *ResTrend) warmUp(from int64) {
 			rt.mainTrend = "bear"
 		}
 	}
+	return nil
 }
 func (rt *ResTrend) Start() {
-	rt.warmUp(time.Now().Unix())
-	candleChan := make(chan *util.Candle)
-	go rt.ftx.SubCandle(rt.market, rt.res, candleChan)
-	for candle := range candleChan {
-		rt.genSignal(candle)
+	candleChan := make(chan *util.Candle, 16)
+	err := rt.exchange.SubCandle(rt.context(), rt.market, rt.res, candleChan)
+	if err != nil {
+		util.Error(rt.tag, "cannot subscribe candles", err.Error())
+		return
+	}
+	for {
+		var candle *util.Candle
+		select {
+		case candle = <-candleChan:
+		case <-rt.stopChan():
+			return
+		}
+		// closed by the exchange at the end of a backtest
+		if candle == nil {
+			return
+		}
+		if err := rt.handleCandle(candle); err != nil {
+			return
+		}
+	}
+}
+
+// handleCandle warms up with candles before the first one, so no candle is
+// missed between warm up and streaming and backtests warm up in the past,
+// then generates signals.
+func (rt *ResTrend) handleCandle(candle *util.Candle) error {
+	if !rt.warmedUp {
+		if err := rt.warmUp(candle.GetTime().Unix()); err != nil {
+			util.Error(rt.tag, "Error on getting warmup candles", err.Error())
+			return err
+		}
+		rt.warmedUp = true
 	}
+	rt.genSignal(candle)
+	return nil
 }
@@ -15,9 +15,15 @@ import (
 	util "crypto-flash/internal/service/util"
 )
 
+func init() {
+	RegisterStrategy("shannon", func(c StrategyConfig) Strategy {
+		return NewShannon(c.Exchange, c.Notifier)
+	}, true)
+}
+
 type Shannon struct {
 	SignalProvider
-	ftx *exchange.FTX
+	exchange exchange.Exchange
 	// strategy config
 	market       string
 	updatePeriod time.Duration
@@ -28,7 +34,7 @@ type Shannon struct {
 	opCount int
 }
 
-func NewShannon(ftx *exchange.FTX, notifier *Notifier) *Shannon {
+func NewShannon(ex exchange.Exchange, notifier *Notifier) *Shannon {
 	return &Shannon{
 		SignalProvider: SignalProvider{
 			tag:             "ShannonProvider",
@@ -41,7 +47,7 @@ func NewShannon(ftx *exchange.FTX, notifier *Notifier) *Shannon {
 			takeProfitCount: 0,
 			stopLossCount:   0,
 		},
-		ftx: ftx,
+		exchange: ex,
 		// config
 		market:       "BTC/USD",
 		updatePeriod: 5 * time.Second,
@@ -53,9 +59,19 @@ func NewShannon(ftx *exchange.FTX, notifier *Notifier) *Shannon {
 	}
 }
 
+func (sh *Shannon) Name() string {
+	return "shannon"
+}
+func (sh *Shannon) RequiredMarkets() []string {
+	return []string{sh.market}
+}
 func (sh *Shannon) Backtest(startTime, endTime int64) float64 {
-	candles :=
-		sh.ftx.GetHistoryCandles(sh.market, 300, startTime, endTime)
+	candles, err :=
+		sh.exchange.GetHistoryCandles(sh.market, 300, startTime, endTime)
+	if err != nil {
+		util.Error(sh.tag, "cannot get backtest candles", err.Error())
+		return 0
+	}
 	util.Info(sh.tag, "start backtesting")
 	for _, candle := range candles {
 		sh.genSignal(candle.GetAvg(), candle.GetAvg())
@@ -95,12 +111,41 @@ func (sh *Shannon) genSignal(ask, bid float64) {
 		fmt.Sprintf("balance: %.2f, total ROI: %.2f%%", sh.balance, roi*100))
 	util.Info(sh.tag, "operation count:", util.PI(sh.opCount))
 }
+
+// Start rebalances on each change of the best bid or ask, or polls the
+// orderbook if the ticker is not available.
 func (sh *Shannon) Start() {
-	for {
-		orderbook := sh.ftx.GetOrderbook(sh.market, 1)
-		bp, _ := orderbook.GetMarketBuyPrice()
-		sp, _ := orderbook.GetMarketSellPrice()
-		sh.genSignal(bp, sp)
-		time.Sleep(sh.updatePeriod)
+	tickers := make(chan *util.Ticker)
+	err := sh.exchange.SubTicker(sh.context(), sh.market, tickers)
+	if err == nil {
+		var bid, ask float64
+		for {
+			var ticker *util.Ticker
+			select {
+			case ticker = <-tickers:
+			case <-sh.stopChan():
+				return
+			}
+			if ticker == nil {
+				return
+			}
+			if ticker.Bid == bid && ticker.Ask == ask {
+				continue
+			}
+			bid, ask = ticker.Bid, ticker.Ask
+			sh.genSignal(ask, bid)
+		}
+	}
+	util.Error(sh.tag, "cannot subscribe ticker", err.Error())
+	for !sh.stopped() {
+		orderbook, err := sh.exchange.GetOrderbook(sh.market, 1)
+		if err != nil {
+			util.Error(sh.tag, "cannot get orderbook", err.Error())
+		} else {
+			bp, _ := orderbook.GetMarketBuyPrice()
+			sp, _ := orderbook.GetMarketSellPrice()
+			sh.genSignal(bp, sp)
+		}
+		sh.sleep(sh.updatePeriod)
 	}
 }
@@ -9,9 +9,11 @@
 package character
 
 import (
+	"context"
 	util "crypto-flash/internal/service/util"
 	"fmt"
 	"os"
+	"sync"
 	"time"
 
 	chart "github.com/wcharczuk/go-chart"
@@ -31,6 +33,48 @@ type SignalProvider struct {
 	stopLossCount   int
 	takeProfitCount int
 	profits         []float64
+	// cancelled by Stop, created on the first use
+	stopMutex sync.Mutex
+	ctx       context.Context
+	cancel    context.CancelFunc
+}
+
+// Stop makes Start of the provider return, it can be called more than once.
+func (sp *SignalProvider) Stop() {
+	sp.context()
+	sp.cancel()
+}
+
+// context returns a context cancelled by Stop, subscriptions of Start are
+// made with it so they end with the provider.
+func (sp *SignalProvider) context() context.Context {
+	sp.stopMutex.Lock()
+	defer sp.stopMutex.Unlock()
+	if sp.ctx == nil {
+		sp.ctx, sp.cancel = context.WithCancel(context.Background())
+	}
+	return sp.ctx
+}
+func (sp *SignalProvider) stopChan() <-chan struct{} {
+	return sp.context().Done()
+}
+func (sp *SignalProvider) stopped() bool {
+	select {
+	case <-sp.stopChan():
+		return true
+	default:
+		return false
+	}
+}
+
+// sleep waits for d and returns false if the provider is stopped meanwhile.
+func (sp *SignalProvider) sleep(d time.Duration) bool {
+	select {
+	case <-sp.stopChan():
+		return false
+	case <-time.After(d):
+		return true
+	}
 }
 
 func (sp *SignalProvider) broadcast(msg string) {
@@ -111,11 +155,11 @@ func (sp *SignalProvider) notifyOpenPosition(reason string) {
 		return
 	}
 	msg := fmt.Sprintf("start %s @ %.2f due to %s",
-		sp.position.Side, sp.position.OpenPrice, reason)
+		sp.position.Side, util.F64(sp.position.OpenPrice), reason)
 	sp.notifier.Broadcast(sp.tag, msg)
 }
 func (sp *SignalProvider) closePosition(price float64, reason string) float64 {
-	roi := sp.position.Close(price)
+	roi := sp.position.Close(util.D(price))
 	sp.balance *= 1 + roi
 	sp.profits = append(sp.profits, sp.balance-sp.initBalance)
 	logMsg := fmt.Sprintf("close %s @ %.2f due to %s, ROI: %.2f%%",
@@ -133,7 +177,7 @@ func (sp *SignalProvider) closePosition(price float64, reason string) float64 {
 }
 func (sp *SignalProvider) openPosition(
 	side string, size, price float64, reason string) {
-	sp.position = util.NewPosition(side, size, price)
+	sp.position = util.NewPosition(side, util.D(size), util.D(price))
 	logMsg := fmt.Sprintf("start %s @ %.2f due to %s", side, price, reason)
 	if side == "long" {
 		util.Info(sp.tag, util.Green(logMsg))
@@ -0,0 +1,122 @@
+package character
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	exchange "crypto-flash/internal/service/exchange"
+
+	util "crypto-flash/internal/service/util"
+)
+
+// Strategy is a signal provider which can be selected by name in config.
+type Strategy interface {
+	Name() string
+	// RequiredMarkets returns markets whose orderbooks should be subscribed
+	// before Start
+	RequiredMarkets() []string
+	// Start runs the strategy until Stop
+	Start()
+	Stop()
+	// Backtest returns the ROI between startTime and endTime in unix seconds,
+	// it is only called if the strategy is registered as backtestable
+	Backtest(startTime, endTime int64) float64
+}
+
+// Signaler is a strategy whose signals a Trader can follow.
+type Signaler interface {
+	SubSignal(signalChan chan<- *util.Signal)
+}
+
+// backtestBalance is the USD balance traders start backtests with.
+const backtestBalance = 10000.0
+
+// traderBacktest replays candles of market on bt to handle, and trades
+// signals of s made meanwhile with a Trader on bt before the next candle, so
+// signals are traded the same way as live. The trader has no background
+// loops, exits filled by a candle are checked before it is handled instead,
+// so the result is the same on every run. The position is closed at the end
+// and the ROI of the trader is returned. s must be created with bt.
+func traderBacktest(s Signaler, bt *exchange.Backtest, market string,
+	resolution int, handle func(candle *util.Candle)) float64 {
+	// a candle makes a few signals at most
+	signalChan := make(chan *util.Signal, 16)
+	s.SubSignal(signalChan)
+	trader := newTrader("backtest", bt, nil)
+	trader.startTime = time.Now()
+	err := bt.Replay(market, resolution, func(candle *util.Candle) {
+		trader.checkStopLoss()
+		trader.checkTakeProfit()
+		handle(candle)
+		for len(signalChan) > 0 {
+			trader.handleSignal(<-signalChan)
+		}
+	})
+	if err != nil {
+		util.Error(trader.tag, "cannot replay candles", err.Error())
+		return 0
+	}
+	if orderbook, err := bt.GetOrderbook(market, 1); err == nil {
+		price, _ := orderbook.GetMarketSellPrice()
+		trader.closePosition(market, price, "end of backtest")
+	}
+	wallet, err := bt.GetWallet()
+	if err != nil {
+		util.Error(trader.tag, "cannot get balance", err.Error())
+		return 0
+	}
+	return util.CalcROI(backtestBalance, util.F64(wallet.GetBalance("USD")))
+}
+
+// StrategyConfig is what factories create strategies with. Orderbooks are
+// shared by strategies.
+type StrategyConfig struct {
+	Exchange   exchange.Exchange
+	Notifier   *Notifier
+	Owner      string
+	Orderbooks *exchange.OrderbookStore
+}
+type StrategyFactory func(c StrategyConfig) Strategy
+type registration struct {
+	factory  StrategyFactory
+	backtest bool
+}
+
+// strategies are registered by init functions, so they are not locked.
+var strategies = make(map[string]registration)
+
+// RegisterStrategy makes a strategy available by name, backtest tells whether
+// its Backtest is implemented. It panics if name is registered twice.
+func RegisterStrategy(name string, factory StrategyFactory, backtest bool) {
+	if _, exist := strategies[name]; exist {
+		panic("strategy " + name + " is registered twice")
+	}
+	strategies[name] = registration{factory: factory, backtest: backtest}
+}
+
+// NewStrategy creates the strategy registered as name.
+func NewStrategy(name string, c StrategyConfig) (Strategy, error) {
+	r, exist := strategies[name]
+	if !exist {
+		return nil, fmt.Errorf("unknown strategy %q, available: %v", name,
+			Strategies())
+	}
+	return r.factory(c), nil
+}
+
+// CanBacktest reports whether the strategy registered as name can run in
+// backtest mode.
+func CanBacktest(name string) bool {
+	return strategies[name].backtest
+}
+
+// Strategies returns names of registered strategies in order.
+func Strategies() []string {
+	var names []string
+	for name := range strategies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,216 @@
+package character
+
+import (
+	"context"
+	"math"
+	"os"
+	"testing"
+	"time"
+
+	exchange "crypto-flash/internal/service/exchange"
+	"crypto-flash/internal/service/exchange/ftxtest"
+	util "crypto-flash/internal/service/util"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStrategies(t *testing.T) {
+	assert.Equal(t, []string{"fr_arbitrage", "fr_arbitrage_fork", "res_trend",
+		"shannon"}, Strategies())
+	for _, name := range Strategies() {
+		s, err := NewStrategy(name, StrategyConfig{Owner: "owner"})
+		assert.Nil(t, err)
+		assert.Equal(t, name, s.Name())
+	}
+	_, err := NewStrategy("unknown", StrategyConfig{})
+	assert.NotNil(t, err)
+	assert.True(t, CanBacktest("res_trend"))
+	assert.False(t, CanBacktest("fr_arbitrage"))
+	assert.False(t, CanBacktest("unknown"))
+	assert.Panics(t, func() {
+		RegisterStrategy("shannon", nil, true)
+	})
+}
+
+func TestSignalProviderStop(t *testing.T) {
+	sp := &SignalProvider{}
+	assert.False(t, sp.stopped())
+	done := make(chan bool)
+	go func() {
+		done <- sp.sleep(time.Hour)
+	}()
+	sp.Stop()
+	sp.Stop()
+	assert.False(t, <-done)
+	assert.True(t, sp.stopped())
+}
+
+// silentExchange accepts ticker subscriptions but never sends a ticker.
+type silentExchange struct {
+	exchange.Exchange
+	subs chan context.Context
+}
+
+func (se *silentExchange) SubTicker(ctx context.Context, market string,
+	c chan<- *util.Ticker) error {
+	se.subs <- ctx
+	return nil
+}
+
+func TestShannonStop(t *testing.T) {
+	ex := &silentExchange{subs: make(chan context.Context, 1)}
+	sh := NewShannon(ex, nil)
+	done := make(chan struct{})
+	go func() {
+		sh.Start()
+		close(done)
+	}()
+	ctx := <-ex.subs
+	sh.Stop()
+	// returns without another ticker and cancels the subscription
+	<-done
+	assert.NotNil(t, ctx.Err())
+}
+
+// waveSource makes candles of any resolution from a sine wave of prices.
+type waveSource struct {
+	exchange.Exchange
+}
+
+func (ws *waveSource) price(t int64) float64 {
+	return 30000 + 2000*math.Sin(float64(t)/(86400/math.Pi))
+}
+func (ws *waveSource) GetHistoryCandles(market string, resolution int,
+	startTime int64, endTime int64) ([]*util.Candle, error) {
+	res := int64(resolution)
+	var candles []*util.Candle
+	for t := startTime - startTime%res; t <= endTime; t += res {
+		if t < startTime {
+			continue
+		}
+		open, close := ws.price(t), ws.price(t+res)
+		candles = append(candles, util.NewCandle(open, math.Max(open, close),
+			math.Min(open, close), close, 1,
+			time.Unix(t, 0).UTC().Format(time.RFC3339)))
+	}
+	return candles, nil
+}
+func (ws *waveSource) GetFee() float64 {
+	return 0.0007
+}
+func (ws *waveSource) GetCollaterableSpots() map[string]float64 {
+	return nil
+}
+
+func TestResTrendBacktest(t *testing.T) {
+	// the chart is written to the working directory
+	wd, _ := os.Getwd()
+	os.Chdir(t.TempDir())
+	defer os.Chdir(wd)
+	rt := NewResTrend(&waveSource{}, nil)
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC).Unix()
+	roi := rt.Backtest(start, start+10*86400)
+	// the trader follows signals on each take profit of the wave
+	assert.True(t, roi > 0)
+}
+
+func TestTraderBacktestRepeatable(t *testing.T) {
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC).Unix()
+	run := func() (float64, []*util.Fill) {
+		bt := exchange.NewBacktest(&waveSource{}, backtestBalance, start,
+			start+10*86400)
+		s := NewResTrend(bt, nil)
+		roi := traderBacktest(s, bt, s.market, s.res,
+			func(candle *util.Candle) {
+				s.handleCandle(candle)
+			})
+		fills, err := bt.GetFills("", 0, 0)
+		assert.Nil(t, err)
+		return roi, fills
+	}
+	roi, fills := run()
+	assert.NotEmpty(t, fills)
+	for i := 0; i < 2; i++ {
+		again, againFills := run()
+		assert.Equal(t, roi, again)
+		assert.Equal(t, fills, againFills)
+	}
+}
+
+// quarterExchange lists quarterly futures of BTC.
+type quarterExchange struct {
+	exchange.Exchange
+	markets *exchange.MarketCatalog
+}
+
+func (qe *quarterExchange) Markets() *exchange.MarketCatalog {
+	return qe.markets
+}
+func (qe *quarterExchange) GetFee() float64 {
+	return 0.0007
+}
+
+func TestFRArbRollQuarters(t *testing.T) {
+	june := time.Date(2021, 6, 25, 3, 0, 0, 0, time.UTC)
+	september := time.Date(2021, 9, 24, 3, 0, 0, 0, time.UTC)
+	december := time.Date(2021, 12, 31, 3, 0, 0, 0, time.UTC)
+	quarter := func(name string, expiry time.Time) *exchange.Market {
+		return &exchange.Market{Name: name, Type: "future", Enabled: true,
+			Underlying: "BTC", FutureType: "future", Expiry: expiry}
+	}
+	ex := &quarterExchange{markets: exchange.NewMarketCatalog(
+		func() ([]*exchange.Market, error) {
+			return []*exchange.Market{quarter("BTC-0625", june),
+				quarter("BTC-0924", september),
+				quarter("BTC-1231", december)}, nil
+		}, time.Hour)}
+
+	server := ftxtest.NewServer()
+	defer server.Close()
+	server.Partial("BTC-0625", [][]float64{{100, 10}}, [][]float64{{101, 10}})
+	server.Partial("BTC-0924", [][]float64{{105, 10}}, [][]float64{{106, 10}})
+	ftx := exchange.NewFTX("", "", "", exchange.WithWSURL(server.URL()))
+	store := exchange.NewOrderbookStore()
+	assert.Nil(t, ftx.SubscribeOrderbook(store, []string{"BTC-0625", "BTC-0924"}))
+	for _, market := range []string{"BTC-0625", "BTC-0924"} {
+		for len(store.Get(market).Bids) == 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	fra := NewFRArb(ex, nil, "owner", store)
+	fra.futures["BTC"] = &future{name: "BTC", perpPair: "BTC-PERP",
+		quarterPair: "BTC-0625", hedgePair: "BTC-0625", quarterExpiry: june,
+		nextQuarterPair: "BTC-0924", size: 1000, hedgeEnterPrice: 100}
+	fra.rollQuarters(june.Add(-time.Hour))
+	future := fra.futures["BTC"]
+	assert.Equal(t, "BTC-0924", future.hedgePair)
+	assert.Equal(t, september, future.quarterExpiry)
+	// the short hedge is opened again at the bid
+	assert.Equal(t, 105.0, future.hedgeEnterPrice)
+	// the quarter after is subscribed to roll into next time
+	assert.Equal(t, "BTC-1231", future.nextQuarterPair)
+	assert.Nil(t, server.WaitSubscribers("orderbook", "BTC-1231", 1, time.Second))
+}
+
+func TestFRArbLastQuarterExpires(t *testing.T) {
+	june := time.Date(2021, 6, 25, 3, 0, 0, 0, time.UTC)
+	ex := &quarterExchange{markets: exchange.NewMarketCatalog(
+		func() ([]*exchange.Market, error) {
+			return []*exchange.Market{{Name: "BTC-0625", Type: "future",
+				Enabled: true, Underlying: "BTC", FutureType: "future",
+				Expiry: june}}, nil
+		}, time.Hour)}
+	fra := NewFRArb(ex, nil, "owner", exchange.NewOrderbookStore())
+	// BTC has no spot pair and no quarter after June
+	fra.futures["BTC"] = &future{name: "BTC", perpPair: "BTC-PERP",
+		quarterPair: "BTC-0625", hedgePair: "BTC-0625", quarterExpiry: june,
+		fundingRates: []float64{0, 0}, size: 1000, hedgeEnterPrice: 100}
+	fra.rollQuarters(june.Add(-time.Hour))
+	future := fra.futures["BTC"]
+	assert.Equal(t, 0.0, future.size)
+	assert.Equal(t, "", future.quarterPair)
+	// it is not traded or subscribed anymore
+	assert.False(t, future.hedgeable())
+	assert.Empty(t, fra.RequiredMarkets())
+}
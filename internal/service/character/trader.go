@@ -8,15 +8,16 @@
 // Input: signal provider
 // Output: exchange trade API or notifier
 // TODO:
-// 1. track order
-// 2. precautions
-// 3. track free balance (fund pool)
+// 1. precautions
+// 2. track free balance (fund pool)
 */
 package character
 
 import (
+	"context"
 	exchange "crypto-flash/internal/service/exchange"
 	"fmt"
+	"sync"
 	"time"
 
 	util "crypto-flash/internal/service/util"
@@ -27,7 +28,7 @@ type Trader struct {
 	tag               string
 	owner             string
 	startTime         time.Time
-	ftx               *exchange.FTX
+	exchange          exchange.Exchange
 	notifier          *Notifier
 	wallet            *util.Wallet
 	market            string
@@ -39,19 +40,50 @@ type Trader struct {
 	updatePeriod      time.Duration
 	stopLoss          float64
 	takeProfit        float64
+	// ids of exit orders of the current position, 0 if not placed
+	takeProfitID  int64
+	stopLossID    int64
+	stopLossOrder *util.Order
+	// guards the wallet, position and its exit orders, which are changed by
+	// signals, executions and status updates in different goroutines
+	positionMutex sync.Mutex
+	// latest tickers of watched markets, nil before the first one. Tickers
+	// are not watched if the map is nil, e.g. in backtests
+	tickerMutex sync.Mutex
+	tickers     map[string]*util.Ticker
 }
 
-// NewTrader creates a trader instance
-func NewTrader(owner string, ftx *exchange.FTX, notifier *Notifier) *Trader {
-	w := ftx.GetWallet()
-	util.Success("Trader-"+owner, "successfully get balance", w.String())
+// tickers older than this are stale and the orderbook is fetched instead
+const tickerTTL = 30 * time.Second
+
+// NewTrader creates a trader instance, which watches tickers, executions and
+// its status in the background.
+func NewTrader(owner string, ex exchange.Exchange, notifier *Notifier) *Trader {
+	t := newTrader(owner, ex, notifier)
+	t.tickers = make(map[string]*util.Ticker)
+	t.watchTicker(t.market)
+	go t.updateStatus()
+	go t.watchExecutions()
+	return t
+}
+
+// newTrader creates a trader without background work, so its status is only
+// changed by calls made by the caller, as backtests need to be repeatable.
+func newTrader(owner string, ex exchange.Exchange, notifier *Notifier) *Trader {
+	w, err := ex.GetWallet()
+	if err != nil {
+		util.Error("Trader-"+owner, "cannot get balance", err.Error())
+		w = util.NewWallet()
+	} else {
+		util.Success("Trader-"+owner, "successfully get balance", w.String())
+	}
 	t := &Trader{
 		tag:         "Trader-" + owner,
 		owner:       owner,
-		ftx:         ftx,
+		exchange:    ex,
 		notifier:    notifier,
 		wallet:      w,
-		initBalance: w.GetBalance("USD"),
+		initBalance: util.F64(w.GetBalance("USD")),
 		market:      "BTC-PERP",
 		position:    nil,
 		// ignore first signal?
@@ -59,21 +91,24 @@ func NewTrader(owner string, ftx *exchange.FTX, notifier *Notifier) *Trader {
 		leverage:          1,
 		updatePeriod:      10 * 60 * time.Second,
 	}
-	go t.updateStatus()
 	return t
 }
 func (t *Trader) notifyROI() {
 	if t.notifier == nil {
 		return
 	}
-	t.wallet = t.ftx.GetWallet()
-	roi := util.CalcROI(t.initBalance, t.wallet.GetBalance("USD"))
+	wallet, err := t.exchange.GetWallet()
+	if err != nil {
+		util.Error(t.tag, "cannot get balance", err.Error())
+		return
+	}
+	roi := util.CalcROI(t.initBalance, util.F64(wallet.GetBalance("USD")))
 	msg := "Report\n"
 	runTime := time.Now().Sub(t.startTime)
 	d := util.FromTimeDuration(runTime)
 	msg += "Runtime: " + d.String() + "\n"
 	msg += fmt.Sprintf("Init Balance: %.2f\n", t.initBalance)
-	msg += fmt.Sprintf("Balance: %.2f\n", t.wallet.GetBalance("USD"))
+	msg += fmt.Sprintf("Balance: %s\n", wallet.GetBalance("USD").StringFixed(2))
 	msg += fmt.Sprintf("ROI: %.2f%%\n", roi*100)
 	ar := roi * (86400 * 365) / runTime.Seconds()
 	msg += fmt.Sprintf("Annualized Return: %.2f%%", ar*100)
@@ -94,25 +129,276 @@ func (t *Trader) notifyOpenPosition(reason string) {
 		return
 	}
 	msg := fmt.Sprintf("start %s @ %.2f due to %s",
-		t.position.Side, t.position.OpenPrice, reason)
+		t.position.Side, util.F64(t.position.OpenPrice), reason)
 	t.notifier.Send(t.tag, t.owner, msg)
 }
+
+// notifyError logs err and tells the owner which action failed.
+func (t *Trader) notifyError(action string, err error) {
+	util.Error(t.tag, action, err.Error())
+	if t.notifier == nil {
+		return
+	}
+	t.notifier.Send(t.tag, t.owner, fmt.Sprintf("%s: %s", action, err))
+}
+
+// confirmOrder waits until the order is closed and returns its final status,
+// or the last status seen if it is still open after a few seconds.
+func (t *Trader) confirmOrder(id int64) (*util.OrderStatus, error) {
+	for i := 0; ; i++ {
+		status, err := t.exchange.GetOrder(id)
+		if err != nil {
+			return nil, err
+		}
+		if status.IsClosed() || i >= 10 {
+			return status, nil
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+// cancelExitOrders cancels take profit and stop loss of the closed position.
+func (t *Trader) cancelExitOrders(market string) {
+	if t.takeProfitID != 0 {
+		status, err := t.exchange.GetOrder(t.takeProfitID)
+		if err != nil {
+			t.notifyError("cannot get take profit", err)
+		} else if !status.IsClosed() {
+			if err := t.exchange.CancelOrder(t.takeProfitID); err != nil {
+				t.notifyError("cannot cancel take profit", err)
+			}
+		}
+		t.takeProfitID = 0
+	}
+	if t.stopLossID != 0 {
+		stopLoss, err := t.getStopLoss()
+		if err != nil {
+			t.notifyError("cannot get stop loss", err)
+		} else if stopLoss != nil && stopLoss.IsOpen() {
+			if err := t.exchange.CancelTriggerOrder(t.stopLossID); err != nil {
+				t.notifyError("cannot cancel stop loss", err)
+			}
+		}
+		t.stopLossID = 0
+	}
+}
+
+// getStopLoss returns the stop loss of the current position, or nil if it
+// cannot be found.
+func (t *Trader) getStopLoss() (*util.TriggerOrderStatus, error) {
+	orders, err := t.exchange.GetOpenTriggerOrders(t.market)
+	if err != nil {
+		return nil, err
+	}
+	for _, o := range orders {
+		if o.ID == t.stopLossID {
+			return o, nil
+		}
+	}
+	orders, err = t.exchange.GetTriggerOrderHistory(t.market, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	for _, o := range orders {
+		if o.ID == t.stopLossID {
+			return o, nil
+		}
+	}
+	return nil, nil
+}
+
+// checkStopLoss closes the position if its stop loss is triggered, or places
+// the stop loss again if it is gone.
+func (t *Trader) checkStopLoss() {
+	t.positionMutex.Lock()
+	defer t.positionMutex.Unlock()
+	if t.position == nil || t.stopLossID == 0 {
+		return
+	}
+	stopLoss, err := t.getStopLoss()
+	if err != nil {
+		util.Error(t.tag, "cannot check stop loss", err.Error())
+		return
+	}
+	if stopLoss != nil && stopLoss.IsOpen() {
+		util.Success(t.tag, "stop loss is open")
+		return
+	}
+	if stopLoss != nil && stopLoss.IsTriggered() {
+		util.Info(t.tag, "stop loss triggered at "+stopLoss.TriggeredAt)
+		t.stopLossID = 0
+		t.closePositionLocked(t.market, stopLoss.AvgFillPrice,
+			"stop loss triggered")
+		return
+	}
+	t.notifyError("stop loss is gone, place it again",
+		fmt.Errorf("conditional order %d not open", t.stopLossID))
+	if id, err := t.exchange.MakeOrder(t.stopLossOrder); err != nil {
+		t.notifyError("cannot place stop loss", err)
+	} else {
+		t.stopLossID = id
+	}
+}
+
+// checkTakeProfit closes the position if its take profit is filled, in case
+// the order update is missed.
+func (t *Trader) checkTakeProfit() {
+	t.positionMutex.Lock()
+	defer t.positionMutex.Unlock()
+	if t.position == nil || t.takeProfitID == 0 {
+		return
+	}
+	status, err := t.exchange.GetOrder(t.takeProfitID)
+	if err != nil {
+		util.Error(t.tag, "cannot check take profit", err.Error())
+		return
+	}
+	t.takeProfitFilled(status)
+}
+
+// takeProfitFilled closes the position if order is its filled take profit,
+// positionMutex must be held.
+func (t *Trader) takeProfitFilled(order *util.OrderStatus) {
+	if t.position != nil && t.takeProfitID != 0 &&
+		order.ID == t.takeProfitID && order.IsFilled() {
+		t.takeProfitID = 0
+		t.closePositionLocked(order.Market, order.AvgFillPrice, "take profit")
+	}
+}
 func (t *Trader) updateStatus() {
 	for {
-		t.wallet = t.ftx.GetWallet()
-		util.Success(t.tag, "successfully update balance", t.wallet.String())
-		t.curPosition = t.ftx.GetPosition(t.market)
-		if t.curPosition != nil {
-			util.Success(t.tag, "successfully update position",
-				t.curPosition.String())
+		t.refreshStatus()
+		time.Sleep(t.updatePeriod)
+	}
+}
+
+// refreshStatus fetches the wallet and the position without positionMutex,
+// and stores them with it held.
+func (t *Trader) refreshStatus() {
+	if wallet, err := t.exchange.GetWallet(); err != nil {
+		util.Error(t.tag, "cannot update balance", err.Error())
+	} else {
+		t.positionMutex.Lock()
+		t.wallet = wallet
+		t.positionMutex.Unlock()
+		util.Success(t.tag, "successfully update balance", wallet.String())
+	}
+	if pos, err := t.exchange.GetPosition(t.market); err != nil {
+		util.Error(t.tag, "cannot update position", err.Error())
+	} else {
+		t.positionMutex.Lock()
+		t.curPosition = pos
+		t.positionMutex.Unlock()
+		if pos != nil {
+			util.Success(t.tag, "successfully update position", pos.String())
 		} else {
 			util.Success(t.tag, "no current position")
 		}
-		time.Sleep(t.updatePeriod)
 	}
+	t.checkStopLoss()
+	t.checkTakeProfit()
+}
+
+// watchTicker keeps the latest ticker of market in the background, tickers
+// of each market are only subscribed once.
+func (t *Trader) watchTicker(market string) {
+	t.tickerMutex.Lock()
+	defer t.tickerMutex.Unlock()
+	if _, exist := t.tickers[market]; exist || t.tickers == nil {
+		return
+	}
+	t.tickers[market] = nil
+	tickers := make(chan *util.Ticker)
+	err := t.exchange.SubTicker(context.Background(), market, tickers)
+	if err != nil {
+		util.Warning(t.tag, "cannot subscribe ticker of", market, err.Error())
+		return
+	}
+	go func() {
+		for ticker := range tickers {
+			t.tickerMutex.Lock()
+			t.tickers[market] = ticker
+			t.tickerMutex.Unlock()
+		}
+	}()
+}
+
+// getOrderbook returns the top of book of market from the latest ticker, or
+// from REST if the ticker is stale or misses a price.
+func (t *Trader) getOrderbook(market string) (*util.Orderbook, error) {
+	t.watchTicker(market)
+	t.tickerMutex.Lock()
+	ticker := t.tickers[market]
+	t.tickerMutex.Unlock()
+	if ticker == nil || time.Since(ticker.ReceivedAt) > tickerTTL ||
+		ticker.Ask <= 0 || ticker.Bid <= 0 {
+		return t.exchange.GetOrderbook(market, 1)
+	}
+	orderbook := &util.Orderbook{}
+	orderbook.Add("ask", util.D(ticker.Ask), util.D(ticker.AskSize))
+	orderbook.Add("bid", util.D(ticker.Bid), util.D(ticker.BidSize))
+	return orderbook, nil
+}
+
+// watchExecutions refreshes status on fills and closes the position when take
+// profit is filled, instead of waiting for the next periodic update.
+func (t *Trader) watchExecutions() {
+	fills := make(chan *util.Fill)
+	orders := make(chan *util.OrderStatus)
+	if err := t.exchange.SubFills(fills); err != nil {
+		util.Warning(t.tag, "cannot subscribe fills, update status periodically",
+			err.Error())
+		return
+	}
+	if err := t.exchange.SubOrders(orders); err != nil {
+		util.Warning(t.tag, "cannot subscribe orders", err.Error())
+		orders = nil
+	}
+	for {
+		select {
+		case fill := <-fills:
+			if fill.Market != t.market {
+				continue
+			}
+			util.Info(t.tag, fmt.Sprintf("fill %s %f @ %.2f",
+				fill.Side, fill.Size, fill.Price))
+			t.refreshStatus()
+		case order := <-orders:
+			t.positionMutex.Lock()
+			t.takeProfitFilled(order)
+			t.positionMutex.Unlock()
+		}
+	}
+}
+
+// positionSide returns the side of the position, or "" if there is none.
+func (t *Trader) positionSide() string {
+	t.positionMutex.Lock()
+	defer t.positionMutex.Unlock()
+	if t.position == nil {
+		return ""
+	}
+	return t.position.Side
 }
 func (t *Trader) closePosition(market string, price float64, reason string) {
-	t.curPosition = t.ftx.GetPosition(market)
+	t.positionMutex.Lock()
+	defer t.positionMutex.Unlock()
+	t.closePositionLocked(market, price, reason)
+}
+
+// closePositionLocked closes the position with positionMutex held, it does
+// nothing if the position is already closed.
+func (t *Trader) closePositionLocked(market string, price float64,
+	reason string) {
+	if t.position == nil {
+		return
+	}
+	pos, err := t.exchange.GetPosition(market)
+	if err != nil {
+		t.notifyError("cannot get position to close", err)
+		return
+	}
+	t.curPosition = pos
 	if t.curPosition != nil {
 		action := ""
 		if t.curPosition.Side == "short" {
@@ -127,14 +413,26 @@ func (t *Trader) closePosition(market string, price float64, reason string) {
 			Size:       t.curPosition.Size,
 			ReduceOnly: true,
 		}
-		t.ftx.MakeOrder(order)
+		id, err := t.exchange.MakeOrder(order)
+		if err != nil {
+			t.notifyError("cannot close position", err)
+			return
+		}
+		if status, err := t.confirmOrder(id); err != nil {
+			t.notifyError("cannot confirm close order", err)
+		} else if status.FilledSize > 0 {
+			price = status.AvgFillPrice
+		}
 	}
 	if reason == "take profit" {
 		price = t.takeProfit
 	} else if reason == "stop loss" {
 		price = t.stopLoss
 	}
-	roi := t.position.Close(price)
+	roi, err := t.position.ROI(util.D(price))
+	if err != nil {
+		t.notifyError("cannot calculate ROI", err)
+	}
 	t.notifyClosePosition(price, roi, reason)
 	logMsg := fmt.Sprintf("close %s @ %.2f due to %s, ROI: %.2f%%",
 		t.position.Side, price, reason, roi*100)
@@ -144,9 +442,11 @@ func (t *Trader) closePosition(market string, price float64, reason string) {
 		util.Info(t.tag, util.Red(logMsg))
 	}
 	t.position = nil
-	t.ftx.CancelAllOrder(market)
+	t.cancelExitOrders(market)
 }
 func (t *Trader) openPosition(signal *util.Signal, size, price float64) {
+	t.positionMutex.Lock()
+	defer t.positionMutex.Unlock()
 	var action, exitAction string
 	if signal.Side == "long" {
 		action = "buy"
@@ -159,10 +459,24 @@ func (t *Trader) openPosition(signal *util.Signal, size, price float64) {
 		Market: signal.Market,
 		Side:   action,
 		Type:   "market",
-		Size:   size,
+		Size:   util.D(size),
+	}
+	id, err := t.exchange.MakeOrder(order)
+	if err != nil {
+		t.notifyError("cannot open position", err)
+		return
 	}
-	t.ftx.MakeOrder(order)
-	t.position = util.NewPosition(signal.Side, size, price)
+	if status, err := t.confirmOrder(id); err != nil {
+		t.notifyError("cannot confirm open order", err)
+	} else if status.FilledSize == 0 {
+		t.notifyError("cannot open position",
+			fmt.Errorf("order %d is not filled", id))
+		return
+	} else {
+		size = status.FilledSize
+		price = status.AvgFillPrice
+	}
+	t.position = util.NewPosition(signal.Side, util.D(size), util.D(price))
 	t.notifyOpenPosition(signal.Reason)
 	logMsg := fmt.Sprintf("start %s @ %.2f due to %s",
 		signal.Side, price, signal.Reason)
@@ -187,11 +501,15 @@ func (t *Trader) openPosition(signal *util.Signal, size, price float64) {
 			Market:     signal.Market,
 			Side:       exitAction,
 			Type:       "limit",
-			Size:       size,
+			Size:       util.D(size),
 			ReduceOnly: true,
-			Price:      signal.TakeProfit,
+			Price:      util.D(signal.TakeProfit),
+		}
+		if id, err := t.exchange.MakeOrder(takeProfitOrder); err != nil {
+			t.notifyError("cannot place take profit", err)
+		} else {
+			t.takeProfitID = id
 		}
-		t.ftx.MakeOrder(takeProfitOrder)
 		t.takeProfit = signal.TakeProfit
 	}
 	if signal.StopLoss > 0 {
@@ -200,61 +518,92 @@ func (t *Trader) openPosition(signal *util.Signal, size, price float64) {
 			order = &util.Order{
 				Market:           signal.Market,
 				Side:             exitAction,
-				Size:             size,
+				Size:             util.D(size),
 				Type:             "trailingStop",
 				ReduceOnly:       true,
 				RetryUntilFilled: true,
-				TrailValue:       signal.StopLoss - signal.Open,
+				TrailValue:       util.D(signal.StopLoss - signal.Open),
 			}
 		} else {
 			order = &util.Order{
 				Market:           signal.Market,
 				Side:             exitAction,
-				Size:             size,
+				Size:             util.D(size),
 				Type:             "stop",
 				ReduceOnly:       true,
 				RetryUntilFilled: true,
-				TriggerPrice:     signal.StopLoss,
+				TriggerPrice:     util.D(signal.StopLoss),
 				//OrderPrice: signal.StopLoss,
 			}
 			t.stopLoss = signal.StopLoss
 		}
-		t.ftx.MakeOrder(order)
+		if id, err := t.exchange.MakeOrder(order); err != nil {
+			t.notifyError("cannot place stop loss", err)
+		} else {
+			t.stopLossID = id
+			t.stopLossOrder = order
+		}
 	}
 }
 
-// Run starts a trader
+// Run starts a trader, signals are traded in order until signalChan is
+// closed.
 func (t *Trader) Start(signalChan <-chan *util.Signal) {
 	t.startTime = time.Now()
 	for signal := range signalChan {
-		util.Info(t.tag, "receive signal: "+signal.Side)
-		// ignore the first signal
-		if t.ignoreFirstSignal {
-			t.ignoreFirstSignal = false
-			continue
+		t.handleSignal(signal)
+	}
+}
+
+// handleSignal opens or closes the position by signal and returns when it is
+// traded.
+func (t *Trader) handleSignal(signal *util.Signal) {
+	util.Info(t.tag, "receive signal: "+signal.Side)
+	// ignore the first signal
+	if t.ignoreFirstSignal {
+		t.ignoreFirstSignal = false
+		return
+	}
+	orderbook, err := t.getOrderbook(signal.Market)
+	if err != nil {
+		t.notifyError("cannot get orderbook for "+signal.Side, err)
+		return
+	}
+	var curMP float64
+	if signal.Side == "close" {
+		side := t.positionSide()
+		if side == "" {
+			return
 		}
-		orderbook := t.ftx.GetOrderbook(signal.Market, 1)
-		var curMP float64
-		if signal.Side == "close" {
-			if t.position == nil {
-				continue
-			}
-			if t.position.Side == "short" {
-				curMP = orderbook.Asks[0].Price
-			} else if t.position.Side == "long" {
-				curMP = orderbook.Bids[0].Price
-			}
-			go t.closePosition(signal.Market, curMP, signal.Reason)
-		} else if signal.Side == "long" || signal.Side == "short" {
-			if signal.Side == "long" {
-				curMP = orderbook.Asks[0].Price
-			} else if signal.Side == "short" {
-				curMP = orderbook.Bids[0].Price
-			}
-			usdBalance := t.wallet.GetBalance("USD")
-			util.Info(t.tag, fmt.Sprintf("current balance: %.2f", usdBalance))
-			size := t.initBalance / curMP * t.leverage
-			go t.openPosition(signal, size, curMP)
+		if side == "short" {
+			curMP, err = orderbook.GetMarketBuyPrice()
+		} else if side == "long" {
+			curMP, err = orderbook.GetMarketSellPrice()
+		}
+		if err != nil {
+			t.notifyError("cannot get close price", err)
+			return
+		}
+		t.closePosition(signal.Market, curMP, signal.Reason)
+	} else if signal.Side == "long" || signal.Side == "short" {
+		if signal.Side == "long" {
+			curMP, err = orderbook.GetMarketBuyPrice()
+		} else if signal.Side == "short" {
+			curMP, err = orderbook.GetMarketSellPrice()
+		}
+		if err != nil {
+			t.notifyError("cannot get open price", err)
+			return
+		}
+		t.positionMutex.Lock()
+		usdBalance := t.wallet.GetBalance("USD")
+		t.positionMutex.Unlock()
+		util.Info(t.tag, "current balance: "+usdBalance.StringFixed(2))
+		size := t.initBalance / curMP * t.leverage
+		if size <= 0 {
+			util.Error(t.tag, "no balance to open position")
+			return
 		}
+		t.openPosition(signal, size, curMP)
 	}
 }
@@ -1,8 +1,860 @@
-/* 
-// Backtest is a fake exchange that provides the same interfaces as other 
+/*
+// Backtest is a fake exchange that provides the same interfaces as other
 // exchanges. It is use for backtesting.
+// Historical candles are fetched from a source exchange and replayed one by
+// one. Before each candle is delivered, resting orders are filled against its
+// high and low, so resting orders placed after candle N are matched from
+// candle N+1 on. Market orders fill at the close of the current candle.
 // Input: trader
 // Output: signal provider or indicator
-// TODO: all
+// TODO:
+// 1. funding payments for perpetual positions
 */
-package exchange
\ No newline at end of file
+package exchange
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+
+	util "crypto-flash/internal/service/util"
+
+	"github.com/shopspring/decimal"
+)
+
+var _ Exchange = (*Backtest)(nil)
+
+type backtestOrder struct {
+	id     int64
+	order  util.Order
+	status util.OrderStatus
+	// unix time of the candle the order is placed on
+	createdAt int64
+	// best price seen since the order is placed, for trailing stop
+	extreme float64
+	// for conditional order
+	triggered   bool
+	triggeredAt string
+}
+
+// isTrigger reports whether the order is a conditional order, which is only
+// returned by the conditional order APIs.
+func (bo *backtestOrder) isTrigger() bool {
+	return bo.order.Type != "market" && bo.order.Type != "limit"
+}
+func (bo *backtestOrder) triggerStatus() *util.TriggerOrderStatus {
+	o := &bo.order
+	status := &util.TriggerOrderStatus{
+		ID:               bo.id,
+		Market:           o.Market,
+		Side:             o.Side,
+		Size:             util.F64(o.Size),
+		TriggerPrice:     util.F64(o.TriggerPrice),
+		OrderPrice:       util.F64(o.OrderPrice),
+		TrailValue:       util.F64(o.TrailValue),
+		OrderType:        "market",
+		FilledSize:       bo.status.FilledSize,
+		AvgFillPrice:     bo.status.AvgFillPrice,
+		ReduceOnly:       o.ReduceOnly,
+		RetryUntilFilled: o.RetryUntilFilled,
+		Status:           "open",
+		TriggeredAt:      bo.triggeredAt,
+		CreatedAt:        bo.status.CreatedAt,
+	}
+	// same as FTX
+	switch o.Type {
+	case "stop":
+		status.Type = "stop"
+	case "takeProfit":
+		status.Type = "take_profit"
+	case "trailingStop":
+		status.Type = "trailing_stop"
+	}
+	if o.OrderPrice.IsPositive() {
+		status.OrderType = "limit"
+	}
+	if bo.triggered {
+		status.Status = "triggered"
+	} else if bo.status.IsClosed() {
+		status.Status = "cancelled"
+	}
+	return status
+}
+
+type Backtest struct {
+	tag               string
+	Fee               float64
+	CollaterableSpots map[string]float64
+	source            Exchange
+	startTime         int64
+	endTime           int64
+	mutex             sync.Mutex
+	usd               decimal.Decimal
+	positions         map[string]*util.Position
+	// orders are resting orders, history are all orders ever made
+	orders      []*backtestOrder
+	history     []*backtestOrder
+	nextOrderID int64
+	fills       []*util.Fill
+	candles     map[string]*util.Candle
+	// events are sent to subscribers after mutex is released, so subscribers
+	// can call back
+	fillSubs       []*subscriber
+	orderSubs      []*subscriber
+	tickerSubs     map[string][]*subscriber
+	pendingFills   []*util.Fill
+	pendingOrders  []*util.OrderStatus
+	pendingTickers []*util.Ticker
+	markets        *MarketCatalog
+}
+
+// NewBacktest replays candles of source between startTime and endTime.
+func NewBacktest(source Exchange, initBalance float64,
+	startTime, endTime int64) *Backtest {
+	return &Backtest{
+		tag:               "Backtest",
+		Fee:               source.GetFee(),
+		CollaterableSpots: source.GetCollaterableSpots(),
+		source:            source,
+		startTime:         startTime,
+		endTime:           endTime,
+		usd:               util.D(initBalance),
+		positions:         make(map[string]*util.Position),
+		nextOrderID:       1,
+		candles:           make(map[string]*util.Candle),
+		tickerSubs:        make(map[string][]*subscriber),
+		// markets do not change during a backtest
+		markets: NewMarketCatalog(source.GetMarkets, math.MaxInt64),
+	}
+}
+func (bt *Backtest) GetFee() float64 {
+	return bt.Fee
+}
+func (bt *Backtest) GetCollaterableSpots() map[string]float64 {
+	return bt.CollaterableSpots
+}
+
+// GetOrderbook returns a single level book at the close of current candle.
+func (bt *Backtest) GetOrderbook(market string, depth int) (*util.Orderbook, error) {
+	bt.mutex.Lock()
+	defer bt.mutex.Unlock()
+	candle, exist := bt.candles[market]
+	if !exist {
+		return nil, fmt.Errorf("no price for %s", market)
+	}
+	orderbook := &util.Orderbook{}
+	price, size := util.D(candle.Close), util.D(math.MaxFloat64)
+	orderbook.Add("ask", price, size)
+	orderbook.Add("bid", price, size)
+	return orderbook, nil
+}
+func (bt *Backtest) GetHistoryCandles(market string, resolution int,
+	startTime int64, endTime int64) ([]*util.Candle, error) {
+	return bt.source.GetHistoryCandles(market, resolution, startTime, endTime)
+}
+
+// SubCandle replays candles of the backtest period to c in the background,
+// then closes c. The replay stops early when ctx is done. The next candle is
+// matched as soon as the previous one is received, so orders should be
+// placed before receiving again, use Replay to trade in step with candles.
+func (bt *Backtest) SubCandle(ctx context.Context,
+	market string, resolution int, c chan<- *util.Candle) error {
+	candles, err := bt.source.GetHistoryCandles(
+		market, resolution, bt.startTime, bt.endTime)
+	if err != nil {
+		return err
+	}
+	go func() {
+		defer close(c)
+		bt.replay(market, candles, func(candle *util.Candle) bool {
+			select {
+			case c <- candle:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		})
+	}()
+	return nil
+}
+
+// Replay matches candles of the backtest period one by one and calls handle
+// with each, the next candle is matched after handle returns.
+func (bt *Backtest) Replay(market string, resolution int,
+	handle func(candle *util.Candle)) error {
+	candles, err := bt.source.GetHistoryCandles(
+		market, resolution, bt.startTime, bt.endTime)
+	if err != nil {
+		return err
+	}
+	bt.replay(market, candles, func(candle *util.Candle) bool {
+		handle(candle)
+		return true
+	})
+	return nil
+}
+
+// replay steps candles until handle returns false.
+func (bt *Backtest) replay(market string, candles []*util.Candle,
+	handle func(candle *util.Candle) bool) {
+	for _, candle := range candles {
+		bt.step(market, candle)
+		if !handle(candle.Copy()) {
+			return
+		}
+	}
+}
+func (bt *Backtest) step(market string, candle *util.Candle) {
+	defer bt.flush()
+	bt.mutex.Lock()
+	defer bt.mutex.Unlock()
+	bt.candles[market] = candle
+	bt.matchOrders(market, candle)
+	bt.tickerSubs[market] = activeSubscribers(bt.tickerSubs[market])
+	if len(bt.tickerSubs[market]) > 0 {
+		bt.pendingTickers = append(bt.pendingTickers, &util.Ticker{
+			Market: market,
+			Bid:    candle.Close,
+			Ask:    candle.Close,
+			Last:   candle.Close,
+			Time:   candle.GetTime(),
+		})
+	}
+}
+func (bt *Backtest) GetWallet() (*util.Wallet, error) {
+	bt.mutex.Lock()
+	defer bt.mutex.Unlock()
+	wallet := util.NewWallet()
+	wallet.Increase("USD", bt.usd)
+	return wallet, nil
+}
+func (bt *Backtest) GetPosition(market string) (*util.Position, error) {
+	bt.mutex.Lock()
+	defer bt.mutex.Unlock()
+	pos, exist := bt.positions[market]
+	if !exist {
+		return nil, nil
+	}
+	return &util.Position{
+		Market:    pos.Market,
+		Side:      pos.Side,
+		Size:      pos.Size,
+		OpenPrice: pos.OpenPrice,
+	}, nil
+}
+func (bt *Backtest) MakeOrder(order *util.Order) (int64, error) {
+	defer bt.flush()
+	bt.mutex.Lock()
+	defer bt.mutex.Unlock()
+	bo, err := bt.makeOrder(order)
+	if err != nil {
+		return 0, err
+	}
+	return bo.id, nil
+}
+func (bt *Backtest) makeOrder(order *util.Order) (*backtestOrder, error) {
+	candle, exist := bt.candles[order.Market]
+	if !exist {
+		return nil, fmt.Errorf("no price for %s", order.Market)
+	}
+	switch order.Type {
+	case "market", "limit":
+		if order.ClientId == nil {
+			clientID := util.NewClientID()
+			order.ClientId = &clientID
+		} else if bo, err := bt.findOrder(0, *order.ClientId); err == nil {
+			// resubmitted order
+			return bo, nil
+		}
+	case "stop", "takeProfit", "trailingStop":
+	default:
+		return nil, fmt.Errorf("unknown order type %s", order.Type)
+	}
+	bo := &backtestOrder{
+		id:        bt.nextOrderID,
+		order:     *order,
+		createdAt: candle.GetTime().Unix(),
+		extreme:   candle.Close,
+	}
+	bo.status = util.OrderStatus{
+		ID:            bo.id,
+		Market:        order.Market,
+		Type:          order.Type,
+		Side:          order.Side,
+		Price:         util.F64(order.Price),
+		Size:          util.F64(order.Size),
+		RemainingSize: util.F64(order.Size),
+		Status:        "open",
+		ReduceOnly:    order.ReduceOnly,
+		Ioc:           order.Ioc,
+		PostOnly:      order.PostOnly,
+		CreatedAt:     candle.StartTime,
+	}
+	if order.ClientId != nil {
+		bo.status.ClientID = *order.ClientId
+	}
+	bt.nextOrderID++
+	bt.history = append(bt.history, bo)
+	switch order.Type {
+	case "market":
+		bt.fill(bo, util.D(candle.Close), "taker")
+		bt.orderUpdated(bo)
+		return bo, nil
+	case "limit":
+		price := util.F64(order.Price)
+		if (order.Side == "buy" && price >= candle.Close) ||
+			(order.Side == "sell" && price <= candle.Close) {
+			if order.PostOnly {
+				bt.cancel(bo)
+				return bo, nil
+			}
+			bt.fill(bo, util.D(candle.Close), "taker")
+			bt.orderUpdated(bo)
+			return bo, nil
+		}
+		if order.Ioc {
+			bt.cancel(bo)
+			return bo, nil
+		}
+	}
+	bt.orderUpdated(bo)
+	bt.orders = append(bt.orders, bo)
+	return bo, nil
+}
+func (bt *Backtest) CancelAllOrder(market string) error {
+	defer bt.flush()
+	bt.mutex.Lock()
+	defer bt.mutex.Unlock()
+	for _, bo := range bt.orders {
+		if bo.order.Market == market {
+			bt.cancel(bo)
+		}
+	}
+	return nil
+}
+
+// cancel closes bo and removes it from resting orders.
+func (bt *Backtest) cancel(bo *backtestOrder) {
+	bo.status.Status = "closed"
+	bo.status.RemainingSize = 0
+	bt.orderUpdated(bo)
+	var orders []*backtestOrder
+	for _, o := range bt.orders {
+		if o != bo {
+			orders = append(orders, o)
+		}
+	}
+	bt.orders = orders
+}
+
+// findOrder returns the order of id, or the one of clientID if id is 0.
+func (bt *Backtest) findOrder(id int64, clientID string) (*backtestOrder, error) {
+	for _, bo := range bt.history {
+		if bo.isTrigger() {
+			continue
+		}
+		if id != 0 && bo.id == id ||
+			id == 0 && clientID != "" && bo.status.ClientID == clientID {
+			return bo, nil
+		}
+	}
+	if id == 0 {
+		return nil, fmt.Errorf("order of client id %s not found", clientID)
+	}
+	return nil, fmt.Errorf("order %d not found", id)
+}
+func (bt *Backtest) GetOrder(id int64) (*util.OrderStatus, error) {
+	bt.mutex.Lock()
+	defer bt.mutex.Unlock()
+	bo, err := bt.findOrder(id, "")
+	if err != nil {
+		return nil, err
+	}
+	status := bo.status
+	return &status, nil
+}
+func (bt *Backtest) GetOrderByClientID(clientID string) (*util.OrderStatus, error) {
+	bt.mutex.Lock()
+	defer bt.mutex.Unlock()
+	bo, err := bt.findOrder(0, clientID)
+	if err != nil {
+		return nil, err
+	}
+	status := bo.status
+	return &status, nil
+}
+func (bt *Backtest) GetOpenOrders(market string) ([]*util.OrderStatus, error) {
+	bt.mutex.Lock()
+	defer bt.mutex.Unlock()
+	var result []*util.OrderStatus
+	for _, bo := range bt.orders {
+		if !bo.isTrigger() && (market == "" || bo.order.Market == market) {
+			status := bo.status
+			result = append(result, &status)
+		}
+	}
+	return result, nil
+}
+func (bt *Backtest) CancelOrder(id int64) error {
+	defer bt.flush()
+	bt.mutex.Lock()
+	defer bt.mutex.Unlock()
+	bo, err := bt.findOrder(id, "")
+	if err != nil {
+		return err
+	}
+	if bo.status.IsClosed() {
+		return fmt.Errorf("order %d already closed", id)
+	}
+	bt.cancel(bo)
+	return nil
+}
+func (bt *Backtest) CancelOrderByClientID(clientID string) error {
+	defer bt.flush()
+	bt.mutex.Lock()
+	defer bt.mutex.Unlock()
+	bo, err := bt.findOrder(0, clientID)
+	if err != nil {
+		return err
+	}
+	if bo.status.IsClosed() {
+		return fmt.Errorf("order of client id %s already closed", clientID)
+	}
+	bt.cancel(bo)
+	return nil
+}
+
+// ModifyOrder cancels the order and places a new one with price and size, 0
+// keeps the original value.
+func (bt *Backtest) ModifyOrder(id int64,
+	price, size float64) (*util.OrderStatus, error) {
+	defer bt.flush()
+	bt.mutex.Lock()
+	defer bt.mutex.Unlock()
+	bo, err := bt.findOrder(id, "")
+	if err != nil {
+		return nil, err
+	}
+	if bo.status.IsClosed() {
+		return nil, fmt.Errorf("order %d already closed", id)
+	}
+	order := bo.order
+	if price > 0 {
+		order.Price = util.D(price)
+	}
+	if size > 0 {
+		order.Size = util.D(size)
+	}
+	// the new order gets a new client id
+	order.ClientId = nil
+	bt.cancel(bo)
+	newBo, err := bt.makeOrder(&order)
+	if err != nil {
+		return nil, err
+	}
+	status := newBo.status
+	return &status, nil
+}
+
+// GetOrderHistory returns orders of market placed on candles between
+// startTime and endTime. Empty market means all markets and 0 means no limit
+// on time.
+func (bt *Backtest) GetOrderHistory(market string,
+	startTime, endTime int64) ([]*util.OrderStatus, error) {
+	bt.mutex.Lock()
+	defer bt.mutex.Unlock()
+	var result []*util.OrderStatus
+	for _, bo := range bt.history {
+		if bo.isTrigger() || market != "" && bo.order.Market != market ||
+			startTime > 0 && bo.createdAt < startTime ||
+			endTime > 0 && bo.createdAt > endTime {
+			continue
+		}
+		status := bo.status
+		result = append(result, &status)
+	}
+	return result, nil
+}
+func (bt *Backtest) GetFills(market string,
+	startTime, endTime int64) ([]*util.Fill, error) {
+	bt.mutex.Lock()
+	defer bt.mutex.Unlock()
+	var result []*util.Fill
+	for _, f := range bt.fills {
+		if market != "" && f.Market != market {
+			continue
+		}
+		fill := *f
+		result = append(result, &fill)
+	}
+	if startTime > 0 || endTime > 0 {
+		util.Warning(bt.tag, "time range of fills is ignored")
+	}
+	return result, nil
+}
+
+// SubFills sends fills to c as soon as the call making them returns. Fills
+// are buffered like those of FTX, so the caller does not wait for c.
+func (bt *Backtest) SubFills(c chan<- *util.Fill) error {
+	bt.mutex.Lock()
+	defer bt.mutex.Unlock()
+	bt.fillSubs = append(bt.fillSubs, newLosslessSubscriber(
+		context.Background(), bt.tag+"-fills",
+		func(v interface{}, done <-chan struct{}) {
+			select {
+			case c <- v.(*util.Fill):
+			case <-done:
+			}
+		}, nil))
+	return nil
+}
+
+// SubOrders sends updates of market and limit orders to c as soon as the call
+// making them returns, they are buffered like fills.
+func (bt *Backtest) SubOrders(c chan<- *util.OrderStatus) error {
+	bt.mutex.Lock()
+	defer bt.mutex.Unlock()
+	bt.orderSubs = append(bt.orderSubs, newLosslessSubscriber(
+		context.Background(), bt.tag+"-orders",
+		func(v interface{}, done <-chan struct{}) {
+			select {
+			case c <- v.(*util.OrderStatus):
+			case <-done:
+			}
+		}, nil))
+	return nil
+}
+
+// SubTicker sends the close of each candle of market as a ticker until ctx is
+// done, then closes c. Tickers are buffered like those of FTX, so they may
+// arrive after the candle is sent by SubCandle.
+func (bt *Backtest) SubTicker(ctx context.Context, market string,
+	c chan<- *util.Ticker) error {
+	bt.mutex.Lock()
+	defer bt.mutex.Unlock()
+	bt.tickerSubs[market] = append(bt.tickerSubs[market],
+		newTickerSubscriber(ctx, bt.tag+"-ticker-"+market, c))
+	return nil
+}
+func (bt *Backtest) orderUpdated(bo *backtestOrder) {
+	if bo.isTrigger() || len(bt.orderSubs) == 0 {
+		return
+	}
+	status := bo.status
+	bt.pendingOrders = append(bt.pendingOrders, &status)
+}
+
+// flush sends pending events to subscribers, mutex must not be held.
+func (bt *Backtest) flush() {
+	bt.mutex.Lock()
+	fills, orders := bt.pendingFills, bt.pendingOrders
+	tickers := bt.pendingTickers
+	bt.pendingFills, bt.pendingOrders, bt.pendingTickers = nil, nil, nil
+	fillSubs, orderSubs := bt.fillSubs, bt.orderSubs
+	tickerSubs := make(map[string][]*subscriber)
+	for _, ticker := range tickers {
+		tickerSubs[ticker.Market] = bt.tickerSubs[ticker.Market]
+	}
+	bt.mutex.Unlock()
+	for _, fill := range fills {
+		for _, s := range fillSubs {
+			f := *fill
+			s.push(&f)
+		}
+	}
+	for _, order := range orders {
+		for _, s := range orderSubs {
+			o := *order
+			s.push(&o)
+		}
+	}
+	for _, ticker := range tickers {
+		for _, s := range tickerSubs[ticker.Market] {
+			s.push(ticker)
+		}
+	}
+}
+func (bt *Backtest) GetFundingRates(startTime, endTime int64,
+	future string) ([]float64, error) {
+	return bt.source.GetFundingRates(startTime, endTime, future)
+}
+func (bt *Backtest) GetFuture(future string) (FutureResult, error) {
+	return bt.source.GetFuture(future)
+}
+func (bt *Backtest) GetFutureStats(future string) (FutureStatsResult, error) {
+	return bt.source.GetFutureStats(future)
+}
+func (bt *Backtest) GetMarkets() ([]*Market, error) {
+	return bt.source.GetMarkets()
+}
+func (bt *Backtest) Markets() *MarketCatalog {
+	return bt.markets
+}
+
+func (bt *Backtest) findTriggerOrder(id int64) (*backtestOrder, error) {
+	for _, bo := range bt.history {
+		if bo.isTrigger() && bo.id == id {
+			return bo, nil
+		}
+	}
+	return nil, fmt.Errorf("conditional order %d not found", id)
+}
+func (bt *Backtest) GetOpenTriggerOrders(
+	market string) ([]*util.TriggerOrderStatus, error) {
+	bt.mutex.Lock()
+	defer bt.mutex.Unlock()
+	var result []*util.TriggerOrderStatus
+	for _, bo := range bt.orders {
+		if bo.isTrigger() && (market == "" || bo.order.Market == market) {
+			result = append(result, bo.triggerStatus())
+		}
+	}
+	return result, nil
+}
+
+// GetTriggerOrderHistory returns conditional orders of market placed on
+// candles between startTime and endTime. Empty market means all markets and 0
+// means no limit on time.
+func (bt *Backtest) GetTriggerOrderHistory(market string,
+	startTime, endTime int64) ([]*util.TriggerOrderStatus, error) {
+	bt.mutex.Lock()
+	defer bt.mutex.Unlock()
+	var result []*util.TriggerOrderStatus
+	for _, bo := range bt.history {
+		if !bo.isTrigger() || market != "" && bo.order.Market != market ||
+			startTime > 0 && bo.createdAt < startTime ||
+			endTime > 0 && bo.createdAt > endTime {
+			continue
+		}
+		result = append(result, bo.triggerStatus())
+	}
+	return result, nil
+}
+
+// GetTriggers returns the fill of a triggered order as the placed order, which
+// shares the id of the conditional order.
+func (bt *Backtest) GetTriggers(id int64) ([]*util.Trigger, error) {
+	bt.mutex.Lock()
+	defer bt.mutex.Unlock()
+	bo, err := bt.findTriggerOrder(id)
+	if err != nil {
+		return nil, err
+	}
+	if !bo.triggered {
+		return nil, nil
+	}
+	trigger := &util.Trigger{
+		Time:       bo.triggeredAt,
+		OrderID:    bo.id,
+		OrderSize:  util.F64(bo.order.Size),
+		FilledSize: bo.status.FilledSize,
+	}
+	if bo.status.FilledSize == 0 {
+		trigger.Error = "reduce only order canceled"
+	}
+	return []*util.Trigger{trigger}, nil
+}
+func (bt *Backtest) CancelTriggerOrder(id int64) error {
+	defer bt.flush()
+	bt.mutex.Lock()
+	defer bt.mutex.Unlock()
+	bo, err := bt.findTriggerOrder(id)
+	if err != nil {
+		return err
+	}
+	if bo.status.IsClosed() {
+		return fmt.Errorf("conditional order %d already closed", id)
+	}
+	bt.cancel(bo)
+	return nil
+}
+
+// ModifyTriggerOrder cancels the conditional order and places a new one, 0
+// keeps the original value.
+func (bt *Backtest) ModifyTriggerOrder(id int64, size, triggerPrice,
+	orderPrice, trailValue float64) (*util.TriggerOrderStatus, error) {
+	defer bt.flush()
+	bt.mutex.Lock()
+	defer bt.mutex.Unlock()
+	bo, err := bt.findTriggerOrder(id)
+	if err != nil {
+		return nil, err
+	}
+	if bo.status.IsClosed() {
+		return nil, fmt.Errorf("conditional order %d already closed", id)
+	}
+	order := bo.order
+	if size > 0 {
+		order.Size = util.D(size)
+	}
+	if triggerPrice > 0 {
+		order.TriggerPrice = util.D(triggerPrice)
+	}
+	if orderPrice > 0 {
+		order.OrderPrice = util.D(orderPrice)
+	}
+	if trailValue != 0 {
+		order.TrailValue = util.D(trailValue)
+	}
+	bt.cancel(bo)
+	newBo, err := bt.makeOrder(&order)
+	if err != nil {
+		return nil, err
+	}
+	return newBo.triggerStatus(), nil
+}
+
+// matchOrders fills resting orders of market whose price is reached by
+// candle. Stop-like orders fill at the worse of trigger and open price to
+// account for gaps.
+func (bt *Backtest) matchOrders(market string, candle *util.Candle) {
+	var remain []*backtestOrder
+	for _, bo := range bt.orders {
+		o := &bo.order
+		if o.Market != market {
+			remain = append(remain, bo)
+			continue
+		}
+		filled := false
+		isBuy := o.Side == "buy"
+		price, triggerPrice := util.F64(o.Price), util.F64(o.TriggerPrice)
+		switch o.Type {
+		case "limit":
+			if isBuy && candle.Low <= price ||
+				!isBuy && candle.High >= price {
+				bt.fill(bo, o.Price, "maker")
+				filled = true
+			}
+		case "stop":
+			if isBuy && candle.High >= triggerPrice {
+				bt.fill(bo, bt.triggerPrice(o, math.Max(triggerPrice, candle.Open)),
+					"taker")
+				filled = true
+			} else if !isBuy && candle.Low <= triggerPrice {
+				bt.fill(bo, bt.triggerPrice(o, math.Min(triggerPrice, candle.Open)),
+					"taker")
+				filled = true
+			}
+		case "takeProfit":
+			if isBuy && candle.Low <= triggerPrice ||
+				!isBuy && candle.High >= triggerPrice {
+				bt.fill(bo, bt.triggerPrice(o, triggerPrice), "taker")
+				filled = true
+			}
+		case "trailingStop":
+			// trail value is negative for sell, positive for buy
+			trigger := bo.extreme + util.F64(o.TrailValue)
+			if isBuy && candle.High >= trigger {
+				bt.fill(bo, util.D(math.Max(trigger, candle.Open)), "taker")
+				filled = true
+			} else if !isBuy && candle.Low <= trigger {
+				bt.fill(bo, util.D(math.Min(trigger, candle.Open)), "taker")
+				filled = true
+			} else if isBuy {
+				bo.extreme = math.Min(bo.extreme, candle.Low)
+			} else {
+				bo.extreme = math.Max(bo.extreme, candle.High)
+			}
+		}
+		if filled {
+			bt.orderUpdated(bo)
+		} else {
+			remain = append(remain, bo)
+		}
+	}
+	bt.orders = remain
+}
+func (bt *Backtest) triggerPrice(o *util.Order, marketPrice float64) decimal.Decimal {
+	if o.OrderPrice.IsPositive() {
+		return o.OrderPrice
+	}
+	return util.D(marketPrice)
+}
+
+// fill updates position and balance as a linear contract settled in USD, and
+// closes bo.
+func (bt *Backtest) fill(bo *backtestOrder, price decimal.Decimal, liquidity string) {
+	o := &bo.order
+	bo.status.Status = "closed"
+	bo.status.RemainingSize = 0
+	if bo.isTrigger() {
+		bo.triggered = true
+		bo.triggeredAt = bt.candles[o.Market].StartTime
+	}
+	size := o.Size
+	pos, hasPos := bt.positions[o.Market]
+	curSize := decimal.Zero
+	if hasPos {
+		curSize = pos.Size
+		if pos.Side == "short" {
+			curSize = pos.Size.Neg()
+		}
+	}
+	delta := size
+	if o.Side == "sell" {
+		delta = size.Neg()
+	}
+	if o.ReduceOnly {
+		if curSize.Mul(delta).Sign() >= 0 {
+			util.Warning(bt.tag, "reduce only order canceled", o.Market)
+			return
+		}
+		if delta.Abs().GreaterThan(curSize.Abs()) {
+			delta = curSize.Neg()
+		}
+	}
+	fee := delta.Abs().Mul(price).Mul(util.D(bt.Fee))
+	bt.usd = bt.usd.Sub(fee)
+	bo.status.FilledSize = util.F64(delta.Abs())
+	bo.status.AvgFillPrice = util.F64(price)
+	fill := &util.Fill{
+		ID:        int64(len(bt.fills) + 1),
+		OrderID:   bo.id,
+		Market:    o.Market,
+		Side:      o.Side,
+		Price:     util.F64(price),
+		Size:      util.F64(delta.Abs()),
+		Fee:       util.F64(fee),
+		FeeRate:   bt.Fee,
+		Liquidity: liquidity,
+		Time:      bt.candles[o.Market].StartTime,
+	}
+	bt.fills = append(bt.fills, fill)
+	if len(bt.fillSubs) > 0 {
+		pending := *fill
+		bt.pendingFills = append(bt.pendingFills, &pending)
+	}
+	newSize := curSize.Add(delta)
+	openPrice := price
+	if curSize.Mul(delta).Sign() > 0 {
+		openPrice = curSize.Abs().Mul(pos.OpenPrice).Add(delta.Abs().Mul(price)).
+			Div(newSize.Abs())
+	} else if !curSize.IsZero() {
+		closeSize := decimal.Min(curSize.Abs(), delta.Abs())
+		pnl := closeSize.Mul(price.Sub(pos.OpenPrice))
+		if curSize.IsNegative() {
+			pnl = pnl.Neg()
+		}
+		bt.usd = bt.usd.Add(pnl)
+		if newSize.Mul(curSize).Sign() > 0 {
+			openPrice = pos.OpenPrice
+		}
+	}
+	util.Info(bt.tag, fmt.Sprintf("fill %s %s %s @ %s",
+		o.Market, o.Side, delta.Abs(), price.StringFixed(2)))
+	if newSize.IsZero() {
+		delete(bt.positions, o.Market)
+		return
+	}
+	side := "long"
+	if newSize.IsNegative() {
+		side = "short"
+	}
+	bt.positions[o.Market] = &util.Position{
+		Market:    o.Market,
+		Side:      side,
+		Size:      newSize.Abs(),
+		OpenPrice: openPrice,
+	}
+}
@@ -0,0 +1,294 @@
+package exchange
+
+import (
+	"context"
+	"testing"
+
+	util "crypto-flash/internal/service/util"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type candleSource struct {
+	Exchange
+	candles []*util.Candle
+}
+
+func (cs *candleSource) GetHistoryCandles(market string, resolution int,
+	startTime int64, endTime int64) ([]*util.Candle, error) {
+	return cs.candles, nil
+}
+func (cs *candleSource) GetFee() float64 {
+	return 0.001
+}
+func (cs *candleSource) GetCollaterableSpots() map[string]float64 {
+	return nil
+}
+
+// newTestBacktest returns a backtest and a function stepping to the next candle
+func newTestBacktest(candles ...*util.Candle) (*Backtest, func()) {
+	bt := NewBacktest(&candleSource{candles: candles}, 1000, 0, 0)
+	i := 0
+	next := func() {
+		bt.step("BTC-PERP", candles[i])
+		i++
+	}
+	return bt, next
+}
+func assertNoPosition(t *testing.T, bt *Backtest) {
+	pos, err := bt.GetPosition("BTC-PERP")
+	assert.Nil(t, err)
+	assert.Nil(t, pos)
+}
+func balance(bt *Backtest) float64 {
+	wallet, _ := bt.GetWallet()
+	return util.F64(wallet.GetBalance("USD"))
+}
+
+func TestBacktestTakeProfit(t *testing.T) {
+	bt, next := newTestBacktest(
+		&util.Candle{Open: 100, High: 100, Low: 100, Close: 100},
+		&util.Candle{Open: 100, High: 111, Low: 99, Close: 105},
+		&util.Candle{Open: 105, High: 106, Low: 90, Close: 92},
+	)
+	next()
+	bt.MakeOrder(&util.Order{Market: "BTC-PERP", Side: "buy", Type: "market", Size: util.D(1)})
+	pos, _ := bt.GetPosition("BTC-PERP")
+	assert.Equal(t, "long", pos.Side)
+	assert.Equal(t, "100", pos.OpenPrice.String())
+	bt.MakeOrder(&util.Order{Market: "BTC-PERP", Side: "sell", Type: "limit",
+		Size: util.D(1), Price: util.D(110), ReduceOnly: true})
+	bt.MakeOrder(&util.Order{Market: "BTC-PERP", Side: "sell", Type: "stop",
+		Size: util.D(1), TriggerPrice: util.D(95), ReduceOnly: true})
+	next()
+	assertNoPosition(t, bt)
+	// the stop loss is reduce only and is dropped without a position
+	next()
+	assertNoPosition(t, bt)
+	assert.InDelta(t, 1000-0.1+10-0.11, balance(bt), 1e-9)
+}
+
+func TestBacktestSubCandle(t *testing.T) {
+	candles := []*util.Candle{
+		{Open: 100, High: 100, Low: 100, Close: 100},
+		{Open: 100, High: 111, Low: 99, Close: 105},
+	}
+	bt := NewBacktest(&candleSource{candles: candles}, 1000, 0, 0)
+	c := make(chan *util.Candle)
+	assert.Nil(t, bt.SubCandle(context.Background(), "BTC-PERP", 15, c))
+	var received []*util.Candle
+	for candle := range c {
+		received = append(received, candle)
+	}
+	assert.Equal(t, candles, received)
+	orderbook, err := bt.GetOrderbook("BTC-PERP", 1)
+	assert.Nil(t, err)
+	ask, _ := orderbook.GetMarketBuyPrice()
+	assert.Equal(t, 105.0, ask)
+}
+
+func TestBacktestReplay(t *testing.T) {
+	candles := []*util.Candle{
+		{Open: 100, High: 100, Low: 100, Close: 100},
+		{Open: 100, High: 111, Low: 99, Close: 105},
+	}
+	bt := NewBacktest(&candleSource{candles: candles}, 1000, 0, 0)
+	var closes []float64
+	assert.Nil(t, bt.Replay("BTC-PERP", 15, func(candle *util.Candle) {
+		closes = append(closes, candle.Close)
+		if len(closes) == 1 {
+			// filled at the close of the handled candle
+			bt.MakeOrder(&util.Order{Market: "BTC-PERP", Side: "buy",
+				Type: "market", Size: util.D(1)})
+		}
+	}))
+	assert.Equal(t, []float64{100, 105}, closes)
+	pos, _ := bt.GetPosition("BTC-PERP")
+	assert.Equal(t, "100", pos.OpenPrice.String())
+}
+
+func TestBacktestTrailingStop(t *testing.T) {
+	bt, next := newTestBacktest(
+		&util.Candle{Open: 100, High: 100, Low: 100, Close: 100},
+		&util.Candle{Open: 100, High: 103, Low: 95, Close: 96},
+		&util.Candle{Open: 96, High: 101, Low: 96, Close: 100},
+	)
+	next()
+	bt.MakeOrder(&util.Order{Market: "BTC-PERP", Side: "sell", Type: "market", Size: util.D(1)})
+	bt.MakeOrder(&util.Order{Market: "BTC-PERP", Side: "buy", Type: "trailingStop",
+		Size: util.D(1), TrailValue: util.D(5), ReduceOnly: true})
+	next()
+	pos, _ := bt.GetPosition("BTC-PERP")
+	assert.Equal(t, "short", pos.Side)
+	next()
+	assertNoPosition(t, bt)
+	assert.InDelta(t, 1000-0.1-0.1, balance(bt), 1e-9)
+}
+
+func TestBacktestFlipPosition(t *testing.T) {
+	bt, next := newTestBacktest(
+		&util.Candle{Open: 100, High: 100, Low: 100, Close: 100},
+		&util.Candle{Open: 100, High: 120, Low: 100, Close: 120},
+	)
+	next()
+	bt.MakeOrder(&util.Order{Market: "BTC-PERP", Side: "buy", Type: "market", Size: util.D(1)})
+	next()
+	bt.MakeOrder(&util.Order{Market: "BTC-PERP", Side: "sell", Type: "market", Size: util.D(3)})
+	pos, _ := bt.GetPosition("BTC-PERP")
+	assert.Equal(t, "short", pos.Side)
+	assert.Equal(t, "2", pos.Size.String())
+	assert.Equal(t, "120", pos.OpenPrice.String())
+	assert.InDelta(t, 1000-0.1+20-0.36, balance(bt), 1e-9)
+}
+
+func TestBacktestOrderLifecycle(t *testing.T) {
+	bt, next := newTestBacktest(
+		&util.Candle{Open: 100, High: 100, Low: 100, Close: 100},
+		&util.Candle{Open: 100, High: 100, Low: 94, Close: 96},
+	)
+	next()
+	clientID := "tp-1"
+	id1, _ := bt.MakeOrder(&util.Order{Market: "BTC-PERP", Side: "buy",
+		Type: "limit", Size: util.D(1), Price: util.D(95)})
+	id2, _ := bt.MakeOrder(&util.Order{Market: "BTC-PERP", Side: "buy",
+		Type: "limit", Size: util.D(1), Price: util.D(90), ClientId: &clientID})
+	id3, _ := bt.MakeOrder(&util.Order{Market: "BTC-PERP", Side: "buy",
+		Type: "limit", Size: util.D(1), Price: util.D(80)})
+	orders, err := bt.GetOpenOrders("BTC-PERP")
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(orders))
+	// modify places a new order
+	modified, err := bt.ModifyOrder(id3, 85, 2)
+	assert.Nil(t, err)
+	assert.NotEqual(t, id3, modified.ID)
+	assert.Equal(t, 85.0, modified.Price)
+	assert.Equal(t, 2.0, modified.Size)
+	assert.Nil(t, bt.CancelOrderByClientID(clientID))
+	assert.NotNil(t, bt.CancelOrder(id2))
+	next()
+	status, err := bt.GetOrder(id1)
+	assert.Nil(t, err)
+	assert.True(t, status.IsFilled())
+	assert.Equal(t, 95.0, status.AvgFillPrice)
+	orders, _ = bt.GetOpenOrders("")
+	assert.Equal(t, 1, len(orders))
+	assert.Equal(t, modified.ID, orders[0].ID)
+	assert.Nil(t, bt.CancelOrder(modified.ID))
+	orders, _ = bt.GetOpenOrders("")
+	assert.Equal(t, 0, len(orders))
+	history, _ := bt.GetOrderHistory("BTC-PERP", 0, 0)
+	assert.Equal(t, 4, len(history))
+	fills, _ := bt.GetFills("BTC-PERP", 0, 0)
+	assert.Equal(t, 1, len(fills))
+	assert.Equal(t, id1, fills[0].OrderID)
+	assert.Equal(t, "maker", fills[0].Liquidity)
+	assert.InDelta(t, 0.095, fills[0].Fee, 1e-9)
+}
+
+func TestBacktestTriggerOrders(t *testing.T) {
+	bt, next := newTestBacktest(
+		&util.Candle{Open: 100, High: 100, Low: 100, Close: 100},
+		&util.Candle{Open: 100, High: 100, Low: 94, Close: 96},
+	)
+	next()
+	bt.MakeOrder(&util.Order{Market: "BTC-PERP", Side: "buy", Type: "market", Size: util.D(1)})
+	id1, _ := bt.MakeOrder(&util.Order{Market: "BTC-PERP", Side: "sell",
+		Type: "stop", Size: util.D(1), TriggerPrice: util.D(90), ReduceOnly: true})
+	id2, _ := bt.MakeOrder(&util.Order{Market: "BTC-PERP", Side: "sell",
+		Type: "takeProfit", Size: util.D(1), TriggerPrice: util.D(120), ReduceOnly: true})
+	orders, err := bt.GetOpenTriggerOrders("BTC-PERP")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(orders))
+	assert.Equal(t, "take_profit", orders[1].Type)
+	// trigger orders are not regular orders
+	assert.NotNil(t, bt.CancelOrder(id1))
+	modified, err := bt.ModifyTriggerOrder(id1, 0, 95, 0, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 95.0, modified.TriggerPrice)
+	assert.Nil(t, bt.CancelTriggerOrder(id2))
+	next()
+	orders, _ = bt.GetOpenTriggerOrders("")
+	assert.Equal(t, 0, len(orders))
+	history, _ := bt.GetTriggerOrderHistory("BTC-PERP", 0, 0)
+	assert.Equal(t, 3, len(history))
+	assert.Equal(t, "cancelled", history[0].Status)
+	assert.Equal(t, "cancelled", history[1].Status)
+	assert.True(t, history[2].IsTriggered())
+	assert.Equal(t, 95.0, history[2].AvgFillPrice)
+	triggers, err := bt.GetTriggers(modified.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(triggers))
+	assert.Equal(t, 1.0, triggers[0].FilledSize)
+	assertNoPosition(t, bt)
+}
+
+func TestBacktestClientID(t *testing.T) {
+	bt, next := newTestBacktest(
+		&util.Candle{Open: 100, High: 100, Low: 100, Close: 100},
+	)
+	next()
+	order := &util.Order{Market: "BTC-PERP", Side: "buy", Type: "limit",
+		Size: util.D(1), Price: util.D(90)}
+	id, _ := bt.MakeOrder(order)
+	assert.NotNil(t, order.ClientId)
+	// resubmitting returns the placed order
+	sameID, _ := bt.MakeOrder(order)
+	assert.Equal(t, id, sameID)
+	status, err := bt.GetOrderByClientID(*order.ClientId)
+	assert.Nil(t, err)
+	assert.Equal(t, id, status.ID)
+	// post only order crossing the book is canceled
+	id, _ = bt.MakeOrder(&util.Order{Market: "BTC-PERP", Side: "buy",
+		Type: "limit", Size: util.D(1), Price: util.D(101), PostOnly: true})
+	status, _ = bt.GetOrder(id)
+	assert.True(t, status.IsClosed())
+	assert.Equal(t, 0.0, status.FilledSize)
+	assertNoPosition(t, bt)
+}
+
+func TestBacktestSubFills(t *testing.T) {
+	bt, next := newTestBacktest(
+		&util.Candle{Open: 100, High: 100, Low: 100, Close: 100},
+		&util.Candle{Open: 100, High: 111, Low: 99, Close: 105},
+	)
+	fills := make(chan *util.Fill, 10)
+	orders := make(chan *util.OrderStatus, 10)
+	bt.SubFills(fills)
+	bt.SubOrders(orders)
+	next()
+	bt.MakeOrder(&util.Order{Market: "BTC-PERP", Side: "buy", Type: "market", Size: util.D(1)})
+	id, _ := bt.MakeOrder(&util.Order{Market: "BTC-PERP", Side: "sell",
+		Type: "limit", Size: util.D(1), Price: util.D(110), ReduceOnly: true})
+	assert.True(t, (<-orders).IsFilled())
+	assert.False(t, (<-orders).IsClosed())
+	<-fills
+	next()
+	fill := <-fills
+	assert.Equal(t, id, fill.OrderID)
+	assert.Equal(t, 110.0, fill.Price)
+	assert.Equal(t, "maker", fill.Liquidity)
+	order := <-orders
+	assert.Equal(t, id, order.ID)
+	assert.True(t, order.IsFilled())
+}
+
+func TestBacktestSubTicker(t *testing.T) {
+	candles := []*util.Candle{
+		util.NewCandle(100, 100, 100, 100, 0, "2021-01-01T00:00:00+00:00"),
+		util.NewCandle(100, 111, 99, 105, 0, "2021-01-01T00:00:15+00:00"),
+	}
+	bt := NewBacktest(&candleSource{candles: candles}, 1000, 0, 0)
+	tickers := make(chan *util.Ticker, 2)
+	assert.Nil(t, bt.SubTicker(context.Background(), "BTC-PERP", tickers))
+	c := make(chan *util.Candle)
+	assert.Nil(t, bt.SubCandle(context.Background(), "BTC-PERP", 15, c))
+	for range c {
+	}
+	ticker := <-tickers
+	assert.Equal(t, 100.0, ticker.Bid)
+	ticker = <-tickers
+	assert.Equal(t, "BTC-PERP", ticker.Market)
+	assert.Equal(t, 105.0, ticker.Ask)
+	assert.Equal(t, 105.0, ticker.Last)
+	assert.Equal(t, int64(1609459215), ticker.Time.Unix())
+}
@@ -0,0 +1,19 @@
+package exchange
+
+import (
+	"fmt"
+)
+
+// APIError is returned when FTX answers with success false. StatusCode is
+// the HTTP status of the response, which can be 200.
+type APIError struct {
+	Method     string
+	Path       string
+	StatusCode int
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("%s %s: ftx error (status %d): %s",
+		e.Method, e.Path, e.StatusCode, e.Message)
+}
@@ -0,0 +1,64 @@
+/*
+// Exchange is the set of market data and trading APIs a character needs from
+// a venue. FTX implements it against the real exchange and Backtest
+// implements it against historical data, so traders and signal providers do
+// not need to know which one they are talking to.
+*/
+package exchange
+
+import (
+	"context"
+
+	util "crypto-flash/internal/service/util"
+)
+
+type Exchange interface {
+	// market data
+	GetOrderbook(market string, depth int) (*util.Orderbook, error)
+	GetHistoryCandles(market string, resolution int,
+		startTime int64, endTime int64) ([]*util.Candle, error)
+	// SubCandle sends candles of market to c until ctx is done, then closes c
+	SubCandle(ctx context.Context, market string, resolution int,
+		c chan<- *util.Candle) error
+	// SubTicker sends the best bid and ask of market on each change until ctx
+	// is done, then closes c
+	SubTicker(ctx context.Context, market string, c chan<- *util.Ticker) error
+	// account
+	GetWallet() (*util.Wallet, error)
+	GetPosition(market string) (*util.Position, error)
+	// MakeOrder sets a client id to market and limit orders without one
+	MakeOrder(order *util.Order) (int64, error)
+	// real time fills and order updates of the account
+	SubFills(c chan<- *util.Fill) error
+	SubOrders(c chan<- *util.OrderStatus) error
+	CancelAllOrder(market string) error
+	// orders
+	GetOrder(id int64) (*util.OrderStatus, error)
+	GetOrderByClientID(clientID string) (*util.OrderStatus, error)
+	GetOpenOrders(market string) ([]*util.OrderStatus, error)
+	CancelOrder(id int64) error
+	CancelOrderByClientID(clientID string) error
+	ModifyOrder(id int64, price, size float64) (*util.OrderStatus, error)
+	GetOrderHistory(market string,
+		startTime, endTime int64) ([]*util.OrderStatus, error)
+	GetFills(market string, startTime, endTime int64) ([]*util.Fill, error)
+	// conditional orders
+	GetOpenTriggerOrders(market string) ([]*util.TriggerOrderStatus, error)
+	GetTriggerOrderHistory(market string,
+		startTime, endTime int64) ([]*util.TriggerOrderStatus, error)
+	GetTriggers(id int64) ([]*util.Trigger, error)
+	CancelTriggerOrder(id int64) error
+	ModifyTriggerOrder(id int64, size, triggerPrice, orderPrice,
+		trailValue float64) (*util.TriggerOrderStatus, error)
+	// futures
+	GetFundingRates(startTime, endTime int64, future string) ([]float64, error)
+	GetFuture(future string) (FutureResult, error)
+	GetFutureStats(future string) (FutureStatsResult, error)
+	// markets
+	GetMarkets() ([]*Market, error)
+	// Markets returns a cache of GetMarkets
+	Markets() *MarketCatalog
+	// venue properties
+	GetFee() float64
+	GetCollaterableSpots() map[string]float64
+}
@@ -5,33 +5,45 @@
 // TODO:
 // 1. getHistoryCandles: if candles >= 5000, request many times and concat result
 // 3. getPosition
-// 4. make conditional order
-// 5. exchange interface
 */
 package exchange
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	util "crypto-flash/internal/service/util"
+
+	"github.com/shopspring/decimal"
 )
 
 const (
-	host                     string = "https://ftx.com"
+	defaultRestURL           string = "https://ftx.com"
+	defaultWSURL             string = "wss://ftx.com/ws"
 	marketAPI                string = "/api/markets"
 	walletAPI                string = "/api/wallet/balances"
 	orderAPI                 string = "/api/orders"
+	orderHistoryAPI          string = "/api/orders/history"
+	fillAPI                  string = "/api/fills"
 	condOrderAPI             string = "/api/conditional_orders"
+	condOrderHistoryAPI      string = "/api/conditional_orders/history"
 	positionAPI              string = "/api/positions"
 	futureAPI                string = "/api/futures"
 	fundingRateAPI           string = "/api/funding_rates"
 	spotMarginBorrowRatesAPI string = "/api/spot_margin/borrow_rates"
 )
 
+var _ Exchange = (*FTX)(nil)
+
 type FTX struct {
 	tag               string
 	key               string
@@ -40,13 +52,77 @@ type FTX struct {
 	Fee               float64
 	CollaterableSpots map[string]float64
 	// save all candles data from different resolutions and markets
-	candleData map[string][]*util.Candle
-	candleSubs map[string][]chan<- *util.Candle
-	restClient *util.RestClient
+	candleMutex sync.Mutex
+	candleData  map[string][]*util.Candle
+	candleSubs  map[string][]*subscriber
+	// public websocket shared by trades and ticker subscribers
+	publicMutex sync.Mutex
+	publicWS    *WSClient
+	tradeSubs   map[string][]*subscriber
+	tickerSubs  map[string][]*subscriber
+	restClient  *util.RestClient
+	restURL     string
+	wsURL       string
+	wsRecorder  *WSRecorder
+	// order ids of client ids made by MakeOrder
+	clientOrdersMutex sync.Mutex
+	clientOrders      map[string]int64
+	// specifications of markets, loaded on the first use
+	markets *MarketCatalog
+	// private websocket shared by fills and orders subscribers
+	privateMutex sync.Mutex
+	privateWS    *WSClient
+	fillSubs     []*subscriber
+	orderSubs    []*subscriber
+}
+
+type FTXOption func(ftx *FTX)
+
+// WithRestURL points REST requests to url instead of https://ftx.com.
+func WithRestURL(url string) FTXOption {
+	return func(ftx *FTX) {
+		ftx.restURL = strings.TrimSuffix(url, "/")
+	}
+}
+
+// WithWSURL points websocket connections to url instead of wss://ftx.com/ws.
+func WithWSURL(url string) FTXOption {
+	return func(ftx *FTX) {
+		ftx.wsURL = url
+	}
+}
+
+// WithTransport sends REST requests through transport, e.g. a
+// util.FixtureTransport to record or replay responses.
+func WithTransport(transport http.RoundTripper) FTXOption {
+	return func(ftx *FTX) {
+		ftx.restClient.SetTransport(transport)
+	}
+}
+
+// WithMarketRefresh reloads specifications of markets when they are older
+// than period, 10 minutes by default.
+func WithMarketRefresh(period time.Duration) FTXOption {
+	return func(ftx *FTX) {
+		ftx.markets.period = period
+	}
+}
+
+// WithWSRecorder records messages of all websockets of the FTX instance.
+func WithWSRecorder(recorder *WSRecorder) FTXOption {
+	return func(ftx *FTX) {
+		ftx.wsRecorder = recorder
+	}
 }
 
-func NewFTX(key, secret, subAccount string) *FTX {
-	return &FTX{
+func NewFTX(key, secret, subAccount string, opts ...FTXOption) *FTX {
+	restClient := util.NewRestClient()
+	// FTX allows about 30 requests per second, orders are throttled more
+	// strictly so they get a smaller budget
+	restClient.SetLimit("", 25, 25)
+	restClient.SetLimit(orderAPI, 8, 8)
+	restClient.SetLimit(condOrderAPI, 8, 8)
+	ftx := &FTX{
 		key:        key,
 		secret:     secret,
 		subAccount: subAccount,
@@ -102,38 +178,120 @@ func NewFTX(key, secret, subAccount string) *FTX {
 			"DOGE":            0.8,
 			"FTT":             0.95,
 		},
-		tag:        "FTX",
-		candleData: make(map[string][]*util.Candle),
-		candleSubs: make(map[string][]chan<- *util.Candle),
-		restClient: util.NewRestClient(),
+		tag:          "FTX",
+		candleData:   make(map[string][]*util.Candle),
+		candleSubs:   make(map[string][]*subscriber),
+		tradeSubs:    make(map[string][]*subscriber),
+		tickerSubs:   make(map[string][]*subscriber),
+		restClient:   restClient,
+		restURL:      defaultRestURL,
+		wsURL:        defaultWSURL,
+		clientOrders: make(map[string]int64),
+	}
+	ftx.markets = NewMarketCatalog(ftx.GetMarkets, 10*time.Minute)
+	for _, opt := range opts {
+		opt(ftx)
+	}
+	return ftx
+}
+func (ftx *FTX) GetFee() float64 {
+	return ftx.Fee
+}
+func (ftx *FTX) GetCollaterableSpots() map[string]float64 {
+	return ftx.CollaterableSpots
+}
+
+// Markets returns the catalog of markets orders are validated against.
+func (ftx *FTX) Markets() *MarketCatalog {
+	return ftx.markets
+}
+func (ftx *FTX) GetRestMetrics() util.RestClientMetrics {
+	return ftx.restClient.Metrics()
+}
+
+// response is the envelope of every FTX REST response. Result should be set
+// to a pointer before decoding.
+type response struct {
+	Success bool        `json:"success"`
+	Error   string      `json:"error"`
+	Result  interface{} `json:"result"`
+}
+
+// request calls FTX REST API and decodes the result field into result.
+// path includes the query string and is signed as is if auth is true, again
+// for each retry since signatures expire with their timestamps.
+func (ftx *FTX) request(method, path string, auth bool,
+	reqBody interface{}, result interface{}) error {
+	bodyStr := ""
+	var body io.Reader
+	if reqBody != nil {
+		bodyStr = util.GetJSONString(reqBody)
+		body = strings.NewReader(bodyStr)
+	}
+	var header func() *http.Header
+	if auth {
+		header = func() *http.Header {
+			return ftx.genAuthHeader(method, path, bodyStr)
+		}
+	}
+	switch method {
+	case "GET", "POST", "DELETE":
+	default:
+		return fmt.Errorf("unsupported method %s", method)
+	}
+	reqURL := ftx.restURL + path
+	resObj := response{Result: result}
+	err := ftx.restClient.Send(method, reqURL, header, body, &resObj)
+	if err != nil {
+		// FTX puts the reason of most 4xx responses in the error field
+		var statusErr *util.StatusError
+		if errors.As(err, &statusErr) {
+			var errRes response
+			if json.Unmarshal(statusErr.Body, &errRes) == nil &&
+				errRes.Error != "" {
+				return &APIError{
+					Method:     method,
+					Path:       path,
+					StatusCode: statusErr.StatusCode,
+					Message:    errRes.Error,
+				}
+			}
+		}
+		return err
+	}
+	if !resObj.Success {
+		return &APIError{
+			Method:     method,
+			Path:       path,
+			StatusCode: http.StatusOK,
+			Message:    resObj.Error,
+		}
 	}
+	return nil
 }
 
 // depth 1 ~ 100
-func (ftx *FTX) GetOrderbook(market string, depth int) *util.Orderbook {
+func (ftx *FTX) GetOrderbook(market string, depth int) (*util.Orderbook, error) {
 	type orderbookRes struct {
 		Asks [][2]float64
 		Bids [][2]float64
 	}
-	type res struct {
-		Success bool
-		Result  orderbookRes
+	path := marketAPI + fmt.Sprintf("/%s/orderbook?depth=%d", market, depth)
+	var result orderbookRes
+	if err := ftx.request("GET", path, false, nil, &result); err != nil {
+		return nil, err
 	}
-	url := host + marketAPI +
-		fmt.Sprintf("/%s/orderbook?depth=%d", market, depth)
-	var resObj res
-	ftx.restClient.Get(url, nil, nil, &resObj)
 	orderbook := &util.Orderbook{}
-	for _, row := range resObj.Result.Asks {
-		orderbook.Add("ask", row[0], row[1])
+	for _, row := range result.Asks {
+		orderbook.Add("ask", util.D(row[0]), util.D(row[1]))
 	}
-	for _, row := range resObj.Result.Bids {
-		orderbook.Add("bid", row[0], row[1])
+	for _, row := range result.Bids {
+		orderbook.Add("bid", util.D(row[0]), util.D(row[1]))
 	}
-	return orderbook
+	return orderbook, nil
 }
 func (ftx *FTX) GetHistoryCandles(market string, resolution int,
-	startTime int64, endTime int64) []*util.Candle {
+	startTime int64, endTime int64) ([]*util.Candle, error) {
 	type candleRes struct {
 		Close     float64
 		High      float64
@@ -142,10 +300,6 @@ func (ftx *FTX) GetHistoryCandles(market string, resolution int,
 		StartTime string
 		Volume    float64
 	}
-	type historyRes struct {
-		Success bool
-		Result  []candleRes
-	}
 	var candles []*util.Candle
 	maxReqInterval := int64(resolution * 5000)
 	for curStartTime := startTime; curStartTime < endTime; curStartTime += maxReqInterval {
@@ -153,50 +307,189 @@ func (ftx *FTX) GetHistoryCandles(market string, resolution int,
 		if curEndTime > endTime {
 			curEndTime = endTime
 		}
-		url := host + marketAPI + fmt.Sprintf(
+		path := marketAPI + fmt.Sprintf(
 			"/%s/candles?resolution=%d&start_time=%d&end_time=%d&limit=5000",
 			market, resolution, curStartTime, curEndTime)
-		var resObj historyRes
-		ftx.restClient.Get(url, nil, nil, &resObj)
-		for _, c := range resObj.Result {
+		var result []candleRes
+		if err := ftx.request("GET", path, false, nil, &result); err != nil {
+			return nil, err
+		}
+		for _, c := range result {
 			candles = append(candles, util.NewCandle(
 				c.Open, c.High, c.Low, c.Close, c.Volume, c.StartTime))
 		}
 	}
-	return candles
+	return candles, nil
 }
-func sleepToNextCandle(resolution int64) {
-	timeToNextCandle := resolution - time.Now().Unix()%resolution
-	sleepDuration := util.Duration{Second: timeToNextCandle + 1}
-	time.Sleep(sleepDuration.GetTimeDuration())
+
+// subPublic subscribes channel of market on the public websocket, which is
+// connected on first call. publicMutex must be held.
+func (ftx *FTX) subPublic(channel, market string) error {
+	if ftx.publicWS != nil {
+		// the subscription is restored after a failed write breaks the
+		// connection
+		if err := ftx.publicWS.Subscribe(channel, []string{market}); err != nil {
+			util.Warning(ftx.tag, "cannot subscribe", channel, market, err.Error())
+		}
+		return nil
+	}
+	ch := make(chan Response)
+	client := ftx.newWSClient(ch)
+	client.Subscribe(channel, []string{market})
+	if err := client.Connect(context.Background()); err != nil {
+		return err
+	}
+	ftx.publicWS = client
+	go func() {
+		for res := range ch {
+			switch res.Type {
+			case TRADES:
+				ftx.publicMutex.Lock()
+				tradeSubs := ftx.tradeSubs[res.Symbol]
+				ftx.publicMutex.Unlock()
+				for _, s := range tradeSubs {
+					s.push(res.Trades)
+				}
+			case TICKER:
+				ftx.publicMutex.Lock()
+				tickerSubs := activeSubscribers(ftx.tickerSubs[res.Symbol])
+				ftx.tickerSubs[res.Symbol] = tickerSubs
+				ftx.publicMutex.Unlock()
+				for _, s := range tickerSubs {
+					s.push(res.Ticker)
+				}
+			case ERROR:
+				util.Error(ftx.tag, "public websocket error", res.Results.Error())
+			}
+		}
+	}()
+	return nil
 }
 
-// resolution can be 15, 60, 300, 900, 3600, 14400, 86400
-func (ftx *FTX) SubCandle(
-	market string, resolution int, c chan<- *util.Candle) {
+// subTrades sends trades of market to c in real time. Trades are buffered
+// without dropping any, since candles are built from all of them.
+func (ftx *FTX) subTrades(market string, c chan<- []util.Trade) error {
+	ftx.publicMutex.Lock()
+	defer ftx.publicMutex.Unlock()
+	if _, exist := ftx.tradeSubs[market]; !exist {
+		if err := ftx.subPublic("trades", market); err != nil {
+			return err
+		}
+	}
+	ftx.tradeSubs[market] = append(ftx.tradeSubs[market], newLosslessSubscriber(
+		context.Background(), ftx.tag+"-trades-"+market,
+		func(v interface{}, done <-chan struct{}) {
+			select {
+			case c <- v.([]util.Trade):
+			case <-done:
+			}
+		}, nil))
+	return nil
+}
+
+// SubTicker sends the best bid and ask of market to c on each change, until
+// ctx is done and c is closed. Tickers are buffered for a slow receiver like
+// fills.
+func (ftx *FTX) SubTicker(ctx context.Context, market string,
+	c chan<- *util.Ticker) error {
+	ftx.publicMutex.Lock()
+	defer ftx.publicMutex.Unlock()
+	if _, exist := ftx.tickerSubs[market]; !exist {
+		if err := ftx.subPublic("ticker", market); err != nil {
+			return err
+		}
+	}
+	ftx.tickerSubs[market] = append(ftx.tickerSubs[market],
+		newTickerSubscriber(ctx, ftx.tag+"-ticker-"+market, c))
+	return nil
+}
+
+// getCandle returns the candle of market starting at the start time of
+// candle, or candle itself if the candle cannot be fetched.
+func (ftx *FTX) getCandle(market string, resolution int,
+	candle *util.Candle) *util.Candle {
+	start := candle.GetTime().Unix()
+	candles, err := ftx.GetHistoryCandles(market, resolution, start, start+1)
+	if err != nil || len(candles) == 0 {
+		util.Warning(ftx.tag, "first candle of", market, "misses trades:", fmt.Sprint(err))
+		return candle
+	}
+	return candles[0]
+}
+
+// SubCandle builds candles of market from its trades and sends each one to c
+// when it closes, until ctx is done and c is closed. The first candle misses
+// trades before subscribing, so it is fetched from REST instead if possible.
+// resolution can be any number of seconds, such as 15, 60, 300 or 3600.
+// Candles are buffered for a slow receiver like fills.
+func (ftx *FTX) SubCandle(ctx context.Context,
+	market string, resolution int, c chan<- *util.Candle) error {
+	dataID := fmt.Sprintf("%s-%d", market, resolution)
+	ftx.candleMutex.Lock()
+	defer ftx.candleMutex.Unlock()
+	// someone may already sub this data
+	if _, exist := ftx.candleData[dataID]; !exist {
+		trades := make(chan []util.Trade)
+		if err := ftx.subTrades(market, trades); err != nil {
+			return err
+		}
+		ftx.candleData[dataID] = []*util.Candle{}
+		go ftx.buildCandles(market, resolution, trades)
+	}
+	ftx.candleSubs[dataID] = append(ftx.candleSubs[dataID], newSubscriber(ctx,
+		ftx.tag+"-"+dataID, func(v interface{}, done <-chan struct{}) {
+			select {
+			case c <- v.(*util.Candle):
+			case <-done:
+			}
+		}, func() { close(c) }))
+	return nil
+}
+
+// buildCandles sends candles built from trades to subscribers of market and
+// resolution. It keeps building without subscribers, trades are subscribed
+// for good.
+func (ftx *FTX) buildCandles(market string, resolution int,
+	trades <-chan []util.Trade) {
 	dataID := fmt.Sprintf("%s-%d", market, resolution)
-	if _, exist := ftx.candleData[dataID]; exist {
-		// someone already sub this data
-		ftx.candleSubs[dataID] = append(ftx.candleSubs[dataID], c)
-		return
-	}
-	ftx.candleData[dataID] = []*util.Candle{}
-	ftx.candleSubs[dataID] = []chan<- *util.Candle{}
-	ftx.candleSubs[dataID] = append(ftx.candleSubs[dataID], c)
-	resolution64 := int64(resolution)
-	// sleep to the next candle
-	sleepToNextCandle(resolution64)
+	builder := util.NewCandleBuilder(resolution)
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	first := true
 	for {
-		now := time.Now().Unix()
-		startTime := now - resolution64*2 + 1
-		endTime := now - resolution64
-		candles := ftx.GetHistoryCandles(
-			"BTC-PERP", resolution, startTime, endTime)
-		for _, c := range ftx.candleSubs[dataID] {
-			c <- candles[0]
+		var candles []*util.Candle
+		select {
+		case ts := <-trades:
+			for i := range ts {
+				candles = append(candles, builder.Add(&ts[i])...)
+			}
+		case now := <-timer.C:
+			candles = builder.Close(now)
+		}
+		if first && len(candles) > 0 {
+			first = false
+			candles[0] = ftx.getCandle(market, resolution, candles[0])
 		}
+		ftx.candleMutex.Lock()
+		subs := activeSubscribers(ftx.candleSubs[dataID])
+		ftx.candleSubs[dataID] = subs
 		ftx.candleData[dataID] = append(ftx.candleData[dataID], candles...)
-		sleepToNextCandle(resolution64)
+		ftx.candleMutex.Unlock()
+		for _, candle := range candles {
+			for _, s := range subs {
+				s.push(candle.Copy())
+			}
+		}
+		// close exactly on the boundary even without trades
+		if next := builder.NextClose(); !next.IsZero() {
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(time.Until(next))
+		}
 	}
 }
 func (ftx *FTX) genAuthHeader(method, path, body string) *http.Header {
@@ -212,30 +505,28 @@ func (ftx *FTX) genAuthHeader(method, path, body string) *http.Header {
 	}
 	return &header
 }
-func (ftx *FTX) GetWallet() *util.Wallet {
+func (ftx *FTX) GetWallet() (*util.Wallet, error) {
 	type coin struct {
 		Coin  string
-		Free  float64
-		Total float64
+		Free  decimal.Decimal
+		Total decimal.Decimal
 	}
-	type res struct {
-		Success bool
-		Result  []coin
+	var result []coin
+	if err := ftx.request("GET", walletAPI, true, nil, &result); err != nil {
+		return nil, err
 	}
-	url := host + walletAPI
-	header := ftx.genAuthHeader("GET", walletAPI, "")
-	var resObj res
-	ftx.restClient.Get(url, header, nil, &resObj)
 	wallet := util.NewWallet()
-	for _, coin := range resObj.Result {
+	for _, coin := range result {
 		wallet.Increase(coin.Coin, coin.Total)
 	}
-	return wallet
+	return wallet, nil
 }
-func (ftx *FTX) GetPosition(market string) *util.Position {
+
+// GetPosition returns nil if there is no position on market.
+func (ftx *FTX) GetPosition(market string) (*util.Position, error) {
 	type resPos struct {
 		Cost                         float64
-		EntryPrice                   float64
+		EntryPrice                   decimal.Decimal
 		EstimatedLiquidationPrice    float64
 		Future                       string
 		InitialMarginRequirement     float64
@@ -246,23 +537,15 @@ func (ftx *FTX) GetPosition(market string) *util.Position {
 		RealizedPnl                  float64
 		ShortOrderSize               float64
 		Side                         string
-		Size                         float64
+		Size                         decimal.Decimal
 		UnrealizedPnl                float64
 	}
-	type res struct {
-		Success bool
-		Result  []resPos
-	}
-	url := host + positionAPI
-	header := ftx.genAuthHeader("GET", positionAPI, "")
-	var resObj res
-	ftx.restClient.Get(url, header, nil, &resObj)
-	if !resObj.Success {
-		fmt.Println(resObj)
-		util.Error(ftx.tag, "Cancel all order error")
+	var result []resPos
+	if err := ftx.request("GET", positionAPI, true, nil, &result); err != nil {
+		return nil, err
 	}
-	for _, pos := range resObj.Result {
-		if pos.Future == market && pos.Size != 0 {
+	for _, pos := range result {
+		if pos.Future == market && !pos.Size.IsZero() {
 			var side string
 			if pos.Side == "sell" {
 				side = "short"
@@ -274,12 +557,12 @@ func (ftx *FTX) GetPosition(market string) *util.Position {
 				Side:      side,
 				Size:      pos.Size,
 				OpenPrice: pos.EntryPrice,
-			}
+			}, nil
 		}
 	}
-	return nil
+	return nil, nil
 }
-func (ftx *FTX) MakeOrder(order *util.Order) int64 {
+func (ftx *FTX) MakeOrder(order *util.Order) (int64, error) {
 	type result struct {
 		CreatedAt  string
 		FilledSize float64
@@ -303,9 +586,8 @@ func (ftx *FTX) MakeOrder(order *util.Order) int64 {
 		OrderType        string
 		RetryUntilFilled bool
 	}
-	type res struct {
-		Success bool
-		Result  result
+	if err := ftx.roundOrder(order); err != nil {
+		return 0, err
 	}
 	var api string
 	if order.Type == "market" || order.Type == "limit" {
@@ -313,158 +595,329 @@ func (ftx *FTX) MakeOrder(order *util.Order) int64 {
 	} else if order.Type == "stop" || order.Type == "trailingStop" ||
 		order.Type == "takeProfit" {
 		api = condOrderAPI
+	} else {
+		return 0, fmt.Errorf("unknown order type %s", order.Type)
+	}
+	if api == condOrderAPI {
+		var resObj result
+		if err := ftx.request("POST", api, true,
+			order.CreateMap(), &resObj); err != nil {
+			return 0, err
+		}
+		return resObj.Id, nil
+	}
+	// conditional orders do not take client id
+	if order.ClientId == nil {
+		clientID := util.NewClientID()
+		order.ClientId = &clientID
+	}
+	clientID := *order.ClientId
+	ftx.clientOrdersMutex.Lock()
+	id, exist := ftx.clientOrders[clientID]
+	ftx.clientOrdersMutex.Unlock()
+	if exist {
+		return id, nil
+	}
+	var err error
+	for attempt := 0; attempt < 3; attempt++ {
+		var resObj result
+		err = ftx.request("POST", api, true, order.CreateMap(), &resObj)
+		if err == nil {
+			id = resObj.Id
+			break
+		}
+		if !isUncertain(err) {
+			return 0, err
+		}
+		// the order may have been placed, look it up before sending again
+		util.Warning(ftx.tag, "order", clientID, "may be placed:", err.Error())
+		status, lookupErr := ftx.GetOrderByClientID(clientID)
+		if lookupErr == nil {
+			id = status.ID
+			err = nil
+			break
+		}
+		var apiErr *APIError
+		if !errors.As(lookupErr, &apiErr) {
+			// cannot tell whether the order exists
+			return 0, fmt.Errorf("%v, and lookup failed: %v", err, lookupErr)
+		}
 	}
-	url := host + api
-	orderStr := util.GetJSONString(order.CreateMap())
-	header := ftx.genAuthHeader("POST", api, orderStr)
-	var resObj res
-	ftx.restClient.Post(url, header,
-		util.GetJSONBuffer(order.CreateMap()), &resObj)
-	if !resObj.Success {
-		fmt.Println(resObj)
-		util.Error(ftx.tag, "Make order error")
+	if err != nil {
+		return 0, err
 	}
-	return resObj.Result.Id
+	ftx.clientOrdersMutex.Lock()
+	ftx.clientOrders[clientID] = id
+	ftx.clientOrdersMutex.Unlock()
+	return id, nil
+}
+
+// roundOrder rounds order to the increments of its market, which FTX
+// requires, and rejects orders the market does not accept.
+func (ftx *FTX) roundOrder(order *util.Order) error {
+	market, err := ftx.markets.Get(order.Market)
+	if err != nil {
+		return fmt.Errorf("cannot round order: %v", err)
+	}
+	if !market.Enabled {
+		return fmt.Errorf("market %s is disabled", market.Name)
+	}
+	if market.PostOnly && !order.PostOnly {
+		return fmt.Errorf("market %s only accepts post only orders",
+			market.Name)
+	}
+	return order.Round(market.PriceIncrement, market.SizeIncrement,
+		market.MinProvideSize)
 }
-func (ftx *FTX) CancelAllOrder(market string) {
+
+// isUncertain reports whether a request may have taken effect despite err.
+func isUncertain(err error) bool {
+	var transportErr *util.TransportError
+	if errors.As(err, &transportErr) {
+		return true
+	}
+	var statusErr *util.StatusError
+	return errors.As(err, &statusErr) && statusErr.StatusCode >= 500
+}
+func (ftx *FTX) CancelAllOrder(market string) error {
 	type req struct {
-		Market string
+		Market string `json:"market"`
 	}
 	reqBody := req{
 		Market: market,
 	}
-	type res struct {
-		Success bool
-		Result  string
+	var result string
+	return ftx.request("DELETE", orderAPI, true, reqBody, &result)
+}
+func (ftx *FTX) GetOrder(id int64) (*util.OrderStatus, error) {
+	var result util.OrderStatus
+	path := orderAPI + fmt.Sprintf("/%d", id)
+	if err := ftx.request("GET", path, true, nil, &result); err != nil {
+		return nil, err
 	}
-	url := host + orderAPI
-	header := ftx.genAuthHeader("DELETE", orderAPI, util.GetJSONString(reqBody))
-	var resObj res
-	ftx.restClient.Delete(url, header, util.GetJSONBuffer(reqBody), &resObj)
-	if !resObj.Success {
-		fmt.Println(resObj)
-		util.Error(ftx.tag, "Cancel all order error")
+	return &result, nil
+}
+
+// GetOpenOrders returns open orders of market, or of all markets if market is
+// empty.
+func (ftx *FTX) GetOpenOrders(market string) ([]*util.OrderStatus, error) {
+	var result []*util.OrderStatus
+	path := orderAPI + timeRangeQuery(market, 0, 0)
+	if err := ftx.request("GET", path, true, nil, &result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+func (ftx *FTX) GetOrderByClientID(clientID string) (*util.OrderStatus, error) {
+	var result util.OrderStatus
+	path := orderAPI + "/by_client_id/" + url.PathEscape(clientID)
+	if err := ftx.request("GET", path, true, nil, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+func (ftx *FTX) CancelOrder(id int64) error {
+	var result string
+	path := orderAPI + fmt.Sprintf("/%d", id)
+	return ftx.request("DELETE", path, true, nil, &result)
+}
+func (ftx *FTX) CancelOrderByClientID(clientID string) error {
+	var result string
+	path := orderAPI + "/by_client_id/" + url.PathEscape(clientID)
+	return ftx.request("DELETE", path, true, nil, &result)
+}
+
+// ModifyOrder replaces the order with a new one of price and size, 0 keeps
+// the original value. The returned order has a new id.
+func (ftx *FTX) ModifyOrder(id int64, price, size float64) (*util.OrderStatus, error) {
+	reqBody := make(map[string]interface{})
+	if price > 0 {
+		reqBody["price"] = price
+	}
+	if size > 0 {
+		reqBody["size"] = size
+	}
+	var result util.OrderStatus
+	path := orderAPI + fmt.Sprintf("/%d/modify", id)
+	if err := ftx.request("POST", path, true, reqBody, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// GetOrderHistory returns orders of market created between startTime and
+// endTime. Empty market means all markets and 0 means no limit on time.
+func (ftx *FTX) GetOrderHistory(market string,
+	startTime, endTime int64) ([]*util.OrderStatus, error) {
+	var result []*util.OrderStatus
+	path := orderHistoryAPI + timeRangeQuery(market, startTime, endTime)
+	if err := ftx.request("GET", path, true, nil, &result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// GetFills returns fills of market between startTime and endTime. Empty
+// market means all markets and 0 means no limit on time.
+func (ftx *FTX) GetFills(market string,
+	startTime, endTime int64) ([]*util.Fill, error) {
+	var result []*util.Fill
+	path := fillAPI + timeRangeQuery(market, startTime, endTime)
+	if err := ftx.request("GET", path, true, nil, &result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// GetOpenTriggerOrders returns open conditional orders of market, or of all
+// markets if market is empty.
+func (ftx *FTX) GetOpenTriggerOrders(market string) ([]*util.TriggerOrderStatus, error) {
+	var result []*util.TriggerOrderStatus
+	path := condOrderAPI + timeRangeQuery(market, 0, 0)
+	if err := ftx.request("GET", path, true, nil, &result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// GetTriggerOrderHistory returns conditional orders of market created between
+// startTime and endTime. Empty market means all markets and 0 means no limit
+// on time.
+func (ftx *FTX) GetTriggerOrderHistory(market string,
+	startTime, endTime int64) ([]*util.TriggerOrderStatus, error) {
+	var result []*util.TriggerOrderStatus
+	path := condOrderHistoryAPI + timeRangeQuery(market, startTime, endTime)
+	if err := ftx.request("GET", path, true, nil, &result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// GetTriggers returns orders placed by the conditional order.
+func (ftx *FTX) GetTriggers(id int64) ([]*util.Trigger, error) {
+	var result []*util.Trigger
+	path := condOrderAPI + fmt.Sprintf("/%d/triggers", id)
+	if err := ftx.request("GET", path, true, nil, &result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+func (ftx *FTX) CancelTriggerOrder(id int64) error {
+	var result string
+	path := condOrderAPI + fmt.Sprintf("/%d", id)
+	return ftx.request("DELETE", path, true, nil, &result)
+}
+
+// ModifyTriggerOrder replaces the conditional order with a new one, 0 keeps
+// the original value. FTX requires size, and triggerPrice or trailValue
+// depending on the order type. The returned order has a new id.
+func (ftx *FTX) ModifyTriggerOrder(id int64, size, triggerPrice, orderPrice,
+	trailValue float64) (*util.TriggerOrderStatus, error) {
+	reqBody := make(map[string]interface{})
+	if size > 0 {
+		reqBody["size"] = size
+	}
+	if triggerPrice > 0 {
+		reqBody["triggerPrice"] = triggerPrice
+	}
+	if orderPrice > 0 {
+		reqBody["orderPrice"] = orderPrice
+	}
+	if trailValue != 0 {
+		reqBody["trailValue"] = trailValue
+	}
+	var result util.TriggerOrderStatus
+	path := condOrderAPI + fmt.Sprintf("/%d/modify", id)
+	if err := ftx.request("POST", path, true, reqBody, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+func timeRangeQuery(market string, startTime, endTime int64) string {
+	query := url.Values{}
+	if market != "" {
+		query.Set("market", market)
+	}
+	if startTime > 0 {
+		query.Set("start_time", strconv.FormatInt(startTime, 10))
+	}
+	if endTime > 0 {
+		query.Set("end_time", strconv.FormatInt(endTime, 10))
+	}
+	if len(query) == 0 {
+		return ""
 	}
+	return "?" + query.Encode()
 }
 func (ftx *FTX) GetFundingRates(startTime, endTime int64,
-	future string) []float64 {
+	future string) ([]float64, error) {
 	type result struct {
 		Future string
 		Rate   float64
 		Time   string
 	}
-	type res struct {
-		Success bool
-		Result  []result
-	}
-	url := host + fundingRateAPI
-	url += fmt.Sprintf("?start_time=%d&end_time=%d&future=%s",
+	path := fundingRateAPI + fmt.Sprintf("?start_time=%d&end_time=%d&future=%s",
 		startTime, endTime, future)
-	req := make(map[string]interface{})
-	req["start_time"] = startTime
-	req["end_time"] = endTime
-	req["future"] = future
-	var resObj res
-	ftx.restClient.Get(url, nil, nil, &resObj)
-	if !resObj.Success {
-		fmt.Println(resObj)
-		util.Error(ftx.tag, "Get funding rates error")
+	var results []result
+	if err := ftx.request("GET", path, false, nil, &results); err != nil {
+		return nil, err
 	}
 	var rates []float64
-	for _, result := range resObj.Result {
+	for _, result := range results {
 		rates = append(rates, result.Rate)
 	}
-	return rates
+	return rates, nil
 }
 
-type futureResult struct {
+type FutureResult struct {
 	Ask   float64
 	Bid   float64
 	Index float64
 }
 
-func (ftx *FTX) GetFuture(future string) (futureResult, error) {
-	type res struct {
-		Success bool
-		Result  futureResult
-	}
-	url := host + futureAPI + "/" + future
-	var resObj res
-	ftx.restClient.Get(url, nil, nil, &resObj)
-	if !resObj.Success {
-		fmt.Println(resObj)
-		errorMsg := fmt.Sprintf("Get future %s error", future)
-		util.Error(ftx.tag, errorMsg)
-		return resObj.Result, errors.New(errorMsg)
-	}
-	return resObj.Result, nil
+func (ftx *FTX) GetFuture(future string) (FutureResult, error) {
+	var result FutureResult
+	err := ftx.request("GET", futureAPI+"/"+future, false, nil, &result)
+	return result, err
 }
 
-type futureStatsResult struct {
+type FutureStatsResult struct {
 	NextFundingRate float64
 	NextFundingTime string
 }
 
-func (ftx *FTX) GetFutureStats(future string) futureStatsResult {
-	type res struct {
-		Success bool
-		Result  futureStatsResult
-	}
-	url := host + futureAPI + "/" + future + "/stats"
-	var resObj res
-	ftx.restClient.Get(url, nil, nil, &resObj)
-	if !resObj.Success {
-		fmt.Println(resObj)
-		util.Error(ftx.tag, "Get future stats error")
-	}
-	return resObj.Result
+func (ftx *FTX) GetFutureStats(future string) (FutureStatsResult, error) {
+	var result FutureStatsResult
+	err := ftx.request("GET", futureAPI+"/"+future+"/stats", false, nil, &result)
+	return result, err
 }
 
-type MarketPairs struct {
-	Perps    []string
-	Quarters []string
-	Spots    []string
-}
-
-// Get all markets
-func (ftx *FTX) GetMarketPairs() (*MarketPairs, error) {
-	type markets struct {
-		Name string
-		Type string
-	}
-
-	type res struct {
-		Success bool
-		Result  []markets
-	}
-
-	var resObj res
-	url := host + marketAPI
-	ftx.restClient.Get(url, nil, nil, &resObj)
-
-	if !resObj.Success {
-		fmt.Println(resObj)
-		errorMsg := fmt.Sprintf("Get all markets error")
-		util.Error(ftx.tag, errorMsg)
-		return nil, errors.New(errorMsg)
-	}
-
-	var marketPairs MarketPairs
-	for _, market := range resObj.Result {
-		switch marketType := market.Type; marketType {
-		case "future":
-			existIndex := strings.Index(market.Name, "-PERP")
-			if existIndex >= 0 {
-				marketPairs.Perps = append(marketPairs.Perps, market.Name)
-			} else {
-				marketPairs.Quarters = append(marketPairs.Quarters, market.Name)
-			}
-		case "spot":
-			marketPairs.Spots = append(marketPairs.Spots, market.Name)
+// GetMarkets returns all markets, with types and expiries of futures from the
+// futures listing. Use Markets for a cached catalog.
+func (ftx *FTX) GetMarkets() ([]*Market, error) {
+	var markets []*Market
+	if err := ftx.request("GET", marketAPI, false, nil, &markets); err != nil {
+		return nil, err
+	}
+	var futures []struct {
+		Name   string
+		Type   string
+		Expiry time.Time
+	}
+	if err := ftx.request("GET", futureAPI, false, nil, &futures); err != nil {
+		return nil, err
+	}
+	byName := make(map[string]*Market)
+	for _, m := range markets {
+		byName[m.Name] = m
+	}
+	for _, f := range futures {
+		if m, exist := byName[f.Name]; exist {
+			m.FutureType = f.Type
+			m.Expiry = f.Expiry
 		}
 	}
-
-	return &marketPairs, nil
+	return markets, nil
 }
 
 type SpotMarginBorrowRate struct {
@@ -475,22 +928,10 @@ type SpotMarginBorrowRate struct {
 
 // Get spot margin borrow rates
 func (ftx *FTX) GetspotMarginBorrowRates() (*[]SpotMarginBorrowRate, error) {
-	type res struct {
-		Success bool
-		Result  []SpotMarginBorrowRate
-	}
-
-	var resObj res
-	url := host + spotMarginBorrowRatesAPI
-	header := ftx.genAuthHeader("GET", spotMarginBorrowRatesAPI, "")
-	ftx.restClient.Get(url, header, nil, &resObj)
-
-	if !resObj.Success {
-		fmt.Println(resObj)
-		errorMsg := fmt.Sprintf("Get spot margin borrow rates error")
-		util.Error(ftx.tag, errorMsg)
-		return nil, errors.New(errorMsg)
+	var result []SpotMarginBorrowRate
+	if err := ftx.request("GET", spotMarginBorrowRatesAPI, true,
+		nil, &result); err != nil {
+		return nil, err
 	}
-
-	return &resObj.Result, nil
+	return &result, nil
 }
@@ -0,0 +1,491 @@
+package exchange
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	util "crypto-flash/internal/service/util"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+// To refresh the fixtures, replace util.FixtureReplay with util.FixtureRecord
+// and run the tests with a real key.
+func newTestFTX() *FTX {
+	ftx := NewFTX("key", "secret", "sub",
+		WithRestURL("https://ftx.invalid/"),
+		WithTransport(util.NewFixtureTransport(
+			util.FixtureReplay, "testdata/fixtures")))
+	ftx.restClient.SetRetry(0, 0, 0)
+	return ftx
+}
+
+func TestFTXGetOrderbook(t *testing.T) {
+	ob, err := newTestFTX().GetOrderbook("BTC-PERP", 2)
+	assert.Nil(t, err)
+	assert.Equal(t, rows(34010, 1.2, 34011, 0.5), ob.Asks)
+	assert.Equal(t, rows(34009, 0.8, 34008, 2.1), ob.Bids)
+}
+
+func TestFTXGetHistoryCandles(t *testing.T) {
+	candles, err := newTestFTX().GetHistoryCandles(
+		"BTC-PERP", 60, 1609459200, 1609459320)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(candles))
+	assert.Equal(t, 29000.0, candles[0].Open)
+	assert.Equal(t, 29050.0, candles[0].High)
+	assert.Equal(t, 28980.0, candles[0].Low)
+	assert.Equal(t, 29010.0, candles[0].Close)
+	assert.Equal(t, 28990.0, candles[2].Close)
+}
+
+func TestFTXGetWallet(t *testing.T) {
+	wallet, err := newTestFTX().GetWallet()
+	assert.Nil(t, err)
+	assert.Equal(t, "2000.25", wallet.GetBalance("USD").String())
+	assert.Equal(t, "0.1", wallet.GetBalance("BTC").String())
+}
+
+func TestFTXGetPosition(t *testing.T) {
+	ftx := newTestFTX()
+	pos, err := ftx.GetPosition("BTC-PERP")
+	assert.Nil(t, err)
+	assert.Equal(t, "short", pos.Side)
+	assert.Equal(t, "0.1", pos.Size.String())
+	assert.Equal(t, "34000", pos.OpenPrice.String())
+	// closed position
+	pos, err = ftx.GetPosition("ETH-PERP")
+	assert.Nil(t, err)
+	assert.Nil(t, pos)
+}
+
+func TestFTXMakeOrder(t *testing.T) {
+	ftx := newTestFTX()
+	id, err := ftx.MakeOrder(&util.Order{Market: "BTC-PERP", Side: "buy",
+		Type: "limit", Price: util.D(33000), Size: util.D(0.1)})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(9596912), id)
+	id, err = ftx.MakeOrder(&util.Order{Market: "BTC-PERP", Side: "sell",
+		Type: "stop", TriggerPrice: util.D(32000), Size: util.D(0.1), ReduceOnly: true})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(50001), id)
+	_, err = ftx.MakeOrder(&util.Order{Market: "BTC-PERP", Type: "unknown"})
+	assert.NotNil(t, err)
+}
+
+func TestFTXMakeOrderRound(t *testing.T) {
+	ftx := newTestFTX()
+	order := &util.Order{Market: "BTC-PERP", Side: "buy", Type: "limit",
+		Price: util.D(33000.4), Size: util.D(0.12345)}
+	_, err := ftx.MakeOrder(order)
+	assert.Nil(t, err)
+	assert.Equal(t, "33000", order.Price.String())
+	assert.Equal(t, "0.1234", order.Size.String())
+	// smaller than the minimum provide size
+	_, err = ftx.MakeOrder(&util.Order{Market: "BTC-PERP", Side: "buy",
+		Type: "limit", Price: util.D(33000), Size: util.D(0.0009)})
+	assert.NotNil(t, err)
+	// smaller than the size increment
+	_, err = ftx.MakeOrder(&util.Order{Market: "BTC-PERP", Side: "buy",
+		Type: "market", Size: util.D(0.00009)})
+	assert.NotNil(t, err)
+	_, err = ftx.MakeOrder(&util.Order{Market: "UNKNOWN-PERP", Side: "buy",
+		Type: "market", Size: util.D(1)})
+	assert.NotNil(t, err)
+	// ETH/USD is in post only mode
+	_, err = ftx.MakeOrder(&util.Order{Market: "ETH/USD", Side: "buy",
+		Type: "market", Size: util.D(1)})
+	assert.NotNil(t, err)
+}
+
+func TestFTXCancelAllOrder(t *testing.T) {
+	assert.Nil(t, newTestFTX().CancelAllOrder("BTC-PERP"))
+}
+
+func TestFTXGetFundingRates(t *testing.T) {
+	rates, err := newTestFTX().GetFundingRates(
+		1609459200, 1609466400, "BTC-PERP")
+	assert.Nil(t, err)
+	assert.Equal(t, []float64{0.0001, -0.00005, 0.00002}, rates)
+}
+
+func TestFTXGetFuture(t *testing.T) {
+	ftx := newTestFTX()
+	future, err := ftx.GetFuture("BTC-PERP")
+	assert.Nil(t, err)
+	assert.Equal(t, FutureResult{Ask: 34010, Bid: 34009, Index: 34000.5}, future)
+	stats, err := ftx.GetFutureStats("BTC-PERP")
+	assert.Nil(t, err)
+	assert.Equal(t, FutureStatsResult{
+		NextFundingRate: 0.00012,
+		NextFundingTime: "2021-01-01T03:00:00+00:00",
+	}, stats)
+}
+
+func TestFTXAPIError(t *testing.T) {
+	_, err := newTestFTX().GetFuture("NOPE-PERP")
+	var apiErr *APIError
+	assert.True(t, errors.As(err, &apiErr))
+	assert.Equal(t, http.StatusNotFound, apiErr.StatusCode)
+	assert.Equal(t, "No such future: NOPE-PERP", apiErr.Message)
+}
+
+func TestFTXMissingFixture(t *testing.T) {
+	_, err := newTestFTX().GetFutureStats("NOPE-PERP")
+	var transportErr *util.TransportError
+	assert.True(t, errors.As(err, &transportErr))
+}
+
+func TestFTXGetMarkets(t *testing.T) {
+	markets, err := newTestFTX().GetMarkets()
+	assert.Nil(t, err)
+	assert.Equal(t, 5, len(markets))
+	perp, quarter, spot := markets[0], markets[1], markets[2]
+	assert.True(t, perp.IsPerpetual())
+	assert.Equal(t, "BTC", perp.Underlying)
+	assert.True(t, perp.Expiry.IsZero())
+	assert.Equal(t, 1500000000.0, perp.VolumeUsd24h)
+	assert.True(t, quarter.IsDated())
+	assert.Equal(t, time.Date(2021, 3, 26, 3, 0, 0, 0, time.UTC),
+		quarter.Expiry.UTC())
+	assert.True(t, spot.IsSpot())
+	assert.False(t, spot.IsDated())
+	assert.Equal(t, "BTC", spot.BaseCurrency)
+	assert.Equal(t, "USD", spot.QuoteCurrency)
+	assert.Equal(t, "0.0001", spot.MinProvideSize.String())
+	assert.True(t, spot.Tradable())
+	assert.False(t, markets[4].Tradable())
+}
+
+func TestFTXGetSpotMarginBorrowRates(t *testing.T) {
+	rates, err := newTestFTX().GetspotMarginBorrowRates()
+	assert.Nil(t, err)
+	assert.Equal(t, []SpotMarginBorrowRate{
+		{Coin: "BTC", Estimate: 0.0000025, Previous: 0.0000024},
+		{Coin: "USD", Estimate: 0.000003, Previous: 0.0000029},
+	}, *rates)
+}
+
+func TestFTXGetOrder(t *testing.T) {
+	status, err := newTestFTX().GetOrder(9596912)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(9596912), status.ID)
+	assert.Equal(t, "BTC-PERP", status.Market)
+	assert.Equal(t, 32990.5, status.AvgFillPrice)
+	assert.True(t, status.IsFilled())
+}
+
+func TestFTXGetOpenOrders(t *testing.T) {
+	orders, err := newTestFTX().GetOpenOrders("BTC-PERP")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(orders))
+	assert.Equal(t, "my-order-1", orders[0].ClientID)
+	assert.Equal(t, 0.0, orders[0].AvgFillPrice)
+	assert.False(t, orders[1].IsClosed())
+	assert.Equal(t, 0.05, orders[1].RemainingSize)
+}
+
+func TestFTXCancelOrder(t *testing.T) {
+	ftx := newTestFTX()
+	assert.Nil(t, ftx.CancelOrder(9596913))
+	assert.Nil(t, ftx.CancelOrderByClientID("my-order-1"))
+	var apiErr *APIError
+	assert.True(t, errors.As(ftx.CancelOrder(9596999), &apiErr))
+	assert.Equal(t, "Order already closed", apiErr.Message)
+}
+
+func TestFTXModifyOrder(t *testing.T) {
+	status, err := newTestFTX().ModifyOrder(9596914, 32500, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(9596920), status.ID)
+	assert.Equal(t, 32500.0, status.Price)
+}
+
+func TestFTXGetOrderHistory(t *testing.T) {
+	orders, err := newTestFTX().GetOrderHistory(
+		"BTC-PERP", 1609459200, 1609466400)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(orders))
+	assert.True(t, orders[0].IsFilled())
+	assert.False(t, orders[1].IsFilled())
+}
+
+func TestFTXGetFills(t *testing.T) {
+	fills, err := newTestFTX().GetFills("BTC-PERP", 0, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []*util.Fill{{
+		ID: 11215, OrderID: 9596912, Market: "BTC-PERP", Side: "buy",
+		Price: 32990, Size: 0.06, Fee: 0.6, FeeRate: 0.0002,
+		Liquidity: "maker", Time: "2021-01-01T00:00:01.000000+00:00",
+	}, {
+		ID: 11216, OrderID: 9596912, Market: "BTC-PERP", Side: "buy",
+		Price: 32991.25, Size: 0.04, Fee: 0.92, FeeRate: 0.0007,
+		Liquidity: "taker", Time: "2021-01-01T00:00:02.000000+00:00",
+	}}, fills)
+}
+
+func TestFTXGetOpenTriggerOrders(t *testing.T) {
+	orders, err := newTestFTX().GetOpenTriggerOrders("BTC-PERP")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(orders))
+	assert.True(t, orders[0].IsOpen())
+	assert.Equal(t, 32000.0, orders[0].TriggerPrice)
+	assert.Equal(t, "trailing_stop", orders[1].Type)
+	assert.Equal(t, -500.0, orders[1].TrailValue)
+}
+
+func TestFTXGetTriggerOrderHistory(t *testing.T) {
+	ftx := newTestFTX()
+	orders, err := ftx.GetTriggerOrderHistory("BTC-PERP", 0, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(orders))
+	assert.True(t, orders[0].IsTriggered())
+	assert.Equal(t, "2021-01-01T01:00:00.000000+00:00", orders[0].TriggeredAt)
+	assert.Equal(t, 31995.0, orders[0].AvgFillPrice)
+	assert.Equal(t, "cancelled", orders[1].Status)
+	triggers, err := ftx.GetTriggers(orders[0].ID)
+	assert.Nil(t, err)
+	assert.Equal(t, []*util.Trigger{{
+		Time: "2021-01-01T01:00:00.000000+00:00", OrderID: 9597000,
+		OrderSize: 0.1, FilledSize: 0.1,
+	}}, triggers)
+}
+
+func TestFTXCancelModifyTriggerOrder(t *testing.T) {
+	ftx := newTestFTX()
+	assert.Nil(t, ftx.CancelTriggerOrder(50001))
+	order, err := ftx.ModifyTriggerOrder(50001, 0.1, 31500, 0, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(50003), order.ID)
+	assert.Equal(t, 31500.0, order.TriggerPrice)
+}
+
+// newOrderServer fails the first POST with 502, and places the order only if
+// placed is true.
+func newOrderServer(placed bool) (*httptest.Server, *int64, *string) {
+	var posts int64
+	var clientID string
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == "POST" {
+				var body map[string]interface{}
+				json.NewDecoder(r.Body).Decode(&body)
+				clientID = body["clientId"].(string)
+				if atomic.AddInt64(&posts, 1) == 1 {
+					w.WriteHeader(http.StatusBadGateway)
+					return
+				}
+				w.Write([]byte(`{"success":true,"result":{"id":2}}`))
+				return
+			}
+			if r.URL.Path == marketAPI {
+				w.Write([]byte(`{"success":true,"result":[{"name":"BTC-PERP",` +
+					`"enabled":true,"priceIncrement":1.0,"sizeIncrement":0.0001,` +
+					`"minProvideSize":0.001}]}`))
+				return
+			}
+			if r.URL.Path == futureAPI {
+				w.Write([]byte(`{"success":true,"result":[]}`))
+				return
+			}
+			if !strings.HasSuffix(r.URL.Path, "/by_client_id/"+clientID) {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			if !placed {
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte(`{"success":false,"error":"Order not found"}`))
+				return
+			}
+			w.Write([]byte(`{"success":true,"result":{"id":1,"clientId":"` +
+				clientID + `","status":"new"}}`))
+		}))
+	return ts, &posts, &clientID
+}
+
+func TestFTXMakeOrderLookupAfterFailure(t *testing.T) {
+	ts, posts, clientID := newOrderServer(true)
+	defer ts.Close()
+	ftx := NewFTX("key", "secret", "", WithRestURL(ts.URL))
+	order := &util.Order{Market: "BTC-PERP", Side: "buy", Type: "limit",
+		Price: util.D(100), Size: util.D(1), PostOnly: true}
+	id, err := ftx.MakeOrder(order)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), id)
+	assert.Equal(t, int64(1), *posts)
+	assert.Equal(t, *clientID, *order.ClientId)
+	// making the same order again does not send it
+	id, err = ftx.MakeOrder(order)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), id)
+	assert.Equal(t, int64(1), *posts)
+}
+
+func TestFTXMakeOrderResubmit(t *testing.T) {
+	ts, posts, _ := newOrderServer(false)
+	defer ts.Close()
+	ftx := NewFTX("key", "secret", "", WithRestURL(ts.URL))
+	id, err := ftx.MakeOrder(&util.Order{Market: "BTC-PERP", Side: "buy",
+		Type: "market", Size: util.D(1), Ioc: true})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), id)
+	assert.Equal(t, int64(2), *posts)
+}
+
+func TestFTXSignRetries(t *testing.T) {
+	var attempts int64
+	stamps := make(chan string, 2)
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			stamp := r.Header.Get("FTX-TS")
+			assert.Equal(t, util.HMac(stamp+r.Method+r.URL.RequestURI(),
+				"secret"), r.Header.Get("FTX-SIGN"))
+			stamps <- stamp
+			if atomic.AddInt64(&attempts, 1) == 1 {
+				w.Header().Set("Retry-After", "0")
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+			w.Write([]byte(`{"success":true,"result":[]}`))
+		}))
+	defer ts.Close()
+	ftx := NewFTX("key", "secret", "", WithRestURL(ts.URL))
+	ftx.restClient.SetRetry(1, 5*time.Millisecond, 5*time.Millisecond)
+	_, err := ftx.GetWallet()
+	assert.Nil(t, err)
+	// the retry is signed again with a new timestamp
+	assert.NotEqual(t, <-stamps, <-stamps)
+}
+
+func TestFTXSubCandle(t *testing.T) {
+	subs := make(chan request, 1)
+	ts := newWSServer(func(conn *websocket.Conn) {
+		var req request
+		conn.ReadJSON(&req)
+		subs <- req
+		now := time.Now().UTC()
+		next := now.Truncate(time.Second).Add(time.Second)
+		layout := "2006-01-02T15:04:05.000000+00:00"
+		conn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf(
+			`{"channel":"trades","market":"ETH-PERP","type":"update","data":[`+
+				`{"id":1,"price":100,"size":1,"side":"buy","liquidation":false,"time":"%s"}]}`,
+			now.Format(layout))))
+		conn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf(
+			`{"channel":"trades","market":"ETH-PERP","type":"update","data":[`+
+				`{"id":2,"price":102,"size":1,"side":"buy","liquidation":false,"time":"%s"},`+
+				`{"id":3,"price":101,"size":2,"side":"sell","liquidation":false,"time":"%s"}]}`,
+			next.Format(layout), next.Add(time.Millisecond).Format(layout))))
+		conn.ReadMessage()
+	})
+	defer ts.Close()
+	ftx := newTestFTX()
+	ftx.wsURL = wsURL(ts)
+	c := make(chan *util.Candle)
+	ctx, cancel := context.WithCancel(context.Background())
+	assert.Nil(t, ftx.SubCandle(ctx, "ETH-PERP", 1, c))
+	assert.Equal(t, request{Op: "subscribe", Channel: "trades",
+		Market: "ETH-PERP"}, <-subs)
+	// the first candle cannot be fetched without a fixture
+	first := <-c
+	assert.Equal(t, 100.0, first.Close)
+	// closed on the boundary without more trades
+	second := <-c
+	assert.Equal(t, 102.0, second.Open)
+	assert.Equal(t, 102.0, second.High)
+	assert.Equal(t, 101.0, second.Low)
+	assert.Equal(t, 101.0, second.Close)
+	assert.Equal(t, 304.0, second.Volume)
+	assert.Equal(t, time.Second, second.GetTime().Sub(first.GetTime()))
+	// c is closed once cancelled
+	cancel()
+	for range c {
+	}
+}
+
+func TestFTXSubTicker(t *testing.T) {
+	subs := make(chan request, 2)
+	ts := newWSServer(func(conn *websocket.Conn) {
+		for i := 0; i < 2; i++ {
+			var req request
+			conn.ReadJSON(&req)
+			subs <- req
+		}
+		conn.WriteMessage(websocket.TextMessage, []byte(
+			`{"channel":"ticker","market":"ETH-PERP","type":"update","data":`+
+				`{"bid":100.5,"ask":101,"bidSize":2,"askSize":3,"last":100.8,`+
+				`"time":1609459200.25}}`))
+		conn.ReadMessage()
+	})
+	defer ts.Close()
+	ftx := newTestFTX()
+	ftx.wsURL = wsURL(ts)
+	btc := make(chan *util.Ticker)
+	eth := make(chan *util.Ticker)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	assert.Nil(t, ftx.SubTicker(ctx, "BTC-PERP", btc))
+	assert.Nil(t, ftx.SubTicker(ctx, "ETH-PERP", eth))
+	assert.Equal(t, request{Op: "subscribe", Channel: "ticker",
+		Market: "BTC-PERP"}, <-subs)
+	assert.Equal(t, request{Op: "subscribe", Channel: "ticker",
+		Market: "ETH-PERP"}, <-subs)
+	ticker := <-eth
+	assert.Equal(t, "ETH-PERP", ticker.Market)
+	assert.Equal(t, 100.5, ticker.Bid)
+	assert.Equal(t, 101.0, ticker.Ask)
+	assert.Equal(t, 2.0, ticker.BidSize)
+	assert.Equal(t, 3.0, ticker.AskSize)
+	assert.Equal(t, 100.8, ticker.Last)
+	assert.Equal(t, 100.75, ticker.GetMid())
+	assert.Equal(t, int64(1609459200250), ticker.Time.UnixNano()/1e6)
+	assert.False(t, ticker.ReceivedAt.IsZero())
+}
+
+func TestFTXTradesDoNotBlockTickers(t *testing.T) {
+	ts := newWSServer(func(conn *websocket.Conn) {
+		for i := 0; i < 2; i++ {
+			var req request
+			conn.ReadJSON(&req)
+		}
+		for i := 1; i <= 3; i++ {
+			conn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf(
+				`{"channel":"trades","market":"ETH-PERP","type":"update","data":[`+
+					`{"id":%d,"price":100,"size":1,"side":"buy","liquidation":false,`+
+					`"time":"2021-01-01T00:00:00.000000+00:00"}]}`, i)))
+		}
+		conn.WriteMessage(websocket.TextMessage, []byte(
+			`{"channel":"ticker","market":"ETH-PERP","type":"update","data":`+
+				`{"bid":100.5,"ask":101,"bidSize":2,"askSize":3,"last":100.8,`+
+				`"time":1609459200.25}}`))
+		conn.ReadMessage()
+	})
+	defer ts.Close()
+	ftx := newTestFTX()
+	ftx.wsURL = wsURL(ts)
+	trades := make(chan []util.Trade)
+	tickers := make(chan *util.Ticker)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	assert.Nil(t, ftx.subTrades("ETH-PERP", trades))
+	assert.Nil(t, ftx.SubTicker(ctx, "ETH-PERP", tickers))
+	// trades are not received yet, the ticker still arrives
+	select {
+	case ticker := <-tickers:
+		assert.Equal(t, 100.5, ticker.Bid)
+	case <-time.After(time.Second):
+		t.Error("ticker is blocked by trades")
+	}
+	// and no trade is lost
+	for i := 1; i <= 3; i++ {
+		assert.Equal(t, int64(i), (<-trades)[0].ID)
+	}
+}
@@ -0,0 +1,384 @@
+/*
+// Package ftxtest is a fake FTX websocket server for tests. It answers
+// login, subscribe, unsubscribe and ping like FTX and streams the market data
+// and account events scripted by the test.
+*/
+package ftxtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	util "crypto-flash/internal/service/util"
+
+	"github.com/gorilla/websocket"
+)
+
+// Request is a request received by the server.
+type Request struct {
+	Op      string `json:"op"`
+	Channel string `json:"channel"`
+	Market  string `json:"market"`
+	Args    struct {
+		Key        string `json:"key"`
+		Sign       string `json:"sign"`
+		Time       int64  `json:"time"`
+		SubAccount string `json:"subaccount"`
+	} `json:"args"`
+}
+
+type subscription struct {
+	channel string
+	market  string
+}
+
+type conn struct {
+	ws       *websocket.Conn
+	mutex    sync.Mutex
+	loggedIn bool
+	subs     map[subscription]bool
+}
+
+func (c *conn) write(v interface{}) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.ws.WriteJSON(v)
+}
+
+// Server is a fake FTX websocket server. Orderbooks are kept like clients
+// keep them, so updates carry valid checksums unless set otherwise.
+type Server struct {
+	server *httptest.Server
+	// RejectLogin makes login fail with an error message
+	RejectLogin bool
+	requests    chan Request
+	mutex       sync.Mutex
+	conns       map[*conn]bool
+	books       map[string]*util.Orderbook
+}
+
+// NewServer starts a server, which should be closed by Close.
+func NewServer() *Server {
+	s := &Server{
+		requests: make(chan Request, 1000),
+		conns:    make(map[*conn]bool),
+		books:    make(map[string]*util.Orderbook),
+	}
+	upgrader := websocket.Upgrader{}
+	s.server = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			ws, err := upgrader.Upgrade(w, r, nil)
+			if err != nil {
+				return
+			}
+			s.serve(ws)
+		}))
+	return s
+}
+
+// URL is the websocket URL of the server.
+func (s *Server) URL() string {
+	return "ws" + strings.TrimPrefix(s.server.URL, "http")
+}
+func (s *Server) Close() {
+	s.Drop()
+	s.server.Close()
+}
+
+// Requests returns requests in the order received, requests are dropped when
+// 1000 of them are not received.
+func (s *Server) Requests() <-chan Request {
+	return s.requests
+}
+
+// Drop closes all connections, like a network failure.
+func (s *Server) Drop() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for c := range s.conns {
+		c.ws.Close()
+		delete(s.conns, c)
+	}
+}
+
+// Connections returns the number of open connections.
+func (s *Server) Connections() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.conns)
+}
+
+// Subscribers returns the number of connections subscribing channel of
+// market, market is empty for fills and orders.
+func (s *Server) Subscribers(channel, market string) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	n := 0
+	for c := range s.conns {
+		if c.subs[subscription{channel, market}] {
+			n++
+		}
+	}
+	return n
+}
+
+// WaitSubscribers blocks until n connections subscribe channel of market, or
+// returns an error after timeout.
+func (s *Server) WaitSubscribers(channel, market string, n int,
+	timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for s.Subscribers(channel, market) < n {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%d subscribers of %s %s, want %d",
+				s.Subscribers(channel, market), channel, market, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return nil
+}
+func (s *Server) serve(ws *websocket.Conn) {
+	c := &conn{ws: ws, subs: make(map[subscription]bool)}
+	s.mutex.Lock()
+	s.conns[c] = true
+	s.mutex.Unlock()
+	defer func() {
+		s.mutex.Lock()
+		delete(s.conns, c)
+		s.mutex.Unlock()
+		ws.Close()
+	}()
+	for {
+		var req Request
+		if err := ws.ReadJSON(&req); err != nil {
+			return
+		}
+		select {
+		case s.requests <- req:
+		default:
+		}
+		s.handle(c, &req)
+	}
+}
+func (s *Server) handle(c *conn, req *Request) {
+	switch req.Op {
+	case "ping":
+		c.write(map[string]string{"type": "pong"})
+	case "login":
+		if s.RejectLogin {
+			c.write(errorMessage(400, "Invalid login credentials"))
+			return
+		}
+		s.mutex.Lock()
+		c.loggedIn = true
+		s.mutex.Unlock()
+	case "subscribe":
+		private := req.Channel == "fills" || req.Channel == "orders"
+		s.mutex.Lock()
+		loggedIn := c.loggedIn
+		s.mutex.Unlock()
+		if private && !loggedIn {
+			c.write(errorMessage(400, "Not logged in"))
+			return
+		}
+		// partials are sent after subscribed like FTX
+		s.mutex.Lock()
+		c.subs[subscription{req.Channel, req.Market}] = true
+		c.write(reply("subscribed", req))
+		if book, exist := s.books[req.Market]; exist && req.Channel == "orderbook" {
+			c.write(orderbookMessage(req.Market, "partial", book, book.Checksum()))
+		}
+		s.mutex.Unlock()
+	case "unsubscribe":
+		s.mutex.Lock()
+		delete(c.subs, subscription{req.Channel, req.Market})
+		s.mutex.Unlock()
+		c.write(reply("unsubscribed", req))
+	default:
+		c.write(errorMessage(400, "Invalid op"))
+	}
+}
+
+// broadcast sends v to connections subscribing channel of market, mutex must
+// be held.
+func (s *Server) broadcast(channel, market string, v interface{}) {
+	for c := range s.conns {
+		if c.subs[subscription{channel, market}] {
+			c.write(v)
+		}
+	}
+}
+func reply(typ string, req *Request) map[string]string {
+	msg := map[string]string{"type": typ, "channel": req.Channel}
+	if req.Market != "" {
+		msg["market"] = req.Market
+	}
+	return msg
+}
+func errorMessage(code int, msg string) map[string]interface{} {
+	return map[string]interface{}{"type": "error", "code": code, "msg": msg}
+}
+func orderbookMessage(market, action string, book *util.Orderbook,
+	checksum uint32) map[string]interface{} {
+	rows := func(rows []util.Row) [][]float64 {
+		levels := [][]float64{}
+		for _, row := range rows {
+			levels = append(levels, []float64{util.F64(row.Price), util.F64(row.Size)})
+		}
+		return levels
+	}
+	return map[string]interface{}{
+		"channel": "orderbook",
+		"market":  market,
+		"type":    action,
+		"data": map[string]interface{}{
+			"time":     now(),
+			"checksum": checksum,
+			"bids":     rows(book.Bids),
+			"asks":     rows(book.Asks),
+			"action":   action,
+		},
+	}
+}
+func now() float64 {
+	return float64(time.Now().UnixNano()) / 1e9
+}
+
+// Partial replaces the orderbook of market and sends it to subscribers.
+func (s *Server) Partial(market string, bids, asks [][]float64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	book := &util.Orderbook{
+		Bids: *util.MergeOrderbook([]util.Row{}, bids, "bids"),
+		Asks: *util.MergeOrderbook([]util.Row{}, asks, "asks"),
+	}
+	s.books[market] = book
+	s.broadcast("orderbook", market,
+		orderbookMessage(market, "partial", book, book.Checksum()))
+}
+
+// Update merges changed levels into the orderbook of market and sends them to
+// subscribers, levels of size 0 are removed.
+func (s *Server) Update(market string, bids, asks [][]float64) {
+	s.update(market, bids, asks, nil)
+}
+
+// UpdateWithChecksum is Update with a given checksum, e.g. a wrong one to
+// corrupt clients.
+func (s *Server) UpdateWithChecksum(market string, bids, asks [][]float64,
+	checksum uint32) {
+	s.update(market, bids, asks, &checksum)
+}
+func (s *Server) update(market string, bids, asks [][]float64,
+	checksum *uint32) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	book, exist := s.books[market]
+	if !exist {
+		book = &util.Orderbook{}
+		s.books[market] = book
+	}
+	book.Bids = *util.MergeOrderbook(book.Bids, bids, "bids")
+	book.Asks = *util.MergeOrderbook(book.Asks, asks, "asks")
+	sum := book.Checksum()
+	if checksum != nil {
+		sum = *checksum
+	}
+	levels := &util.Orderbook{}
+	for _, bid := range bids {
+		levels.Add("bid", util.D(bid[0]), util.D(bid[1]))
+	}
+	for _, ask := range asks {
+		levels.Add("ask", util.D(ask[0]), util.D(ask[1]))
+	}
+	s.broadcast("orderbook", market,
+		orderbookMessage(market, "update", levels, sum))
+}
+
+// Trades sends trades of market to subscribers, trades without time are
+// timed now.
+func (s *Server) Trades(market string, trades ...util.Trade) {
+	for i := range trades {
+		if trades[i].Time == "" {
+			trades[i].Time = time.Now().UTC().Format(time.RFC3339Nano)
+		}
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.broadcast("trades", market, map[string]interface{}{
+		"channel": "trades",
+		"market":  market,
+		"type":    "update",
+		"data":    trades,
+	})
+}
+
+// Ticker sends the best bid and ask of market to subscribers.
+func (s *Server) Ticker(market string, bid, ask, last float64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.broadcast("ticker", market, map[string]interface{}{
+		"channel": "ticker",
+		"market":  market,
+		"type":    "update",
+		"data": map[string]float64{
+			"bid":     bid,
+			"ask":     ask,
+			"bidSize": 1,
+			"askSize": 1,
+			"last":    last,
+			"time":    now(),
+		},
+	})
+}
+
+// Fill sends fill to connections subscribing fills.
+func (s *Server) Fill(fill util.Fill) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.broadcast("fills", "", map[string]interface{}{
+		"channel": "fills",
+		"type":    "update",
+		"data":    fill,
+	})
+}
+
+// Order sends an order update to connections subscribing orders.
+func (s *Server) Order(order util.OrderStatus) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.broadcast("orders", "", map[string]interface{}{
+		"channel": "orders",
+		"type":    "update",
+		"data":    order,
+	})
+}
+
+// Error sends an error message to all connections.
+func (s *Server) Error(code int, msg string) {
+	s.Send(errorMessage(code, msg))
+}
+
+// Restart sends the info message FTX sends before restarting, which asks
+// clients to reconnect.
+func (s *Server) Restart() {
+	s.Send(map[string]interface{}{
+		"type": "info", "code": 20001, "msg": "Server restarting",
+	})
+}
+
+// Send sends v, or raw JSON if v is a string, to all connections.
+func (s *Server) Send(v interface{}) {
+	if raw, ok := v.(string); ok {
+		v = json.RawMessage(raw)
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for c := range s.conns {
+		c.write(v)
+	}
+}
@@ -0,0 +1,143 @@
+package exchange
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"crypto-flash/internal/service/exchange/ftxtest"
+	util "crypto-flash/internal/service/util"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWSClientFakeServer(t *testing.T) {
+	server := ftxtest.NewServer()
+	defer server.Close()
+	server.Partial("BTC-PERP", [][]float64{{99, 1}, {98, 2}},
+		[][]float64{{101, 1}})
+	ch := make(chan Response, 8)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client := NewWSClient(server.URL(), ch)
+	client.minBackoff = time.Millisecond
+	client.maxBackoff = 5 * time.Millisecond
+	store := NewOrderbookStore()
+	client.StoreOrderbooks(store)
+	assert.Nil(t, client.Subscribe("orderbook", []string{"BTC-PERP"}))
+	assert.Nil(t, client.Connect(ctx))
+	res := <-ch
+	assert.Equal(t, "partial", res.Orderbook.Action)
+	assert.Equal(t, rows(99, 1, 98, 2),
+		res.Snapshot.Bids)
+
+	server.Update("BTC-PERP", [][]float64{{99, 0}}, [][]float64{{100, 3}})
+	res = <-ch
+	assert.Equal(t, ORDERBOOK, res.Type)
+	assert.Equal(t, rows(98, 2), res.Snapshot.Bids)
+	assert.Equal(t, rows(100, 3, 101, 1),
+		res.Snapshot.Asks)
+
+	// a corrupted update is dropped and the book is resubscribed
+	server.UpdateWithChecksum("BTC-PERP", [][]float64{{97, 1}}, nil, 1)
+	res = <-ch
+	assert.Equal(t, ERROR, res.Type)
+	assert.Contains(t, res.Results.Error(), "checksum")
+	res = <-ch
+	assert.Equal(t, "partial", res.Orderbook.Action)
+	assert.Equal(t, rows(98, 2, 97, 1),
+		res.Snapshot.Bids)
+	assert.Equal(t, []string{"subscribe", "unsubscribe", "subscribe"},
+		ops(server.Requests(), 3))
+
+	server.Drop()
+	assert.Equal(t, ERROR, (<-ch).Type)
+	assert.Equal(t, RECONNECT, (<-ch).Type)
+	res = <-ch
+	assert.Equal(t, "partial", res.Orderbook.Action)
+	assert.Equal(t, res.Snapshot, store.Get("BTC-PERP"))
+	assert.Equal(t, 1, server.Connections())
+}
+
+func TestFTXStreamFakeServer(t *testing.T) {
+	server := ftxtest.NewServer()
+	defer server.Close()
+	ftx := NewFTX("key", "secret", "sub", WithWSURL(server.URL()))
+	ctx, cancel := context.WithCancel(context.Background())
+	events, err := ftx.Stream(ctx, Subscription{Channel: "fills"},
+		Subscription{Channel: "orders"},
+		Subscription{Channel: "trades", Market: "ETH-PERP"},
+		Subscription{Channel: "ticker", Market: "ETH-PERP"})
+	assert.Nil(t, err)
+	login := <-server.Requests()
+	assert.Equal(t, "login", login.Op)
+	assert.Equal(t, "key", login.Args.Key)
+	assert.Equal(t, "sub", login.Args.SubAccount)
+	assert.Nil(t, server.WaitSubscribers("ticker", "ETH-PERP", 1, time.Second))
+
+	server.Fill(util.Fill{ID: 1, Market: "BTC-PERP", Price: 100, Size: 1})
+	fill := (<-events).(*FillEvent)
+	assert.Equal(t, 100.0, fill.Fill.Price)
+	server.Order(util.OrderStatus{ID: 2, Market: "BTC-PERP", Status: "closed"})
+	order := (<-events).(*OrderEvent)
+	assert.Equal(t, int64(2), order.Order.ID)
+	server.Trades("ETH-PERP", util.Trade{ID: 3, Price: 10, Size: 2, Side: "buy"})
+	trade := (<-events).(*TradeEvent)
+	assert.Equal(t, 10.0, trade.Trades[0].Price)
+	server.Ticker("ETH-PERP", 9, 11, 10)
+	ticker := (<-events).(*TickerEvent)
+	assert.Equal(t, 10.0, ticker.Ticker.GetMid())
+	server.Error(400, "Invalid market")
+	e := (<-events).(*ErrorEvent)
+	assert.Contains(t, e.Err.Error(), "Invalid market")
+
+	cancel()
+	for range events {
+	}
+}
+
+func TestFTXStreamFakeServerRejectLogin(t *testing.T) {
+	server := ftxtest.NewServer()
+	server.RejectLogin = true
+	defer server.Close()
+	ftx := NewFTX("key", "wrong", "", WithWSURL(server.URL()))
+	ctx, cancel := context.WithCancel(context.Background())
+	events, err := ftx.Stream(ctx, Subscription{Channel: "fills"})
+	assert.Nil(t, err)
+	e := (<-events).(*ErrorEvent)
+	assert.Contains(t, e.Err.Error(), "Invalid login")
+	assert.Equal(t, 0, server.Subscribers("fills", ""))
+	cancel()
+	for range events {
+	}
+}
+
+func TestFTXSubscribeOrderbookFakeServer(t *testing.T) {
+	server := ftxtest.NewServer()
+	defer server.Close()
+	server.Partial("BTC-PERP", [][]float64{{99, 1}}, [][]float64{{101, 1}})
+	server.Partial("BTC-0625", [][]float64{{102, 1}}, [][]float64{{103, 1}})
+	ftx := NewFTX("", "", "", WithWSURL(server.URL()))
+	store := NewOrderbookStore()
+	assert.NotNil(t, store.Subscribe("BTC-0625"))
+	assert.Nil(t, ftx.SubscribeOrderbook(store, []string{"BTC-PERP"}))
+	assert.Nil(t, server.WaitSubscribers("orderbook", "BTC-PERP", 1, time.Second))
+
+	// markets listed later are added to the feed
+	assert.Nil(t, store.Subscribe("BTC-PERP", "BTC-0625"))
+	assert.Nil(t, server.WaitSubscribers("orderbook", "BTC-0625", 1, time.Second))
+	assert.Equal(t, 1, server.Subscribers("orderbook", "BTC-PERP"))
+	for len(store.Get("BTC-0625").Bids) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, rows(102, 1), store.Get("BTC-0625").Bids)
+}
+
+// ops returns the ops of the next n requests.
+func ops(reqs <-chan ftxtest.Request, n int) []string {
+	var ops []string
+	for i := 0; i < n; i++ {
+		ops = append(ops, (<-reqs).Op)
+	}
+	return ops
+}
@@ -0,0 +1,191 @@
+package exchange
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	util "crypto-flash/internal/service/util"
+
+	"github.com/shopspring/decimal"
+)
+
+// Market is the specification of a market of an exchange.
+type Market struct {
+	Name string
+	// "spot" or "future"
+	Type     string
+	Enabled  bool
+	PostOnly bool
+	// orders are rounded to the increments, see util.Order.Round
+	PriceIncrement decimal.Decimal
+	SizeIncrement  decimal.Decimal
+	MinProvideSize decimal.Decimal
+	VolumeUsd24h   float64
+	// of spots
+	BaseCurrency  string
+	QuoteCurrency string
+	// of futures, FutureType is "perpetual", "future", "move" or "prediction"
+	// and Expiry is zero for perpetuals
+	Underlying string
+	FutureType string
+	Expiry     time.Time
+}
+
+func (m *Market) IsSpot() bool {
+	return m.Type == "spot"
+}
+func (m *Market) IsPerpetual() bool {
+	return m.FutureType == "perpetual"
+}
+
+// IsDated reports whether m is a future expiring at Expiry, MOVE contracts
+// are not.
+func (m *Market) IsDated() bool {
+	return m.FutureType == "future"
+}
+
+// IsQuarterly reports whether m is a future expiring in March, June,
+// September or December.
+func (m *Market) IsQuarterly() bool {
+	return m.IsDated() && m.Expiry.Month()%3 == 0
+}
+
+// Tradable reports whether market orders can be made on m.
+func (m *Market) Tradable() bool {
+	return m.Enabled && !m.PostOnly
+}
+
+// MarketCatalog caches markets of an exchange and is safe for concurrent use.
+// Markets are reloaded when they are older than the period, or when an
+// unknown market is asked for, e.g. a new listing.
+type MarketCatalog struct {
+	tag    string
+	load   func() ([]*Market, error)
+	period time.Duration
+	// unknown markets do not reload more often than this
+	minReload time.Duration
+	mutex     sync.Mutex
+	markets   map[string]*Market
+	loadedAt  time.Time
+}
+
+func NewMarketCatalog(load func() ([]*Market, error),
+	period time.Duration) *MarketCatalog {
+	return &MarketCatalog{
+		tag:       "MarketCatalog",
+		load:      load,
+		period:    period,
+		minReload: 10 * time.Second,
+	}
+}
+
+// Refresh reloads markets now.
+func (mc *MarketCatalog) Refresh() error {
+	mc.mutex.Lock()
+	defer mc.mutex.Unlock()
+	return mc.refresh()
+}
+func (mc *MarketCatalog) refresh() error {
+	markets, err := mc.load()
+	if err != nil {
+		return err
+	}
+	mc.markets = make(map[string]*Market)
+	for _, m := range markets {
+		mc.markets[m.Name] = m
+	}
+	mc.loadedAt = time.Now()
+	return nil
+}
+
+// fresh reloads stale markets. Stale markets are kept if they cannot be
+// reloaded, an error is returned only if markets were never loaded.
+func (mc *MarketCatalog) fresh() error {
+	if mc.markets != nil && time.Since(mc.loadedAt) < mc.period {
+		return nil
+	}
+	err := mc.refresh()
+	if err != nil && mc.markets != nil {
+		util.Warning(mc.tag, "cannot refresh markets, keep stale ones",
+			err.Error())
+		return nil
+	}
+	return err
+}
+
+// Get returns the market of name.
+func (mc *MarketCatalog) Get(name string) (*Market, error) {
+	mc.mutex.Lock()
+	defer mc.mutex.Unlock()
+	if err := mc.fresh(); err != nil {
+		return nil, err
+	}
+	m, exist := mc.markets[name]
+	if !exist && time.Since(mc.loadedAt) >= mc.minReload {
+		if err := mc.refresh(); err != nil {
+			return nil, err
+		}
+		m, exist = mc.markets[name]
+	}
+	if !exist {
+		return nil, fmt.Errorf("unknown market %s", name)
+	}
+	return m, nil
+}
+
+// QuarterlyExpiries returns expiries of quarterly futures after now, the
+// current quarter first.
+func (mc *MarketCatalog) QuarterlyExpiries(now time.Time) ([]time.Time, error) {
+	markets, err := mc.Markets()
+	if err != nil {
+		return nil, err
+	}
+	var expiries []time.Time
+	seen := make(map[int64]bool)
+	for _, m := range markets {
+		if !m.IsQuarterly() || !m.Expiry.After(now) || seen[m.Expiry.Unix()] {
+			continue
+		}
+		seen[m.Expiry.Unix()] = true
+		expiries = append(expiries, m.Expiry)
+	}
+	sort.Slice(expiries, func(i, j int) bool {
+		return expiries[i].Before(expiries[j])
+	})
+	return expiries, nil
+}
+
+// Quarterly returns the quarterly future of underlying expiring at expiry.
+func (mc *MarketCatalog) Quarterly(underlying string,
+	expiry time.Time) (*Market, error) {
+	markets, err := mc.Markets()
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range markets {
+		if m.IsQuarterly() && m.Underlying == underlying && m.Expiry.Equal(expiry) {
+			return m, nil
+		}
+	}
+	return nil, fmt.Errorf("no %s quarterly future expiring at %s", underlying,
+		expiry.Format(time.RFC3339))
+}
+
+// Markets returns all markets sorted by name.
+func (mc *MarketCatalog) Markets() ([]*Market, error) {
+	mc.mutex.Lock()
+	defer mc.mutex.Unlock()
+	if err := mc.fresh(); err != nil {
+		return nil, err
+	}
+	markets := make([]*Market, 0, len(mc.markets))
+	for _, m := range mc.markets {
+		markets = append(markets, m)
+	}
+	sort.Slice(markets, func(i, j int) bool {
+		return markets[i].Name < markets[j].Name
+	})
+	return markets, nil
+}
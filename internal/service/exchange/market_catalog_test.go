@@ -0,0 +1,94 @@
+package exchange
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// countingLoad returns markets of names and counts loads, it fails once fail
+// is set.
+func countingLoad(loads *int, fail *bool, names ...string) func() ([]*Market, error) {
+	return func() ([]*Market, error) {
+		*loads++
+		if *fail {
+			return nil, errors.New("down")
+		}
+		var markets []*Market
+		for _, name := range names {
+			markets = append(markets, &Market{Name: name, Enabled: true})
+		}
+		return markets, nil
+	}
+}
+
+func TestMarketCatalog(t *testing.T) {
+	loads, fail := 0, false
+	mc := NewMarketCatalog(countingLoad(&loads, &fail, "ETH-PERP", "BTC-PERP"),
+		time.Hour)
+	markets, err := mc.Markets()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(markets))
+	assert.Equal(t, "BTC-PERP", markets[0].Name)
+	m, err := mc.Get("ETH-PERP")
+	assert.Nil(t, err)
+	assert.True(t, m.Enabled)
+	assert.Equal(t, 1, loads)
+	// unknown markets reload at most once in minReload
+	_, err = mc.Get("SOL-PERP")
+	assert.NotNil(t, err)
+	assert.Equal(t, 1, loads)
+	mc.minReload = 0
+	_, err = mc.Get("SOL-PERP")
+	assert.NotNil(t, err)
+	assert.Equal(t, 2, loads)
+}
+
+func TestMarketCatalogStale(t *testing.T) {
+	loads, fail := 0, true
+	mc := NewMarketCatalog(countingLoad(&loads, &fail, "BTC-PERP"), 0)
+	_, err := mc.Get("BTC-PERP")
+	assert.NotNil(t, err)
+	fail = false
+	assert.Nil(t, mc.Refresh())
+	// stale markets are kept if they cannot be reloaded
+	fail = true
+	m, err := mc.Get("BTC-PERP")
+	assert.Nil(t, err)
+	assert.Equal(t, "BTC-PERP", m.Name)
+	assert.Equal(t, 3, loads)
+}
+
+func TestMarketCatalogQuarterly(t *testing.T) {
+	march := time.Date(2021, 3, 26, 3, 0, 0, 0, time.UTC)
+	june := time.Date(2021, 6, 25, 3, 0, 0, 0, time.UTC)
+	future := func(name, underlying, futureType string, expiry time.Time) *Market {
+		return &Market{Name: name, Type: "future", Underlying: underlying,
+			FutureType: futureType, Expiry: expiry}
+	}
+	mc := NewMarketCatalog(func() ([]*Market, error) {
+		return []*Market{
+			future("BTC-PERP", "BTC", "perpetual", time.Time{}),
+			future("BTC-0625", "BTC", "future", june),
+			future("BTC-0326", "BTC", "future", march),
+			future("ETH-0326", "ETH", "future", march),
+			future("BTC-MOVE-0326", "BTC", "move", march),
+			// monthly
+			future("BTC-0430", "BTC", "future",
+				time.Date(2021, 4, 30, 3, 0, 0, 0, time.UTC)),
+		}, nil
+	}, time.Hour)
+	expiries, err := mc.QuarterlyExpiries(march.Add(-time.Hour))
+	assert.Nil(t, err)
+	assert.Equal(t, []time.Time{march, june}, expiries)
+	expiries, err = mc.QuarterlyExpiries(march)
+	assert.Nil(t, err)
+	assert.Equal(t, []time.Time{june}, expiries)
+	m, err := mc.Quarterly("BTC", june)
+	assert.Nil(t, err)
+	assert.Equal(t, "BTC-0625", m.Name)
+	_, err = mc.Quarterly("ETH", june)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,102 @@
+package exchange
+
+import (
+	"math"
+	"time"
+
+	util "crypto-flash/internal/service/util"
+)
+
+// OrderbookFeatures are derived from an orderbook and its updates in the
+// window of the store. Values of an empty side are 0.
+type OrderbookFeatures struct {
+	// (bid size - ask size) / (bid size + ask size) of the top levels
+	Imbalance  float64
+	Microprice float64
+	// spread rates relative to the mid price
+	Spread     float64
+	SpreadMean float64
+	SpreadStd  float64
+	// updates per second
+	UpdateRate float64
+}
+
+type spreadSample struct {
+	time   time.Time
+	spread float64
+	// false if a side is empty
+	valid bool
+}
+
+// featureTracker keeps spreads of a market in the window with their running
+// sums, so each update is sampled in O(1) amortized time.
+type featureTracker struct {
+	samples []spreadSample
+	// index of the first sample in the window
+	head  int
+	count int
+	sum   float64
+	sumSq float64
+}
+
+// update adds a sample and forgets samples out of the window.
+func (f *featureTracker) update(sample spreadSample, window time.Duration) {
+	f.add(sample)
+	f.prune(sample.time, window)
+}
+
+// prune forgets samples out of the window ending at now, so features decay
+// when a market is quiet. It reports whether any sample is forgotten.
+func (f *featureTracker) prune(now time.Time, window time.Duration) bool {
+	head := f.head
+	for f.head < len(f.samples) &&
+		now.Sub(f.samples[f.head].time) > window {
+		f.remove(f.samples[f.head])
+		f.head++
+	}
+	pruned := f.head > head
+	// drop removed samples once they are the majority
+	if f.head > len(f.samples)/2 {
+		f.samples = append(f.samples[:0], f.samples[f.head:]...)
+		f.head = 0
+	}
+	return pruned
+}
+
+// features returns features of ob, which is the book of the last sample, from
+// samples left by the last prune.
+func (f *featureTracker) features(ob *util.Orderbook, levels int,
+	window time.Duration) OrderbookFeatures {
+	var features OrderbookFeatures
+	if spread, err := ob.GetSpreadRate(); err == nil {
+		features.Spread = spread
+		features.Microprice, _ = ob.GetMicroprice()
+	}
+	features.Imbalance, _ = ob.GetImbalance(levels)
+	if f.count > 0 {
+		mean := f.sum / float64(f.count)
+		features.SpreadMean = mean
+		features.SpreadStd = math.Sqrt(math.Max(f.sumSq/float64(f.count)-mean*mean, 0))
+	}
+	features.UpdateRate = float64(len(f.samples)-f.head) / window.Seconds()
+	return features
+}
+func (f *featureTracker) add(sample spreadSample) {
+	f.samples = append(f.samples, sample)
+	if sample.valid {
+		f.count++
+		f.sum += sample.spread
+		f.sumSq += sample.spread * sample.spread
+	}
+}
+func (f *featureTracker) remove(sample spreadSample) {
+	if sample.valid {
+		f.count--
+		f.sum -= sample.spread
+		f.sumSq -= sample.spread * sample.spread
+	}
+	if f.count == 0 {
+		// no drift from rounding errors
+		f.sum, f.sumSq = 0, 0
+	}
+}
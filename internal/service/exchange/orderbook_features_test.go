@@ -0,0 +1,95 @@
+package exchange
+
+import (
+	"testing"
+	"time"
+
+	util "crypto-flash/internal/service/util"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFeatureTracker(t *testing.T) {
+	tracker := &featureTracker{}
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	window := 10 * time.Second
+	narrow := &util.Orderbook{
+		Bids: rows(99, 1),
+		Asks: rows(101, 1),
+	}
+	wide := &util.Orderbook{
+		Bids: rows(98, 1),
+		Asks: rows(102, 3),
+	}
+	// update samples ob at start + seconds and returns its features
+	update := func(ob *util.Orderbook, seconds int) OrderbookFeatures {
+		spread, err := ob.GetSpreadRate()
+		tracker.update(spreadSample{
+			time:   start.Add(time.Duration(seconds) * time.Second),
+			spread: spread,
+			valid:  err == nil,
+		}, window)
+		return tracker.features(ob, 5, window)
+	}
+	features := update(narrow, 0)
+	assert.Equal(t, 0.02, features.Spread)
+	assert.Equal(t, 0.02, features.SpreadMean)
+	assert.Equal(t, 0.0, features.SpreadStd)
+	assert.Equal(t, 100.0, features.Microprice)
+	assert.Equal(t, 0.1, features.UpdateRate)
+
+	features = update(wide, 5)
+	assert.Equal(t, -0.5, features.Imbalance)
+	assert.InDelta(t, 0.03, features.SpreadMean, 1e-12)
+	assert.InDelta(t, 0.01, features.SpreadStd, 1e-9)
+	assert.Equal(t, 0.2, features.UpdateRate)
+	// empty books count as updates without spreads
+	features = update(&util.Orderbook{}, 6)
+	assert.Equal(t, 0.0, features.Spread)
+	assert.InDelta(t, 0.03, features.SpreadMean, 1e-12)
+	assert.InDelta(t, 0.3, features.UpdateRate, 1e-12)
+
+	// the first two samples leave the window
+	features = update(narrow, 16)
+	assert.InDelta(t, 0.02, features.SpreadMean, 1e-12)
+	assert.Equal(t, 0.2, features.UpdateRate)
+
+	// without updates, features decay as time goes on
+	assert.False(t, tracker.prune(start.Add(16*time.Second), window))
+	assert.True(t, tracker.prune(start.Add(30*time.Second), window))
+	features = tracker.features(narrow, 5, window)
+	assert.Equal(t, 0.02, features.Spread)
+	assert.Equal(t, 0.0, features.SpreadMean)
+	assert.Equal(t, 0.0, features.UpdateRate)
+}
+
+func TestOrderbookStoreFeatures(t *testing.T) {
+	store := NewOrderbookStore()
+	store.SetFeatures(1, time.Second)
+	store.Replace("BTC-PERP", [][]float64{{99, 3}, {98, 10}}, [][]float64{{101, 1}})
+	store.Merge("BTC-PERP", nil, [][]float64{{101, 3}})
+	snapshot := store.Get("BTC-PERP")
+	assert.Equal(t, 0.0, snapshot.Features.Imbalance)
+	assert.Equal(t, 100.0, snapshot.Features.Microprice)
+	assert.Equal(t, 0.02, snapshot.Features.SpreadMean)
+	assert.Equal(t, 2.0, snapshot.Features.UpdateRate)
+}
+
+func TestOrderbookStoreFeaturesDecay(t *testing.T) {
+	store := NewOrderbookStore()
+	store.SetFeatures(1, 50*time.Millisecond)
+	store.Replace("BTC-PERP", [][]float64{{99, 3}}, [][]float64{{101, 1}})
+	snapshot := store.Get("BTC-PERP")
+	assert.Equal(t, 20.0, snapshot.Features.UpdateRate)
+	// the market is quiet for longer than the window
+	time.Sleep(100 * time.Millisecond)
+	decayed := store.Get("BTC-PERP")
+	assert.Equal(t, snapshot.Seq, decayed.Seq)
+	assert.Equal(t, snapshot.Orderbook, decayed.Orderbook)
+	assert.Equal(t, 0.0, decayed.Features.UpdateRate)
+	assert.Equal(t, 0.0, decayed.Features.SpreadMean)
+	assert.Equal(t, 0.02, decayed.Features.Spread)
+	// the snapshot read before is not changed
+	assert.Equal(t, 20.0, snapshot.Features.UpdateRate)
+	assert.Same(t, decayed, store.Get("BTC-PERP"))
+}
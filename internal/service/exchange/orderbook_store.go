@@ -0,0 +1,262 @@
+package exchange
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	util "crypto-flash/internal/service/util"
+)
+
+// OrderbookSnapshot is an orderbook at some point. It is never modified after
+// being stored, so it can be read without locking.
+type OrderbookSnapshot struct {
+	util.Orderbook
+	Market    string
+	UpdatedAt time.Time
+	// Seq increases by one on each change of the market
+	Seq      uint64
+	Features OrderbookFeatures
+}
+
+// OrderbookStore keeps the latest orderbooks of markets and is safe for
+// concurrent use. A store is fed by a websocket client, see
+// FTX.SubscribeOrderbook, and can be shared by several bots. Books are updated
+// in place, snapshots are only built when they are read.
+type OrderbookStore struct {
+	mutex  sync.RWMutex
+	books  map[string]*storedBook
+	depths map[string]int
+	// settings of features
+	featureLevels int
+	featureWindow time.Duration
+	// state of the feed, orderbooks are stale unless WSConnected
+	state int32
+	// subscribes markets on the feed, set by FTX.SubscribeOrderbook
+	subscribeMutex sync.Mutex
+	subscribe      func(markets []string) error
+}
+
+// storedBook is the book of a market, locked on its own so markets are
+// updated in parallel.
+type storedBook struct {
+	mutex     sync.Mutex
+	book      *util.Book
+	seq       uint64
+	updatedAt time.Time
+	tracker   featureTracker
+	// built from book by the first Get after a change or a prune of features
+	snapshot *OrderbookSnapshot
+}
+
+func NewOrderbookStore() *OrderbookStore {
+	return &OrderbookStore{
+		books:  make(map[string]*storedBook),
+		depths: make(map[string]int),
+		// about the depth of a market order of FRArb
+		featureLevels: 5,
+		featureWindow: time.Minute,
+	}
+}
+
+// SetFeatures computes the imbalance of snapshots on the top levels, and
+// spread statistics and update rates in the last window.
+func (s *OrderbookStore) SetFeatures(levels int, window time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.featureLevels = levels
+	s.featureWindow = window
+}
+
+// SetDepth keeps at most depth levels of market, util.OrderbookDepth by
+// default. It applies from the next Replace or Clear. Checksums of FTX cover
+// util.OrderbookDepth levels, so fewer levels are not verified.
+func (s *OrderbookStore) SetDepth(market string, depth int) {
+	if depth > 0 && depth < util.OrderbookDepth {
+		util.Warning("OrderbookStore", "checksums of "+market+
+			" are not verified with depth "+strconv.Itoa(depth))
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.depths[market] = depth
+}
+
+// Depth returns the depth of market set by SetDepth.
+func (s *OrderbookStore) Depth(market string) int {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.depth(market)
+}
+func (s *OrderbookStore) depth(market string) int {
+	if depth := s.depths[market]; depth > 0 {
+		return depth
+	}
+	return util.OrderbookDepth
+}
+
+// emptyBook empties book for reuse, or makes one of depth.
+func emptyBook(book *util.Book, depth int) *util.Book {
+	if book == nil || book.Depth() != depth {
+		return util.NewBook(depth)
+	}
+	book.Reset()
+	return book
+}
+
+// Get returns the latest snapshot of market, or nil if it has never been set.
+func (s *OrderbookStore) Get(market string) *OrderbookSnapshot {
+	s.mutex.RLock()
+	b, exist := s.books[market]
+	levels, window := s.featureLevels, s.featureWindow
+	s.mutex.RUnlock()
+	if !exist {
+		return nil
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.book == nil {
+		return nil
+	}
+	pruned := b.tracker.prune(time.Now(), window)
+	if b.snapshot == nil || b.snapshot.Seq != b.seq || pruned {
+		snapshot := &OrderbookSnapshot{
+			Market:    market,
+			UpdatedAt: b.updatedAt,
+			Seq:       b.seq,
+		}
+		if b.snapshot != nil && b.snapshot.Seq == b.seq {
+			// rows of snapshots are not changed, so they are shared
+			snapshot.Orderbook = b.snapshot.Orderbook
+		} else {
+			snapshot.Orderbook = *b.book.Orderbook()
+		}
+		snapshot.Features = b.tracker.features(&snapshot.Orderbook, levels,
+			window)
+		b.snapshot = snapshot
+	}
+	return b.snapshot
+}
+
+// Checksum returns the checksum of the orderbook of market, see
+// util.Orderbook.Checksum, without building a snapshot.
+func (s *OrderbookStore) Checksum(market string) uint32 {
+	s.mutex.RLock()
+	b, exist := s.books[market]
+	s.mutex.RUnlock()
+	if !exist {
+		return 0
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.book == nil {
+		return 0
+	}
+	return b.book.Checksum()
+}
+
+// Subscribe adds markets to the feed of the store, such as quarters listed
+// after the feed started. Markets already in the store are skipped.
+func (s *OrderbookStore) Subscribe(markets ...string) error {
+	s.subscribeMutex.Lock()
+	defer s.subscribeMutex.Unlock()
+	if s.subscribe == nil {
+		return errors.New("orderbooks are not subscribed")
+	}
+	var missing []string
+	s.mutex.RLock()
+	for _, market := range markets {
+		if _, exist := s.books[market]; !exist {
+			missing = append(missing, market)
+		}
+	}
+	s.mutex.RUnlock()
+	if len(missing) == 0 {
+		return nil
+	}
+	for _, market := range missing {
+		s.Clear(market)
+	}
+	return s.subscribe(missing)
+}
+func (s *OrderbookStore) setSubscribe(subscribe func(markets []string) error) {
+	s.subscribeMutex.Lock()
+	defer s.subscribeMutex.Unlock()
+	s.subscribe = subscribe
+}
+
+// Markets returns markets with snapshots.
+func (s *OrderbookStore) Markets() []string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	markets := make([]string, 0, len(s.books))
+	for market := range s.books {
+		markets = append(markets, market)
+	}
+	return markets
+}
+
+// Replace sets the orderbook of market to bids and asks, such as a partial.
+func (s *OrderbookStore) Replace(market string, bids, asks [][]float64) {
+	s.set(market, func(book *util.Book, depth int) *util.Book {
+		book = emptyBook(book, depth)
+		book.Update(bids, asks)
+		return book
+	})
+}
+
+// Merge applies changed levels to the orderbook of market, levels of size 0
+// are removed.
+func (s *OrderbookStore) Merge(market string, bids, asks [][]float64) {
+	s.set(market, func(book *util.Book, depth int) *util.Book {
+		if book == nil {
+			book = util.NewBook(depth)
+		}
+		book.Update(bids, asks)
+		return book
+	})
+}
+
+// Clear empties the orderbook of market until it is replaced again.
+func (s *OrderbookStore) Clear(market string) {
+	s.set(market, emptyBook)
+}
+
+// set updates the book of market by update, which returns the book to keep.
+// Only the spread is sampled for features, the rest is computed by Get.
+func (s *OrderbookStore) set(market string,
+	update func(book *util.Book, depth int) *util.Book) {
+	s.mutex.RLock()
+	b, exist := s.books[market]
+	depth, window := s.depth(market), s.featureWindow
+	s.mutex.RUnlock()
+	if !exist {
+		s.mutex.Lock()
+		if b, exist = s.books[market]; !exist {
+			b = &storedBook{}
+			s.books[market] = b
+		}
+		s.mutex.Unlock()
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.book != nil {
+		b.seq++
+	}
+	b.book = update(b.book, depth)
+	b.updatedAt = time.Now()
+	sample := spreadSample{time: b.updatedAt}
+	if bid, ask, ok := b.book.Best(); ok {
+		sample.spread, sample.valid = (ask-bid)/((ask+bid)/2), true
+	}
+	b.tracker.update(sample, window)
+}
+
+// State tells whether orderbooks are live.
+func (s *OrderbookStore) State() WSState {
+	return WSState(atomic.LoadInt32(&s.state))
+}
+func (s *OrderbookStore) setState(state WSState) {
+	atomic.StoreInt32(&s.state, int32(state))
+}
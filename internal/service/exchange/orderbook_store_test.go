@@ -0,0 +1,134 @@
+package exchange
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+
+	util "crypto-flash/internal/service/util"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// rows makes orderbook rows of price and size pairs.
+func rows(levels ...float64) []util.Row {
+	var result []util.Row
+	for i := 0; i+1 < len(levels); i += 2 {
+		result = append(result, util.Row{Price: util.D(levels[i]),
+			Size: util.D(levels[i+1])})
+	}
+	return result
+}
+
+func TestOrderbookStore(t *testing.T) {
+	store := NewOrderbookStore()
+	assert.Nil(t, store.Get("BTC-PERP"))
+	assert.Equal(t, WSDisconnected, store.State())
+
+	store.Replace("BTC-PERP", [][]float64{{99, 1}, {100, 2}},
+		[][]float64{{101, 1}})
+	partial := store.Get("BTC-PERP")
+	assert.Equal(t, uint64(0), partial.Seq)
+	assert.Equal(t, rows(100, 2, 99, 1),
+		partial.Bids)
+	store.Merge("BTC-PERP", [][]float64{{100, 0}},
+		[][]float64{{100.5, 3}})
+	update := store.Get("BTC-PERP")
+	assert.Equal(t, uint64(1), update.Seq)
+	assert.False(t, update.UpdatedAt.Before(partial.UpdatedAt))
+	assert.Equal(t, rows(99, 1), update.Bids)
+	assert.Equal(t, rows(100.5, 3, 101, 1),
+		update.Asks)
+	// snapshots are built once for each change
+	assert.Same(t, update, store.Get("BTC-PERP"))
+	// snapshots are not changed by later updates
+	assert.Equal(t, rows(100, 2, 99, 1),
+		partial.Bids)
+
+	store.Clear("BTC-PERP")
+	cleared := store.Get("BTC-PERP")
+	assert.Equal(t, uint64(2), cleared.Seq)
+	assert.Equal(t, 0, len(cleared.Bids))
+	assert.Equal(t, 0, len(cleared.Asks))
+	assert.Equal(t, []string{"BTC-PERP"}, store.Markets())
+}
+
+func TestOrderbookStoreInstances(t *testing.T) {
+	a, b := NewOrderbookStore(), NewOrderbookStore()
+	a.Replace("BTC-PERP", [][]float64{{99, 1}}, [][]float64{{101, 1}})
+	assert.Nil(t, b.Get("BTC-PERP"))
+}
+
+func TestOrderbookStoreConcurrent(t *testing.T) {
+	store := NewOrderbookStore()
+	store.Replace("BTC-PERP", [][]float64{{99, 1}}, [][]float64{{101, 1}})
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			store.Merge("BTC-PERP", [][]float64{{99, float64(i + 1)}}, nil)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		var seq uint64
+		for i := 0; i < 1000; i++ {
+			snapshot := store.Get("BTC-PERP")
+			assert.True(t, snapshot.Seq >= seq)
+			seq = snapshot.Seq
+			price, err := snapshot.GetMarketSellPrice()
+			assert.Nil(t, err)
+			assert.Equal(t, 99.0, price)
+		}
+	}()
+	wg.Wait()
+	assert.Equal(t, uint64(1000), store.Get("BTC-PERP").Seq)
+}
+
+func TestOrderbookStoreDepth(t *testing.T) {
+	store := NewOrderbookStore()
+	assert.Equal(t, util.OrderbookDepth, store.Depth("BTC-PERP"))
+	store.SetDepth("BTC-PERP", 1)
+	assert.Equal(t, 1, store.Depth("BTC-PERP"))
+	store.Replace("BTC-PERP", [][]float64{{99, 1}, {100, 2}},
+		[][]float64{{101, 1}, {102, 1}})
+	snapshot := store.Get("BTC-PERP")
+	assert.Equal(t, rows(100, 2), snapshot.Bids)
+	assert.Equal(t, rows(101, 1), snapshot.Asks)
+	store.Merge("BTC-PERP", [][]float64{{100.5, 1}}, nil)
+	snapshot = store.Get("BTC-PERP")
+	assert.Equal(t, rows(100.5, 1), snapshot.Bids)
+	// other markets are not limited
+	store.Replace("ETH-PERP", [][]float64{{99, 1}, {100, 2}}, nil)
+	snapshot = store.Get("ETH-PERP")
+	assert.Len(t, snapshot.Bids, 2)
+}
+
+// BenchmarkOrderbookStoreMerge updates full books of many markets without
+// reading them, like a store fed for a few strategies.
+func BenchmarkOrderbookStoreMerge(b *testing.B) {
+	store := NewOrderbookStore()
+	markets := make([]string, 200)
+	var partial [][]float64
+	for i := 0; i < util.OrderbookDepth; i++ {
+		partial = append(partial, []float64{float64(1000 - i), 1})
+	}
+	for i := range markets {
+		markets[i] = "MARKET" + strconv.Itoa(i) + "-PERP"
+		store.Replace(markets[i], partial, [][]float64{{1001, 1}})
+	}
+	updates := make([][][]float64, 1024)
+	for i := range updates {
+		updates[i] = [][]float64{
+			{float64(900 + i%100), float64(i % 3)},
+			{float64(950 + i%50), 2},
+		}
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		store.Merge(markets[i%len(markets)], updates[i%len(updates)], nil)
+		store.Checksum(markets[i%len(markets)])
+	}
+}
@@ -0,0 +1,135 @@
+package exchange
+
+import (
+	"context"
+	"errors"
+
+	util "crypto-flash/internal/service/util"
+)
+
+// Event is sent by Stream, use a type switch to get its data.
+type Event interface {
+	// GetMarket returns the market of the event, empty if it has none
+	GetMarket() string
+}
+
+// OrderbookEvent is the orderbook after a partial or an update whose
+// checksum is verified.
+type OrderbookEvent struct {
+	Snapshot *OrderbookSnapshot
+}
+type TradeEvent struct {
+	Market string
+	Trades []util.Trade
+}
+type TickerEvent struct {
+	Ticker *util.Ticker
+}
+type FillEvent struct {
+	Fill *util.Fill
+}
+type OrderEvent struct {
+	Order *util.OrderStatus
+}
+
+// ErrorEvent is an error from the server or a broken connection, which is
+// reconnected unless the context is done.
+type ErrorEvent struct {
+	Err error
+}
+
+// ReconnectEvent means the connection is restored and resubscribed. Events
+// may be missed while disconnected, orderbooks restart from partials.
+type ReconnectEvent struct{}
+
+func (e *OrderbookEvent) GetMarket() string { return e.Snapshot.Market }
+func (e *TradeEvent) GetMarket() string     { return e.Market }
+func (e *TickerEvent) GetMarket() string    { return e.Ticker.Market }
+func (e *FillEvent) GetMarket() string      { return e.Fill.Market }
+func (e *OrderEvent) GetMarket() string     { return e.Order.Market }
+func (e *ErrorEvent) GetMarket() string     { return "" }
+func (e *ReconnectEvent) GetMarket() string { return "" }
+
+// Subscription is a websocket channel of a market, such as orderbook, trades
+// or ticker. Market is empty for the fills and orders channels.
+type Subscription struct {
+	Channel string
+	Market  string
+	// levels kept of orderbooks, util.OrderbookDepth if 0
+	Depth int
+}
+
+// Stream connects a websocket for subs and returns its events. The websocket
+// is reconnected until ctx is done, then the channel is closed. Events must
+// be received, otherwise the connection is blocked.
+func (ftx *FTX) Stream(ctx context.Context,
+	subs ...Subscription) (<-chan Event, error) {
+	ch := make(chan Response)
+	client := ftx.newWSClient(ch)
+	store := NewOrderbookStore()
+	client.StoreOrderbooks(store)
+	channels := make(map[string][]string)
+	var order []string
+	for _, sub := range subs {
+		if sub.Channel == "orderbook" {
+			store.SetDepth(sub.Market, sub.Depth)
+		}
+		if _, exist := channels[sub.Channel]; !exist {
+			order = append(order, sub.Channel)
+		}
+		if sub.Market == "" {
+			channels[sub.Channel] = nil
+		} else {
+			channels[sub.Channel] = append(channels[sub.Channel], sub.Market)
+		}
+	}
+	for _, channel := range order {
+		if channel == "fills" || channel == "orders" {
+			if ftx.key == "" {
+				return nil, errors.New("private channels require an API key")
+			}
+			client.Login(ftx.key, ftx.secret, ftx.subAccount)
+		}
+		client.Subscribe(channel, channels[channel])
+	}
+	if err := client.Connect(ctx); err != nil {
+		return nil, err
+	}
+	events := make(chan Event)
+	go func() {
+		defer close(events)
+		for res := range ch {
+			event := toEvent(res)
+			if event == nil {
+				continue
+			}
+			select {
+			case events <- event:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return events, nil
+}
+func toEvent(res Response) Event {
+	switch res.Type {
+	case ORDERBOOK:
+		if res.Snapshot != nil {
+			return &OrderbookEvent{Snapshot: res.Snapshot}
+		}
+	case TRADES:
+		return &TradeEvent{Market: res.Symbol, Trades: res.Trades}
+	case TICKER:
+		return &TickerEvent{Ticker: res.Ticker}
+	case FILLS:
+		return &FillEvent{Fill: res.Fill}
+	case ORDERS:
+		return &OrderEvent{Order: res.Order}
+	case ERROR:
+		return &ErrorEvent{Err: res.Results}
+	case RECONNECT:
+		return &ReconnectEvent{}
+	}
+	return nil
+}
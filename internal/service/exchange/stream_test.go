@@ -0,0 +1,69 @@
+package exchange
+
+import (
+	"context"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFTXStream(t *testing.T) {
+	subs := make(chan request, 3)
+	ts := newWSServer(func(conn *websocket.Conn) {
+		for i := 0; i < 3; i++ {
+			var req request
+			conn.ReadJSON(&req)
+			subs <- req
+		}
+		for _, msg := range []string{
+			`{"channel":"orderbook","market":"BTC-PERP","type":"partial",` +
+				`"data":{"bids":[[99,1]],"asks":[[101,1]],"action":"partial",` +
+				`"checksum":4091777139}}`,
+			`{"channel":"ticker","market":"BTC-PERP","type":"update","data":` +
+				`{"bid":99,"ask":101,"bidSize":1,"askSize":1,"last":100,"time":1609459200}}`,
+			`{"channel":"trades","market":"ETH-PERP","type":"update","data":` +
+				`[{"id":1,"price":10,"size":2,"side":"buy","liquidation":false,` +
+				`"time":"2021-01-01T00:00:00+00:00"}]}`,
+			`{"type":"error","code":400,"msg":"Invalid market"}`,
+		} {
+			conn.WriteMessage(websocket.TextMessage, []byte(msg))
+		}
+		conn.ReadMessage()
+	})
+	defer ts.Close()
+	ftx := NewFTX("", "", "", WithWSURL(wsURL(ts)))
+	ctx, cancel := context.WithCancel(context.Background())
+	events, err := ftx.Stream(ctx,
+		Subscription{Channel: "orderbook", Market: "BTC-PERP"},
+		Subscription{Channel: "ticker", Market: "BTC-PERP"},
+		Subscription{Channel: "trades", Market: "ETH-PERP"})
+	assert.Nil(t, err)
+	assert.Equal(t, request{Op: "subscribe", Channel: "orderbook",
+		Market: "BTC-PERP"}, <-subs)
+	assert.Equal(t, request{Op: "subscribe", Channel: "ticker",
+		Market: "BTC-PERP"}, <-subs)
+	assert.Equal(t, request{Op: "subscribe", Channel: "trades",
+		Market: "ETH-PERP"}, <-subs)
+
+	orderbook := (<-events).(*OrderbookEvent)
+	assert.Equal(t, "BTC-PERP", orderbook.GetMarket())
+	assert.Equal(t, rows(99, 1), orderbook.Snapshot.Bids)
+	ticker := (<-events).(*TickerEvent)
+	assert.Equal(t, 101.0, ticker.Ticker.Ask)
+	trade := (<-events).(*TradeEvent)
+	assert.Equal(t, "ETH-PERP", trade.GetMarket())
+	assert.Equal(t, 10.0, trade.Trades[0].Price)
+	e := (<-events).(*ErrorEvent)
+	assert.Contains(t, e.Err.Error(), "Invalid market")
+
+	cancel()
+	for range events {
+	}
+}
+
+func TestFTXStreamPrivateWithoutKey(t *testing.T) {
+	ftx := NewFTX("", "", "", WithWSURL("ws://127.0.0.1:0"))
+	_, err := ftx.Stream(context.Background(), Subscription{Channel: "fills"})
+	assert.NotNil(t, err)
+}
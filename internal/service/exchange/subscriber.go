@@ -0,0 +1,147 @@
+package exchange
+
+import (
+	"context"
+	"sync"
+
+	util "crypto-flash/internal/service/util"
+)
+
+// subscriberBuffer is how many messages a subscriber can fall behind before
+// its oldest ones are dropped.
+const subscriberBuffer = 64
+
+// subscriber forwards messages to the channel of a subscriber through its own
+// buffer, so a slow subscriber loses its oldest messages instead of blocking
+// the connection and other subscribers. Forwarding stops when ctx is done.
+type subscriber struct {
+	tag   string
+	ctx   context.Context
+	queue chan interface{}
+	// lossless subscribers keep messages the queue cannot take in pending
+	// instead of dropping them, pending is not empty only if queue is full
+	lossless     bool
+	pendingMutex sync.Mutex
+	pending      []interface{}
+}
+
+// newSubscriber starts forwarding messages by send, which must give up when
+// done is closed. done is called after forwarding stops if it is not nil.
+func newSubscriber(ctx context.Context, tag string,
+	send func(v interface{}, done <-chan struct{}), done func()) *subscriber {
+	s := &subscriber{
+		tag:   tag,
+		ctx:   ctx,
+		queue: make(chan interface{}, subscriberBuffer),
+	}
+	s.start(send, done)
+	return s
+}
+
+// newLosslessSubscriber is newSubscriber which never drops messages, for
+// those which cannot be recovered later such as fills and orders.
+func newLosslessSubscriber(ctx context.Context, tag string,
+	send func(v interface{}, done <-chan struct{}), done func()) *subscriber {
+	s := &subscriber{
+		tag:      tag,
+		ctx:      ctx,
+		queue:    make(chan interface{}, subscriberBuffer),
+		lossless: true,
+	}
+	s.start(send, done)
+	return s
+}
+func (s *subscriber) start(send func(v interface{}, done <-chan struct{}),
+	done func()) {
+	ctx := s.ctx
+	go func() {
+		if done != nil {
+			defer done()
+		}
+		for {
+			select {
+			case v := <-s.queue:
+				if s.lossless {
+					s.refill()
+				}
+				send(v, ctx.Done())
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// refill moves pending messages to the queue in order until it is full.
+func (s *subscriber) refill() {
+	s.pendingMutex.Lock()
+	defer s.pendingMutex.Unlock()
+	for len(s.pending) > 0 {
+		select {
+		case s.queue <- s.pending[0]:
+			s.pending[0] = nil
+			s.pending = s.pending[1:]
+		default:
+			return
+		}
+	}
+	s.pending = nil
+}
+
+// push queues v without blocking, the oldest message is dropped if the queue
+// is full, unless the subscriber is lossless.
+func (s *subscriber) push(v interface{}) {
+	if s.lossless {
+		s.pendingMutex.Lock()
+		defer s.pendingMutex.Unlock()
+		if len(s.pending) == 0 {
+			select {
+			case s.queue <- v:
+				return
+			default:
+				util.Warning(s.tag, "subscriber is too slow, keep messages")
+			}
+		}
+		s.pending = append(s.pending, v)
+		return
+	}
+	for {
+		select {
+		case s.queue <- v:
+			return
+		default:
+		}
+		select {
+		case <-s.queue:
+			util.Warning(s.tag, "subscriber is too slow, drop a message")
+		default:
+		}
+	}
+}
+func (s *subscriber) cancelled() bool {
+	return s.ctx.Err() != nil
+}
+
+// newTickerSubscriber forwards copies of tickers to c and closes c when ctx
+// is done.
+func newTickerSubscriber(ctx context.Context, tag string,
+	c chan<- *util.Ticker) *subscriber {
+	return newSubscriber(ctx, tag, func(v interface{}, done <-chan struct{}) {
+		ticker := *v.(*util.Ticker)
+		select {
+		case c <- &ticker:
+		case <-done:
+		}
+	}, func() { close(c) })
+}
+
+// activeSubscribers returns subs without cancelled ones.
+func activeSubscribers(subs []*subscriber) []*subscriber {
+	var active []*subscriber
+	for _, s := range subs {
+		if !s.cancelled() {
+			active = append(active, s)
+		}
+	}
+	return active
+}
@@ -0,0 +1,61 @@
+package exchange
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSubscriber(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := make(chan int)
+	closed := make(chan struct{})
+	s := newSubscriber(ctx, "test", func(v interface{}, done <-chan struct{}) {
+		select {
+		case c <- v.(int):
+		case <-done:
+		}
+	}, func() { close(closed) })
+	// nobody receives, pushes do not block and the oldest are dropped
+	n := subscriberBuffer + 10
+	for i := 0; i < n; i++ {
+		s.push(i)
+	}
+	var got []int
+	for len(got) == 0 || got[len(got)-1] != n-1 {
+		got = append(got, <-c)
+	}
+	assert.True(t, len(got) <= subscriberBuffer+1)
+	for i := 1; i < len(got); i++ {
+		assert.True(t, got[i-1] < got[i])
+	}
+	assert.False(t, s.cancelled())
+	cancel()
+	<-closed
+	assert.True(t, s.cancelled())
+}
+
+func TestLosslessSubscriber(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := make(chan int)
+	s := newLosslessSubscriber(ctx, "test",
+		func(v interface{}, done <-chan struct{}) {
+			select {
+			case c <- v.(int):
+			case <-done:
+			}
+		}, nil)
+	// nobody receives, pushes do not block and nothing is dropped
+	n := 3*subscriberBuffer + 10
+	for i := 0; i < n; i++ {
+		s.push(i)
+	}
+	for i := 0; i < n; i++ {
+		assert.Equal(t, i, <-c)
+	}
+	// pushes after the backlog is drained keep the order
+	s.push(n)
+	assert.Equal(t, n, <-c)
+}
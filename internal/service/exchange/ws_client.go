@@ -6,236 +6,705 @@ import (
 	"context"
 	util "crypto-flash/internal/service/util"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
-	"net/url"
-	"os"
+	"math"
+	"math/rand"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/buger/jsonparser"
 	"github.com/gorilla/websocket"
 )
 
-const (
-	wsScheme = "wss"
-	wsHost   = "ftx.com"
-	wsPath   = "/ws"
-)
-
 const (
 	UNDEFINED = iota
 	ERROR
 	ORDERBOOK
+	FILLS
+	ORDERS
+	TRADES
+	TICKER
+	// the connection is restored, data may be missed while disconnected
+	RECONNECT
 )
 
-var (
-	OrderbookRes map[string]*util.Orderbook = make(map[string]*util.Orderbook)
+type WSState int32
+
+const (
+	WSDisconnected WSState = iota
+	WSConnecting
+	WSConnected
+	// the context is done and the client will not reconnect
+	WSClosed
 )
 
+func (s WSState) String() string {
+	switch s {
+	case WSDisconnected:
+		return "disconnected"
+	case WSConnecting:
+		return "connecting"
+	case WSConnected:
+		return "connected"
+	case WSClosed:
+		return "closed"
+	}
+	return "unknown"
+}
+
+// maxOrderbookSubs is the number of orderbooks on each connection of
+// SubscribeOrderbook.
+const maxOrderbookSubs = 50
+
+// errReconnect means the server asks clients to reconnect.
+var errReconnect = errors.New("server asks to reconnect")
+
 type request struct {
 	Op      string `json:"op"`
-	Channel string `json:"channel"`
-	Market  string `json:"market"`
+	Channel string `json:"channel,omitempty"`
+	Market  string `json:"market,omitempty"`
+}
+
+type loginArgs struct {
+	Key        string `json:"key"`
+	Sign       string `json:"sign"`
+	Time       int64  `json:"time"`
+	SubAccount string `json:"subaccount,omitempty"`
+}
+
+type loginRequest struct {
+	Op   string    `json:"op"`
+	Args loginArgs `json:"args"`
 }
 
 type Response struct {
 	Type      int
 	Symbol    string
 	Orderbook Orderbook
-	Results   error
+	// the stored orderbook after the message, if the client stores
+	// orderbooks by StoreOrderbooks
+	Snapshot *OrderbookSnapshot
+	Trades   []util.Trade
+	Ticker   *util.Ticker
+	// for private channels
+	Fill    *util.Fill
+	Order   *util.OrderStatus
+	Results error
 }
 
 type Orderbook struct {
-	Bids   [][]float64 `json:"bids"`
-	Asks   [][]float64 `json:"asks"`
-	Action string      `json:"action"`
-}
-
-func subscribe(conn *websocket.Conn, channel string, symbols []string) error {
-	if symbols != nil {
-		for j := range symbols {
-			if err := conn.WriteJSON(&request{
-				Op:      "subscribe",
-				Channel: channel,
-				Market:  symbols[j],
-			}); err != nil {
-				return err
+	Bids [][]float64 `json:"bids"`
+	Asks [][]float64 `json:"asks"`
+	// partial or update
+	Action   string `json:"action"`
+	Checksum uint32 `json:"checksum"`
+	// seconds
+	Time float64 `json:"time"`
+}
+
+// WSClient is a websocket connection to FTX. Messages of subscribed channels
+// are parsed and sent to ch, orderbooks are also kept in the store if any and
+// verified by checksums. A corrupted orderbook is cleared and resubscribed.
+// A broken connection is reconnected with backoff, then logged in and
+// subscribed again, and its orderbooks are cleared to be rebuilt from fresh
+// partials.
+type WSClient struct {
+	tag        string
+	url        string
+	key        string
+	secret     string
+	subAccount string
+	ch         chan<- Response
+	done       <-chan struct{}
+	state      int32
+	minBackoff time.Duration
+	maxBackoff time.Duration
+	// subscriptions to restore on reconnect
+	subsMutex sync.Mutex
+	subs      []request
+	// gorilla websocket allows only one concurrent writer
+	writeMutex sync.Mutex
+	conn       *websocket.Conn
+	store      *OrderbookStore
+	// called on each change of state
+	onState  func(state WSState)
+	recorder *WSRecorder
+	// markets waiting for a partial after resubscribing, only used by read
+	resyncing map[string]bool
+	// whether responses carry snapshots, which are built for each message
+	snapshots bool
+}
+
+// NewWSClient creates a client of url. ch can be nil if only orderbooks are
+// subscribed, otherwise it is closed after the client is closed.
+func NewWSClient(url string, ch chan<- Response) *WSClient {
+	return &WSClient{
+		tag:        "WSClient",
+		url:        url,
+		ch:         ch,
+		minBackoff: time.Second,
+		maxBackoff: 30 * time.Second,
+		resyncing:  make(map[string]bool),
+	}
+}
+
+// State tells whether data from the client is live. Data is stale unless the
+// state is WSConnected.
+func (c *WSClient) State() WSState {
+	return WSState(atomic.LoadInt32(&c.state))
+}
+func (c *WSClient) setState(state WSState) {
+	if WSState(atomic.SwapInt32(&c.state, int32(state))) != state {
+		util.Info(c.tag, c.url, state.String())
+	}
+	if c.onState != nil {
+		c.onState(state)
+	}
+}
+
+// StoreOrderbooks makes the client keep subscribed orderbooks in store, whose
+// state follows the client, and send snapshots with orderbook responses. It
+// must be called before Connect.
+func (c *WSClient) StoreOrderbooks(store *OrderbookStore) {
+	c.store = store
+	c.snapshots = true
+	c.onState = store.setState
+	store.setState(c.State())
+}
+
+// Login makes Connect log in with the API key, which is required by private
+// channels such as fills and orders.
+func (c *WSClient) Login(key, secret, subAccount string) {
+	c.key = key
+	c.secret = secret
+	c.subAccount = subAccount
+}
+
+// Connect dials the server and keeps the connection until ctx is done. Only
+// the first dial error is returned, later ones are retried.
+func (c *WSClient) Connect(ctx context.Context) error {
+	c.done = ctx.Done()
+	conn, err := c.dial()
+	if err != nil {
+		c.setState(WSDisconnected)
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		c.writeMutex.Lock()
+		c.conn.Close()
+		c.writeMutex.Unlock()
+	}()
+	go c.run(ctx, conn)
+	return nil
+}
+
+// dial connects, logs in and restores subscriptions.
+func (c *WSClient) dial() (*websocket.Conn, error) {
+	c.setState(WSConnecting)
+	conn, _, err := websocket.DefaultDialer.Dial(c.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	c.writeMutex.Lock()
+	c.conn = conn
+	c.writeMutex.Unlock()
+	if c.key != "" {
+		if err := c.login(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	// hold subsMutex so Subscribe either sends or is included here
+	c.subsMutex.Lock()
+	defer c.subsMutex.Unlock()
+	for i := range c.subs {
+		if err := c.write(&c.subs[i]); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	c.setState(WSConnected)
+	return conn, nil
+}
+
+// run reads conn and reconnects when it is broken, until ctx is done.
+func (c *WSClient) run(ctx context.Context, conn *websocket.Conn) {
+	if c.ch != nil {
+		defer close(c.ch)
+	}
+	attempt := 0
+	for {
+		start := time.Now()
+		pingCtx, cancel := context.WithCancel(ctx)
+		// ping each 15sec for exchange
+		go c.ping(pingCtx)
+		err := c.read(conn)
+		cancel()
+		conn.Close()
+		if ctx.Err() != nil {
+			c.setState(WSClosed)
+			return
+		}
+		c.setState(WSDisconnected)
+		c.send(Response{Type: ERROR, Results: err})
+		c.resetOrderbooks()
+		// a connection lasting a while is not part of a reconnect storm
+		if time.Since(start) > time.Minute {
+			attempt = 0
+		}
+		for {
+			wait := c.backoff(attempt)
+			attempt++
+			util.Warning(c.tag, fmt.Sprintf("reconnect in %s: %v", wait, err))
+			select {
+			case <-ctx.Done():
+				c.setState(WSClosed)
+				return
+			case <-time.After(wait):
+			}
+			if conn, err = c.dial(); err == nil {
+				break
 			}
 		}
-	} else {
-		if err := conn.WriteJSON(&request{
+		if ctx.Err() != nil {
+			conn.Close()
+			c.setState(WSClosed)
+			return
+		}
+		c.send(Response{Type: RECONNECT})
+	}
+}
+
+// backoff returns a random duration up to minBackoff * 2^attempt, capped by
+// maxBackoff.
+func (c *WSClient) backoff(attempt int) time.Duration {
+	d := c.minBackoff << uint(attempt)
+	if d > c.maxBackoff || d <= 0 {
+		d = c.maxBackoff
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// resetOrderbooks clears subscribed orderbooks, which are rebuilt from the
+// partials after resubscribing.
+func (c *WSClient) resetOrderbooks() {
+	if c.store == nil {
+		return
+	}
+	c.subsMutex.Lock()
+	defer c.subsMutex.Unlock()
+	for _, sub := range c.subs {
+		if sub.Channel == "orderbook" {
+			c.store.Clear(sub.Market)
+		}
+	}
+}
+func (c *WSClient) write(v interface{}) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	// replaying
+	if c.conn == nil {
+		return errors.New("no connection")
+	}
+	return c.conn.WriteJSON(v)
+}
+
+// login signs like genAuthHeader, FTX replies only if it fails.
+func (c *WSClient) login() error {
+	ts := time.Now().UnixNano() / 1000000
+	return c.write(&loginRequest{
+		Op: "login",
+		Args: loginArgs{
+			Key:        c.key,
+			Sign:       util.HMac(fmt.Sprintf("%dwebsocket_login", ts), c.secret),
+			Time:       ts,
+			SubAccount: c.subAccount,
+		},
+	})
+}
+
+// Record makes the client write each received message to recorder. It must
+// be called before Connect.
+func (c *WSClient) Record(recorder *WSRecorder) {
+	c.recorder = recorder
+}
+
+// Subscribe subscribes channel of each market, markets should be nil for
+// channels without market such as fills and orders. Subscriptions are
+// restored on reconnect.
+func (c *WSClient) Subscribe(channel string, markets []string) error {
+	var reqs []request
+	if markets == nil {
+		reqs = append(reqs, request{Op: "subscribe", Channel: channel})
+	}
+	for _, market := range markets {
+		reqs = append(reqs, request{
 			Op:      "subscribe",
 			Channel: channel,
-		}); err != nil {
+			Market:  market,
+		})
+	}
+	c.subsMutex.Lock()
+	defer c.subsMutex.Unlock()
+	c.subs = append(c.subs, reqs...)
+	if c.State() != WSConnected {
+		return nil
+	}
+	for i := range reqs {
+		// a failed write breaks the connection, which is restored later
+		if err := c.write(&reqs[i]); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func unsubscribe(conn *websocket.Conn, channel string, symbols []string) error {
-	if symbols != nil {
-		for j := range symbols {
-			if err := conn.WriteJSON(&request{
-				Op:      "unsubscribe",
-				Channel: channel,
-				Market:  symbols[j],
-			}); err != nil {
-				return err
-			}
+// Unsubscribe unsubscribes channel of each market and stops storing their
+// orderbooks.
+func (c *WSClient) Unsubscribe(channel string, markets []string) error {
+	c.subsMutex.Lock()
+	defer c.subsMutex.Unlock()
+	removed := make(map[string]bool)
+	for _, market := range markets {
+		removed[market] = true
+	}
+	subs := c.subs[:0]
+	for _, sub := range c.subs {
+		if sub.Channel != channel || !removed[sub.Market] {
+			subs = append(subs, sub)
 		}
-	} else {
-		if err := conn.WriteJSON(&request{
-			Op:      "unsubscribe",
-			Channel: channel,
-		}); err != nil {
+	}
+	c.subs = subs
+	if c.State() != WSConnected {
+		return nil
+	}
+	for _, market := range markets {
+		err := c.write(&request{Op: "unsubscribe", Channel: channel, Market: market})
+		if err != nil {
 			return err
 		}
 	}
 	return nil
 }
-
-func ping(conn *websocket.Conn) (err error) {
+func (c *WSClient) subscribed(channel, market string) bool {
+	c.subsMutex.Lock()
+	defer c.subsMutex.Unlock()
+	for _, sub := range c.subs {
+		if sub.Channel == channel && sub.Market == market {
+			return true
+		}
+	}
+	return false
+}
+func (c *WSClient) ping(ctx context.Context) {
 	ticker := time.NewTicker(15 * time.Second)
 	defer ticker.Stop()
-
 	for {
 		select {
+		case <-ctx.Done():
+			return
 		case <-ticker.C:
-			if err := conn.WriteMessage(websocket.PingMessage, []byte(`{"op": "pong"}`)); err != nil {
-				goto EXIT
+			if err := c.write(&request{Op: "ping"}); err != nil {
+				return
 			}
 		}
 	}
-EXIT:
-	return err
 }
 
-func Connect(ctx context.Context, ch chan Response, channel string, symbols []string, l *log.Logger) error {
-	if l == nil {
-		l = log.New(os.Stdout, "ftx websocket", log.Llongfile)
+// send gives up when the client is closed.
+func (c *WSClient) send(res Response) {
+	if c.ch == nil {
+		return
 	}
-
-	u := url.URL{Scheme: wsScheme, Host: wsHost, Path: wsPath}
-	log.Printf("connecting to %s", u.String())
-	conn, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
-	if err != nil {
-		return err
+	select {
+	case c.ch <- res:
+	case <-c.done:
 	}
+}
 
-	if err := subscribe(conn, channel, symbols); err != nil {
-		return err
+// read returns the error breaking conn.
+func (c *WSClient) read(conn *websocket.Conn) error {
+	for {
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			util.Error(c.tag, "read error", err.Error())
+			return err
+		}
+		if c.recorder != nil {
+			if err := c.recorder.Write(time.Now(), msg); err != nil {
+				util.Error(c.tag, "cannot record message", err.Error())
+			}
+		}
+		res, err := c.parse(msg)
+		if err == errReconnect {
+			return err
+		}
+		if err != nil {
+			// the connection is still usable
+			util.Error(c.tag, err.Error())
+			c.send(Response{Type: ERROR, Results: err})
+			continue
+		}
+		if res != nil {
+			c.send(*res)
+		}
 	}
+}
 
-	// ping each 15sec for exchange
-	go ping(conn)
-
-	go func() {
-		defer conn.Close()
-		defer unsubscribe(conn, channel, symbols)
-
-	RESTART:
-		for {
-			var res Response
-			_, msg, err := conn.ReadMessage()
-			if err != nil {
-				l.Printf("[ERROR]: msg error: %+v", err)
-				res.Type = ERROR
-				res.Results = fmt.Errorf("%v", err)
-				break RESTART
+// parse returns nil if msg has no data to send.
+func (c *WSClient) parse(msg []byte) (*Response, error) {
+	typeMsg, _ := jsonparser.GetString(msg, "type")
+	switch typeMsg {
+	case "error":
+		return nil, errors.New(string(msg))
+	case "info":
+		// 20001: server restarting
+		if code, _ := jsonparser.GetInt(msg, "code"); code == 20001 {
+			return nil, errReconnect
+		}
+		util.Info(c.tag, string(msg))
+		return nil, nil
+	case "subscribed", "unsubscribed":
+		util.Success(c.tag, string(msg))
+		return nil, nil
+	case "pong":
+		return nil, nil
+	}
+	channel, err := jsonparser.GetString(msg, "channel")
+	if err != nil {
+		return nil, fmt.Errorf("channel error: %s", string(msg))
+	}
+	data, _, _, err := jsonparser.Get(msg, "data")
+	if err != nil {
+		return nil, fmt.Errorf("data error: %v %s", err, string(msg))
+	}
+	var res Response
+	switch channel {
+	case "orderbook":
+		market, err := jsonparser.GetString(msg, "market")
+		if err != nil {
+			return nil, fmt.Errorf("market error: %s", string(msg))
+		}
+		res.Type = ORDERBOOK
+		res.Symbol = market
+		if err := json.Unmarshal(data, &res.Orderbook); err != nil {
+			util.Warning(c.tag, "cannot unmarshal orderbook", err.Error())
+			return nil, nil
+		}
+		if c.store == nil {
+			return &res, nil
+		}
+		// messages in flight after unsubscribing
+		if !c.subscribed("orderbook", market) {
+			return nil, nil
+		}
+		switch res.Orderbook.Action {
+		case "partial":
+			delete(c.resyncing, market)
+			c.store.Replace(market, res.Orderbook.Bids, res.Orderbook.Asks)
+		case "update":
+			// updates before the new partial are based on the old book
+			if c.resyncing[market] {
+				return nil, nil
 			}
-
-			typeMsg, err := jsonparser.GetString(msg, "type")
-			if typeMsg == "error" {
-				l.Printf("[ERROR]: error: %+v", string(msg))
-				res.Type = ERROR
-				res.Results = fmt.Errorf("%v", string(msg))
-				break RESTART
+			c.store.Merge(market, res.Orderbook.Bids, res.Orderbook.Asks)
+		default:
+			return nil, fmt.Errorf("orderbook action error: %s", string(msg))
+		}
+		// books with fewer levels than checksums cannot be verified
+		if c.store.Depth(market) >= util.OrderbookDepth {
+			checksum := c.store.Checksum(market)
+			if checksum != res.Orderbook.Checksum {
+				return nil, c.resync(market, checksum, res.Orderbook.Checksum)
 			}
+		}
+		if c.snapshots {
+			res.Snapshot = c.store.Get(market)
+		}
+	case "trades":
+		market, err := jsonparser.GetString(msg, "market")
+		if err != nil {
+			return nil, fmt.Errorf("market error: %s", string(msg))
+		}
+		res.Type = TRADES
+		res.Symbol = market
+		if err := json.Unmarshal(data, &res.Trades); err != nil {
+			return nil, fmt.Errorf("cannot unmarshal trades: %v", err)
+		}
+	case "ticker":
+		market, err := jsonparser.GetString(msg, "market")
+		if err != nil {
+			return nil, fmt.Errorf("market error: %s", string(msg))
+		}
+		var ticker struct {
+			Bid     float64 `json:"bid"`
+			Ask     float64 `json:"ask"`
+			BidSize float64 `json:"bidSize"`
+			AskSize float64 `json:"askSize"`
+			Last    float64 `json:"last"`
+			// seconds
+			Time float64 `json:"time"`
+		}
+		if err := json.Unmarshal(data, &ticker); err != nil {
+			return nil, fmt.Errorf("cannot unmarshal ticker: %v", err)
+		}
+		res.Type = TICKER
+		res.Symbol = market
+		res.Ticker = &util.Ticker{
+			Market:     market,
+			Bid:        ticker.Bid,
+			Ask:        ticker.Ask,
+			BidSize:    ticker.BidSize,
+			AskSize:    ticker.AskSize,
+			Last:       ticker.Last,
+			Time:       ftxTime(ticker.Time),
+			ReceivedAt: time.Now(),
+		}
+	case "fills":
+		res.Type = FILLS
+		res.Fill = &util.Fill{}
+		if err := json.Unmarshal(data, res.Fill); err != nil {
+			return nil, fmt.Errorf("cannot unmarshal fill: %v", err)
+		}
+		res.Symbol = res.Fill.Market
+	case "orders":
+		res.Type = ORDERS
+		res.Order = &util.OrderStatus{}
+		if err := json.Unmarshal(data, res.Order); err != nil {
+			return nil, fmt.Errorf("cannot unmarshal order: %v", err)
+		}
+		res.Symbol = res.Order.Market
+	default:
+		res.Type = UNDEFINED
+		res.Results = fmt.Errorf("%v", string(msg))
+	}
+	return &res, nil
+}
 
-			channel, err := jsonparser.GetString(msg, "channel")
-			if err != nil {
-				l.Printf("[ERROR]: channel error: %+v", string(msg))
-				res.Type = ERROR
-				res.Results = fmt.Errorf("%v", string(msg))
-				break RESTART
-			}
+// ftxTime converts seconds in websocket messages, which are precise to
+// microseconds.
+func ftxTime(seconds float64) time.Time {
+	sec, frac := math.Modf(seconds)
+	return time.Unix(int64(sec), int64(math.Round(frac*1e6))*1e3)
+}
 
-			market, err := jsonparser.GetString(msg, "market")
-			if err != nil {
-				l.Printf("[ERROR]: market err: %+v", string(msg))
-				res.Type = ERROR
-				res.Results = fmt.Errorf("%v", string(msg))
-				break RESTART
-			}
+// resync clears the orderbook of market and resubscribes it to get a new
+// partial. It returns the error to report.
+func (c *WSClient) resync(market string, got, want uint32) error {
+	c.store.Clear(market)
+	c.resyncing[market] = true
+	err := fmt.Errorf("orderbook checksum of %s is %d, want %d", market, got, want)
+	// a failed write breaks the connection, which resubscribes anyway
+	if c.write(&request{Op: "unsubscribe", Channel: "orderbook", Market: market}) == nil {
+		c.write(&request{Op: "subscribe", Channel: "orderbook", Market: market})
+	}
+	return err
+}
 
-			res.Symbol = market
-
-			data, _, _, err := jsonparser.Get(msg, "data")
-			if err != nil {
-				if isSubscribe, _ := jsonparser.GetString(msg, "type"); isSubscribe == "subscribed" {
-					l.Printf("[SUCCESS]: %s %+v", isSubscribe, string(msg))
-					continue
-				} else {
-					err = fmt.Errorf("[ERROR]: data err: %v %s", err, string(msg))
-					l.Println(err)
-					res.Type = ERROR
-					res.Results = err
-					break RESTART
-				}
-			}
+// SubscribeOrderbook streams orderbooks of pairs into store, over as many
+// connections as needed. More pairs can be added by store.Subscribe.
+func (ftx *FTX) SubscribeOrderbook(store *OrderbookStore, pairs []string) error {
+	for _, pair := range pairs {
+		store.Clear(pair)
+	}
+	pool := NewWSPool(ftx.wsURL, maxOrderbookSubs, store)
+	pool.recorder = ftx.wsRecorder
+	pool.Connect(context.Background())
+	store.setSubscribe(func(markets []string) error {
+		return pool.Subscribe("orderbook", markets)
+	})
+	return pool.Subscribe("orderbook", pairs)
+}
 
-			switch channel {
-			case "orderbook":
-				res.Type = ORDERBOOK
-				if err := json.Unmarshal(data, &res.Orderbook); err != nil {
-					l.Printf("[WARN]: cant unmarshal orderbook %+v", err)
-					continue
-				}
+// newWSClient creates a client recording to the recorder of ftx if any.
+func (ftx *FTX) newWSClient(ch chan<- Response) *WSClient {
+	client := NewWSClient(ftx.wsURL, ch)
+	if ftx.wsRecorder != nil {
+		client.Record(ftx.wsRecorder)
+	}
+	return client
+}
 
-				// Sort of Bids
-				OrderbookRes[res.Symbol].Bids = *util.MergeOrderbook(
-					OrderbookRes[res.Symbol].Bids,
-					res.Orderbook.Bids,
-					"bids",
-				)
-
-				// Sort of Asks
-				OrderbookRes[res.Symbol].Asks = *util.MergeOrderbook(
-					OrderbookRes[res.Symbol].Asks,
-					res.Orderbook.Asks,
-					"asks",
-				)
-
-			default:
-				res.Type = UNDEFINED
-				res.Results = fmt.Errorf("%v", string(msg))
+// subPrivate connects the private websocket on first call and dispatches
+// fills and orders to subscribers.
+func (ftx *FTX) subPrivate() error {
+	ftx.privateMutex.Lock()
+	defer ftx.privateMutex.Unlock()
+	if ftx.privateWS != nil {
+		return nil
+	}
+	if ftx.key == "" {
+		return errors.New("private channels require an API key")
+	}
+	ch := make(chan Response)
+	client := ftx.newWSClient(ch)
+	client.Login(ftx.key, ftx.secret, ftx.subAccount)
+	client.Subscribe("fills", nil)
+	client.Subscribe("orders", nil)
+	if err := client.Connect(context.Background()); err != nil {
+		return err
+	}
+	ftx.privateWS = client
+	go func() {
+		for res := range ch {
+			ftx.privateMutex.Lock()
+			fillSubs := ftx.fillSubs
+			orderSubs := ftx.orderSubs
+			ftx.privateMutex.Unlock()
+			switch res.Type {
+			case FILLS:
+				for _, s := range fillSubs {
+					s.push(res.Fill)
+				}
+			case ORDERS:
+				for _, s := range orderSubs {
+					s.push(res.Order)
+				}
+			case ERROR:
+				util.Error(ftx.tag, "private websocket error", res.Results.Error())
 			}
 		}
 	}()
-
 	return nil
 }
 
-func GetOrderbookRes() map[string]*util.Orderbook {
-	return OrderbookRes
+// SubFills sends fills of the account to c in real time. Fills are buffered
+// for a slow receiver and never dropped.
+func (ftx *FTX) SubFills(c chan<- *util.Fill) error {
+	if err := ftx.subPrivate(); err != nil {
+		return err
+	}
+	ftx.privateMutex.Lock()
+	defer ftx.privateMutex.Unlock()
+	ftx.fillSubs = append(ftx.fillSubs, newLosslessSubscriber(
+		context.Background(), ftx.tag+"-fills",
+		func(v interface{}, done <-chan struct{}) {
+			select {
+			case c <- v.(*util.Fill):
+			case <-done:
+			}
+		}, nil))
+	return nil
 }
 
-func SubscribeOrderbook(pairs []string) error {
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-
-	// initial pairs
-	for _, val := range pairs {
-		OrderbookRes[val] = &util.Orderbook{
-			Bids: []util.Row{},
-			Asks: []util.Row{},
-		}
+// SubOrders sends updates of orders of the account to c in real time, they
+// are buffered like fills.
+func (ftx *FTX) SubOrders(c chan<- *util.OrderStatus) error {
+	if err := ftx.subPrivate(); err != nil {
+		return err
 	}
-
-	channel := "orderbook"
-	ch := make(chan Response)
-	go Connect(ctx, ch, channel, pairs, nil)
-
+	ftx.privateMutex.Lock()
+	defer ftx.privateMutex.Unlock()
+	ftx.orderSubs = append(ftx.orderSubs, newLosslessSubscriber(
+		context.Background(), ftx.tag+"-orders",
+		func(v interface{}, done <-chan struct{}) {
+			select {
+			case c <- v.(*util.OrderStatus):
+			case <-done:
+			}
+		}, nil))
 	return nil
 }
@@ -0,0 +1,211 @@
+package exchange
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	util "crypto-flash/internal/service/util"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+// newWSServer runs handle on each websocket connection.
+func newWSServer(handle func(conn *websocket.Conn)) *httptest.Server {
+	upgrader := websocket.Upgrader{}
+	return httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			conn, err := upgrader.Upgrade(w, r, nil)
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			handle(conn)
+		}))
+}
+func wsURL(ts *httptest.Server) string {
+	return "ws" + strings.TrimPrefix(ts.URL, "http")
+}
+
+func TestWSClientPrivateChannels(t *testing.T) {
+	received := make(chan interface{}, 3)
+	ts := newWSServer(func(conn *websocket.Conn) {
+		var login loginRequest
+		conn.ReadJSON(&login)
+		received <- login
+		for i := 0; i < 2; i++ {
+			var req request
+			conn.ReadJSON(&req)
+			received <- req
+		}
+		conn.WriteMessage(websocket.TextMessage, []byte(
+			`{"channel":"fills","type":"update","data":{"fee":0.07,`+
+				`"feeRate":0.0007,"id":1,"liquidity":"taker","market":"BTC-PERP",`+
+				`"orderId":2,"price":100.5,"side":"buy","size":1,`+
+				`"time":"2021-01-01T00:00:00+00:00"}}`))
+		conn.WriteMessage(websocket.TextMessage, []byte(
+			`{"channel":"orders","type":"update","data":{"id":2,`+
+				`"clientId":null,"market":"BTC-PERP","type":"limit","side":"buy",`+
+				`"size":1,"price":101,"status":"closed","filledSize":1,`+
+				`"remainingSize":0,"avgFillPrice":100.5}}`))
+		// wait for the client to close
+		conn.ReadMessage()
+	})
+	defer ts.Close()
+	ftx := NewFTX("key", "secret", "sub", WithWSURL(wsURL(ts)))
+	fills := make(chan *util.Fill)
+	orders := make(chan *util.OrderStatus)
+	assert.Nil(t, ftx.SubFills(fills))
+	assert.Nil(t, ftx.SubOrders(orders))
+
+	login := (<-received).(loginRequest)
+	assert.Equal(t, "login", login.Op)
+	assert.Equal(t, "key", login.Args.Key)
+	assert.Equal(t, "sub", login.Args.SubAccount)
+	assert.Equal(t, util.HMac(fmt.Sprintf("%dwebsocket_login", login.Args.Time),
+		"secret"), login.Args.Sign)
+	assert.Equal(t, request{Op: "subscribe", Channel: "fills"}, <-received)
+	assert.Equal(t, request{Op: "subscribe", Channel: "orders"}, <-received)
+
+	fill := <-fills
+	assert.Equal(t, &util.Fill{ID: 1, OrderID: 2, Market: "BTC-PERP",
+		Side: "buy", Price: 100.5, Size: 1, Fee: 0.07, FeeRate: 0.0007,
+		Liquidity: "taker", Time: "2021-01-01T00:00:00+00:00"}, fill)
+	order := <-orders
+	assert.Equal(t, int64(2), order.ID)
+	assert.True(t, order.IsFilled())
+	assert.Equal(t, 100.5, order.AvgFillPrice)
+}
+
+func TestWSClientPrivateWithoutKey(t *testing.T) {
+	ftx := NewFTX("", "", "", WithWSURL("ws://127.0.0.1:0"))
+	assert.NotNil(t, ftx.SubFills(make(chan *util.Fill)))
+}
+
+func TestWSClientError(t *testing.T) {
+	ts := newWSServer(func(conn *websocket.Conn) {
+		conn.WriteMessage(websocket.TextMessage, []byte(
+			`{"type":"error","code":400,"msg":"Invalid login credentials"}`))
+		conn.ReadMessage()
+	})
+	defer ts.Close()
+	ch := make(chan Response)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client := NewWSClient(wsURL(ts), ch)
+	client.Login("key", "wrong", "")
+	assert.Nil(t, client.Connect(ctx))
+	res := <-ch
+	assert.Equal(t, ERROR, res.Type)
+	assert.Contains(t, res.Results.Error(), "Invalid login credentials")
+}
+
+func TestWSClientReconnect(t *testing.T) {
+	subs := make(chan request, 4)
+	var conns int32
+	ts := newWSServer(func(conn *websocket.Conn) {
+		var req request
+		conn.ReadJSON(&req)
+		subs <- req
+		if atomic.AddInt32(&conns, 1) == 1 {
+			conn.WriteMessage(websocket.TextMessage, []byte(
+				`{"channel":"orderbook","market":"TEST-PERP","type":"partial",`+
+					`"data":{"bids":[[99,1]],"asks":[[101,1]],"action":"partial",`+
+					`"checksum":4091777139}}`))
+			// break the first connection
+			return
+		}
+		conn.ReadMessage()
+	})
+	defer ts.Close()
+	ch := make(chan Response, 4)
+	ctx, cancel := context.WithCancel(context.Background())
+	client := NewWSClient(wsURL(ts), ch)
+	client.minBackoff = time.Millisecond
+	client.maxBackoff = 5 * time.Millisecond
+	store := NewOrderbookStore()
+	client.StoreOrderbooks(store)
+	assert.Nil(t, client.Subscribe("orderbook", []string{"TEST-PERP"}))
+	assert.Nil(t, client.Connect(ctx))
+	sub := request{Op: "subscribe", Channel: "orderbook", Market: "TEST-PERP"}
+	assert.Equal(t, sub, <-subs)
+	res := <-ch
+	assert.Equal(t, ORDERBOOK, res.Type)
+	// disconnected, the book is cleared until a new partial
+	res = <-ch
+	assert.Equal(t, ERROR, res.Type)
+	assert.Equal(t, sub, <-subs)
+	assert.Equal(t, 0, len(store.Get("TEST-PERP").Bids))
+	assert.Equal(t, RECONNECT, (<-ch).Type)
+	assert.Equal(t, WSConnected, store.State())
+	cancel()
+	for store.State() != WSClosed {
+		time.Sleep(time.Millisecond)
+	}
+	// ch is closed with the client
+	_, ok := <-ch
+	assert.False(t, ok)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&conns))
+}
+
+func TestWSClientOrderbookChecksum(t *testing.T) {
+	reqs := make(chan request, 4)
+	step := make(chan bool)
+	ts := newWSServer(func(conn *websocket.Conn) {
+		write := func(action, data string, checksum uint32) {
+			conn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf(
+				`{"channel":"orderbook","market":"TEST-PERP","type":"%s",`+
+					`"data":{%s,"action":"%s","checksum":%d}}`,
+				action, data, action, checksum)))
+		}
+		var req request
+		conn.ReadJSON(&req)
+		write("partial", `"bids":[[99,1]],"asks":[[101,1]]`, 4091777139)
+		write("update", `"bids":[[98,2]],"asks":[]`, 316189990)
+		<-step
+		// the book of the client becomes 99, 98.5, 98
+		write("update", `"bids":[[98.5,2]],"asks":[]`, 3661111894)
+		for i := 0; i < 2; i++ {
+			conn.ReadJSON(&req)
+			reqs <- req
+		}
+		<-step
+		// updates before the new partial are ignored
+		write("update", `"bids":[[97,1]],"asks":[]`, 0)
+		write("partial", `"bids":[[99,1],[98.5,2]],"asks":[[101,1]]`, 3661111894)
+		conn.ReadMessage()
+	})
+	defer ts.Close()
+	ch := make(chan Response)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client := NewWSClient(wsURL(ts), ch)
+	store := NewOrderbookStore()
+	client.StoreOrderbooks(store)
+	assert.Nil(t, client.Subscribe("orderbook", []string{"TEST-PERP"}))
+	assert.Nil(t, client.Connect(ctx))
+	assert.Equal(t, "partial", (<-ch).Orderbook.Action)
+	assert.Equal(t, "update", (<-ch).Orderbook.Action)
+	assert.Equal(t, rows(99, 1, 98, 2),
+		store.Get("TEST-PERP").Bids)
+	step <- true
+	res := <-ch
+	assert.Equal(t, ERROR, res.Type)
+	assert.Contains(t, res.Results.Error(), "checksum")
+	assert.Equal(t, 0, len(store.Get("TEST-PERP").Bids))
+	assert.Equal(t, request{Op: "unsubscribe", Channel: "orderbook",
+		Market: "TEST-PERP"}, <-reqs)
+	assert.Equal(t, request{Op: "subscribe", Channel: "orderbook",
+		Market: "TEST-PERP"}, <-reqs)
+	step <- true
+	res = <-ch
+	assert.Equal(t, "partial", res.Orderbook.Action)
+	assert.Equal(t, rows(99, 1, 98.5, 2),
+		store.Get("TEST-PERP").Bids)
+}
@@ -0,0 +1,281 @@
+package exchange
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	util "crypto-flash/internal/service/util"
+)
+
+// WSPool spreads subscriptions over websocket connections with at most
+// maxSubs subscriptions each. Orderbooks are kept in the store, whose state is
+// the worst state of the connections. A connection whose messages lag behind
+// the exchange time by more than maxLag on average is relieved of half of its
+// subscriptions, so the clock should be synchronized.
+type WSPool struct {
+	tag     string
+	url     string
+	maxSubs int
+	store   *OrderbookStore
+	// records messages of all connections if not nil
+	recorder *WSRecorder
+	// settings of the lag check
+	checkPeriod time.Duration
+	maxLag      time.Duration
+	ctx         context.Context
+	mutex       sync.Mutex
+	conns       []*poolConn
+	// clients of conns for updateState, which is called while mutex is held
+	clientsMutex sync.Mutex
+	clients      []*WSClient
+}
+
+// WSConnStats is the load of a connection of WSPool in the last check period.
+type WSConnStats struct {
+	State         WSState
+	Subscriptions int
+	// messages per second
+	Rate float64
+	// average delay of messages from the exchange time
+	Lag time.Duration
+}
+
+type poolConn struct {
+	client *WSClient
+	subs   []Subscription
+	// since the last check
+	messages int
+	lagCount int
+	lagSum   time.Duration
+	stats    WSConnStats
+}
+
+func NewWSPool(url string, maxSubs int, store *OrderbookStore) *WSPool {
+	return &WSPool{
+		tag:         "WSPool",
+		url:         url,
+		maxSubs:     maxSubs,
+		store:       store,
+		checkPeriod: 10 * time.Second,
+		maxLag:      2 * time.Second,
+	}
+}
+
+// Connect starts the lag check until ctx is done, connections are made by
+// Subscribe.
+func (p *WSPool) Connect(ctx context.Context) {
+	p.mutex.Lock()
+	p.ctx = ctx
+	p.mutex.Unlock()
+	go func() {
+		ticker := time.NewTicker(p.checkPeriod)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				p.check()
+			}
+		}
+	}()
+}
+
+// Subscribe subscribes channel of each market on connections with room,
+// connecting new ones as needed.
+func (p *WSPool) Subscribe(channel string, markets []string) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.ctx == nil {
+		return errors.New("pool is not connected")
+	}
+	var subs []Subscription
+	for _, market := range markets {
+		subs = append(subs, Subscription{Channel: channel, Market: market})
+	}
+	return p.assign(subs, nil)
+}
+
+// assign subscribes subs on connections other than exclude, mutex must be
+// held. It is released while a new connection is dialed, so messages of other
+// connections are recorded meanwhile.
+func (p *WSPool) assign(subs []Subscription, exclude *poolConn) error {
+	for len(subs) > 0 {
+		var pc *poolConn
+		for _, conn := range p.conns {
+			if conn != exclude && len(conn.subs) < p.maxSubs {
+				pc = conn
+				break
+			}
+		}
+		if pc == nil {
+			ctx := p.ctx
+			p.mutex.Unlock()
+			client, ch, err := p.dial(ctx)
+			p.mutex.Lock()
+			if err != nil {
+				return err
+			}
+			pc = p.add(client, ch)
+		}
+		n := p.maxSubs - len(pc.subs)
+		if n > len(subs) {
+			n = len(subs)
+		}
+		for _, sub := range subs[:n] {
+			if err := pc.client.Subscribe(sub.Channel, []string{sub.Market}); err != nil {
+				// restored after reconnecting
+				util.Warning(p.tag, "cannot subscribe", sub.Channel, sub.Market, err.Error())
+			}
+		}
+		pc.subs = append(pc.subs, subs[:n]...)
+		subs = subs[n:]
+	}
+	return nil
+}
+
+// dial connects a new client until ctx is done, mutex must not be held.
+func (p *WSPool) dial(ctx context.Context) (*WSClient, chan Response, error) {
+	ch := make(chan Response)
+	client := NewWSClient(p.url, ch)
+	client.store = p.store
+	client.onState = func(WSState) { p.updateState() }
+	if p.recorder != nil {
+		client.Record(p.recorder)
+	}
+	if err := client.Connect(ctx); err != nil {
+		return nil, nil, err
+	}
+	return client, ch, nil
+}
+
+// add records messages of a connected client sent to ch, mutex must be held.
+func (p *WSPool) add(client *WSClient, ch chan Response) *poolConn {
+	pc := &poolConn{client: client}
+	p.conns = append(p.conns, pc)
+	p.clientsMutex.Lock()
+	p.clients = append(p.clients, client)
+	p.clientsMutex.Unlock()
+	p.updateState()
+	go func() {
+		for res := range ch {
+			p.record(pc, &res)
+		}
+	}()
+	return pc
+}
+
+// record counts a message of pc and its lag.
+func (p *WSPool) record(pc *poolConn, res *Response) {
+	var exchangeTime time.Time
+	switch res.Type {
+	case ORDERBOOK:
+		exchangeTime = ftxTime(res.Orderbook.Time)
+	case TICKER:
+		exchangeTime = res.Ticker.Time
+	case TRADES:
+		if len(res.Trades) > 0 {
+			exchangeTime = res.Trades[len(res.Trades)-1].GetTime()
+		}
+	case ERROR:
+		util.Error(p.tag, res.Results.Error())
+		return
+	default:
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	pc.messages++
+	if res.Type != ORDERBOOK || res.Orderbook.Time > 0 {
+		pc.lagCount++
+		pc.lagSum += time.Since(exchangeTime)
+	}
+}
+
+// updateState sets the state of the store to the worst state of connections.
+func (p *WSPool) updateState() {
+	p.clientsMutex.Lock()
+	defer p.clientsMutex.Unlock()
+	if p.store == nil {
+		return
+	}
+	state := WSDisconnected
+	for i, client := range p.clients {
+		s := client.State()
+		if s == WSClosed {
+			state = WSClosed
+			break
+		}
+		if i == 0 || s < state {
+			state = s
+		}
+	}
+	p.store.setState(state)
+}
+
+// check updates stats and moves half of the subscriptions off connections
+// falling behind.
+func (p *WSPool) check() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for _, pc := range p.conns {
+		pc.stats = WSConnStats{
+			State:         pc.client.State(),
+			Subscriptions: len(pc.subs),
+			Rate:          float64(pc.messages) / p.checkPeriod.Seconds(),
+		}
+		if pc.lagCount > 0 {
+			pc.stats.Lag = pc.lagSum / time.Duration(pc.lagCount)
+		}
+		pc.messages, pc.lagCount, pc.lagSum = 0, 0, 0
+	}
+	// new conns made while moving are checked next time
+	conns := p.conns
+	for _, pc := range conns {
+		if pc.stats.Lag <= p.maxLag || len(pc.subs) < 2 {
+			continue
+		}
+		moved := pc.subs[len(pc.subs)/2:]
+		util.Warning(p.tag, fmt.Sprintf("lag %s, move %d subscriptions",
+			pc.stats.Lag, len(moved)))
+		p.unsubscribe(pc, moved)
+		if err := p.assign(moved, pc); err != nil {
+			util.Error(p.tag, "cannot move subscriptions", err.Error())
+		}
+	}
+}
+
+// unsubscribe removes subs from pc, mutex must be held.
+func (p *WSPool) unsubscribe(pc *poolConn, subs []Subscription) {
+	byChannel := make(map[string][]string)
+	for _, sub := range subs {
+		byChannel[sub.Channel] = append(byChannel[sub.Channel], sub.Market)
+	}
+	for channel, markets := range byChannel {
+		// a failed write breaks the connection, which does not restore them
+		if err := pc.client.Unsubscribe(channel, markets); err != nil {
+			util.Warning(p.tag, "cannot unsubscribe", channel, err.Error())
+		}
+		if channel == "orderbook" && p.store != nil {
+			// until partials from the new connection
+			for _, market := range markets {
+				p.store.Clear(market)
+			}
+		}
+	}
+	pc.subs = append([]Subscription(nil), pc.subs[:len(pc.subs)-len(subs)]...)
+}
+
+// Stats returns the load of each connection in the last check period.
+func (p *WSPool) Stats() []WSConnStats {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	var stats []WSConnStats
+	for _, pc := range p.conns {
+		stats = append(stats, pc.stats)
+	}
+	return stats
+}
@@ -0,0 +1,157 @@
+package exchange
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+type poolRequest struct {
+	conn int32
+	req  request
+}
+
+// newPoolServer replies a partial to each subscription, lagging by lag on
+// the first connection.
+func newPoolServer(reqs chan<- poolRequest, lag time.Duration) func(conn *websocket.Conn) {
+	var conns int32
+	return func(conn *websocket.Conn) {
+		id := atomic.AddInt32(&conns, 1)
+		for {
+			var req request
+			if err := conn.ReadJSON(&req); err != nil {
+				return
+			}
+			reqs <- poolRequest{conn: id, req: req}
+			if req.Op != "subscribe" {
+				continue
+			}
+			t := time.Now()
+			if id == 1 {
+				t = t.Add(-lag)
+			}
+			conn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf(
+				`{"channel":"orderbook","market":"%s","type":"partial","data":`+
+					`{"bids":[],"asks":[],"action":"partial","checksum":0,"time":%f}}`,
+				req.Market, float64(t.UnixNano())/1e9)))
+		}
+	}
+}
+
+func TestWSPoolShard(t *testing.T) {
+	reqs := make(chan poolRequest, 10)
+	ts := newWSServer(newPoolServer(reqs, 0))
+	defer ts.Close()
+	store := NewOrderbookStore()
+	pool := NewWSPool(wsURL(ts), 2, store)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	assert.NotNil(t, pool.Subscribe("orderbook", []string{"A"}))
+	pool.Connect(ctx)
+	assert.Nil(t, pool.Subscribe("orderbook", []string{"A", "B", "C", "D", "E"}))
+	markets := make(map[int32][]string)
+	for i := 0; i < 5; i++ {
+		r := <-reqs
+		markets[r.conn] = append(markets[r.conn], r.req.Market)
+	}
+	assert.Equal(t, map[int32][]string{
+		1: {"A", "B"}, 2: {"C", "D"}, 3: {"E"},
+	}, markets)
+	assert.Len(t, pool.Stats(), 3)
+	assert.Equal(t, WSConnected, store.State())
+	cancel()
+	for store.State() != WSClosed {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestWSPoolMoveLagging(t *testing.T) {
+	reqs := make(chan poolRequest, 10)
+	ts := newWSServer(newPoolServer(reqs, 5*time.Second))
+	defer ts.Close()
+	store := NewOrderbookStore()
+	pool := NewWSPool(wsURL(ts), 2, store)
+	pool.checkPeriod = 50 * time.Millisecond
+	pool.maxLag = time.Second
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pool.Connect(ctx)
+	assert.Nil(t, pool.Subscribe("orderbook", []string{"A", "B"}))
+	assert.Equal(t, poolRequest{1, request{Op: "subscribe",
+		Channel: "orderbook", Market: "A"}}, <-reqs)
+	assert.Equal(t, poolRequest{1, request{Op: "subscribe",
+		Channel: "orderbook", Market: "B"}}, <-reqs)
+	// B is moved off the first connection
+	assert.Equal(t, poolRequest{1, request{Op: "unsubscribe",
+		Channel: "orderbook", Market: "B"}}, <-reqs)
+	assert.Equal(t, poolRequest{2, request{Op: "subscribe",
+		Channel: "orderbook", Market: "B"}}, <-reqs)
+	// partial, cleared and partial again
+	for store.Get("B").Seq < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(3 * pool.checkPeriod)
+	stats := pool.Stats()
+	assert.Len(t, stats, 2)
+	assert.Equal(t, 1, stats[0].Subscriptions)
+	assert.Equal(t, 1, stats[1].Subscriptions)
+	assert.True(t, stats[1].Lag < time.Second)
+}
+
+func TestWSPoolDialUnlocked(t *testing.T) {
+	reqs := make(chan poolRequest, 10)
+	handle := newPoolServer(reqs, 0)
+	upgrader := websocket.Upgrader{}
+	release := make(chan struct{})
+	var dials int32
+	// the second connection is accepted after release
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if atomic.AddInt32(&dials, 1) == 2 {
+				<-release
+			}
+			conn, err := upgrader.Upgrade(w, r, nil)
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			handle(conn)
+		}))
+	defer ts.Close()
+	pool := NewWSPool(wsURL(ts), 1, NewOrderbookStore())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pool.Connect(ctx)
+	assert.Nil(t, pool.Subscribe("orderbook", []string{"A"}))
+	<-reqs
+	subscribed := make(chan error)
+	go func() {
+		subscribed <- pool.Subscribe("orderbook", []string{"B"})
+	}()
+	for atomic.LoadInt32(&dials) < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	// the pool is not locked while the second connection is dialed
+	stats := make(chan []WSConnStats)
+	go func() {
+		stats <- pool.Stats()
+	}()
+	select {
+	case s := <-stats:
+		assert.Len(t, s, 1)
+	case <-time.After(time.Second):
+		t.Error("pool is locked while dialing")
+	}
+	close(release)
+	assert.Nil(t, <-subscribed)
+	assert.Equal(t, poolRequest{2, request{Op: "subscribe",
+		Channel: "orderbook", Market: "B"}}, <-reqs)
+	assert.Len(t, pool.Stats(), 2)
+}
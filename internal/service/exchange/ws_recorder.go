@@ -0,0 +1,165 @@
+package exchange
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	util "crypto-flash/internal/service/util"
+
+	"github.com/buger/jsonparser"
+)
+
+// recordedMessage is a line of a recording.
+type recordedMessage struct {
+	// unix nano when the message is received
+	Time int64           `json:"time"`
+	Data json.RawMessage `json:"data"`
+}
+
+// WSRecorder writes raw websocket messages with their receive time to a
+// gzipped file of JSON lines. It can be shared by clients.
+type WSRecorder struct {
+	mutex   sync.Mutex
+	file    *os.File
+	gz      *gzip.Writer
+	encoder *json.Encoder
+	// flushed about each second so a crash loses little
+	flushedAt time.Time
+}
+
+func NewWSRecorder(path string) (*WSRecorder, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	gz := gzip.NewWriter(file)
+	return &WSRecorder{
+		file:    file,
+		gz:      gz,
+		encoder: json.NewEncoder(gz),
+	}, nil
+}
+func (r *WSRecorder) Write(t time.Time, msg []byte) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if err := r.encoder.Encode(&recordedMessage{Time: t.UnixNano(), Data: msg}); err != nil {
+		return err
+	}
+	if time.Since(r.flushedAt) < time.Second {
+		return nil
+	}
+	r.flushedAt = time.Now()
+	return r.gz.Flush()
+}
+
+// Close flushes the recording, it must be called to get a complete file.
+func (r *WSRecorder) Close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if err := r.gz.Close(); err != nil {
+		r.file.Close()
+		return err
+	}
+	return r.file.Close()
+}
+
+// WSReplayer feeds a recording of WSRecorder to a client without connection,
+// so messages are parsed and orderbooks are merged as they were received.
+type WSReplayer struct {
+	tag    string
+	path   string
+	client *WSClient
+}
+
+// NewWSReplayer replays path to ch, which is closed after replaying. ch can be
+// nil if only orderbooks are needed.
+func NewWSReplayer(path string, ch chan<- Response) *WSReplayer {
+	return &WSReplayer{
+		tag:    "WSReplayer",
+		path:   path,
+		client: NewWSClient("", ch),
+	}
+}
+
+// StoreOrderbooks keeps replayed orderbooks in store, which is connected
+// while replaying.
+func (r *WSReplayer) StoreOrderbooks(store *OrderbookStore) {
+	r.client.StoreOrderbooks(store)
+}
+
+// Replay blocks until the recording ends or ctx is done. Messages are
+// replayed at speed times the recorded pace, or as fast as possible if speed
+// is 0. Subscriptions are restored from the subscribed messages recorded.
+func (r *WSReplayer) Replay(ctx context.Context, speed float64) error {
+	c := r.client
+	c.done = ctx.Done()
+	if c.ch != nil {
+		defer close(c.ch)
+	}
+	defer c.setState(WSClosed)
+	file, err := os.Open(r.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	gz, err := gzip.NewReader(bufio.NewReader(file))
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+	decoder := json.NewDecoder(gz)
+	c.setState(WSConnected)
+	var first int64
+	start := time.Now()
+	for {
+		var m recordedMessage
+		if err := decoder.Decode(&m); err == io.EOF {
+			return nil
+		} else if err == io.ErrUnexpectedEOF {
+			util.Warning(r.tag, r.path, "is not closed properly")
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if first == 0 {
+			first = m.Time
+		}
+		if speed > 0 {
+			at := start.Add(time.Duration(float64(m.Time-first) / speed))
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(time.Until(at)):
+			}
+		} else if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		r.feed(m.Data)
+	}
+}
+func (r *WSReplayer) feed(msg []byte) {
+	c := r.client
+	if typeMsg, _ := jsonparser.GetString(msg, "type"); typeMsg == "subscribed" {
+		channel, _ := jsonparser.GetString(msg, "channel")
+		market, _ := jsonparser.GetString(msg, "market")
+		var markets []string
+		if market != "" {
+			markets = []string{market}
+		}
+		if !c.subscribed(channel, market) {
+			c.Subscribe(channel, markets)
+		}
+	}
+	res, err := c.parse(msg)
+	if err != nil {
+		c.send(Response{Type: ERROR, Results: err})
+	} else if res != nil {
+		c.send(*res)
+	}
+}
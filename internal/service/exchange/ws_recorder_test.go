@@ -0,0 +1,93 @@
+package exchange
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWSRecordAndReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ws_record")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "orderbook.jsonl.gz")
+
+	ts := newWSServer(func(conn *websocket.Conn) {
+		var req request
+		conn.ReadJSON(&req)
+		for _, msg := range []string{
+			`{"type":"subscribed","channel":"orderbook","market":"TEST-PERP"}`,
+			`{"channel":"orderbook","market":"TEST-PERP","type":"partial",` +
+				`"data":{"bids":[[99,1]],"asks":[[101,1]],"action":"partial",` +
+				`"checksum":4091777139}}`,
+			`{"channel":"orderbook","market":"TEST-PERP","type":"update",` +
+				`"data":{"bids":[[98,2]],"asks":[],"action":"update",` +
+				`"checksum":316189990}}`,
+		} {
+			conn.WriteMessage(websocket.TextMessage, []byte(msg))
+		}
+		conn.ReadMessage()
+	})
+	defer ts.Close()
+	recorder, err := NewWSRecorder(path)
+	assert.Nil(t, err)
+	ftx := NewFTX("", "", "", WithWSURL(wsURL(ts)), WithWSRecorder(recorder))
+	store := NewOrderbookStore()
+	assert.Nil(t, ftx.SubscribeOrderbook(store, []string{"TEST-PERP"}))
+	for store.Get("TEST-PERP").Seq < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Nil(t, recorder.Close())
+
+	ch := make(chan Response, 3)
+	replayed := NewOrderbookStore()
+	replayer := NewWSReplayer(path, ch)
+	replayer.StoreOrderbooks(replayed)
+	assert.Nil(t, replayer.Replay(context.Background(), 0))
+	assert.Equal(t, WSClosed, replayed.State())
+	assert.Equal(t, store.Get("TEST-PERP").Orderbook,
+		replayed.Get("TEST-PERP").Orderbook)
+	assert.Equal(t, rows(99, 1, 98, 2),
+		replayed.Get("TEST-PERP").Bids)
+	var actions []string
+	for res := range ch {
+		assert.Equal(t, ORDERBOOK, res.Type)
+		actions = append(actions, res.Orderbook.Action)
+	}
+	assert.Equal(t, []string{"partial", "update"}, actions)
+}
+
+func TestWSReplaySpeed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ws_record")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ticker.jsonl.gz")
+	recorder, err := NewWSRecorder(path)
+	assert.Nil(t, err)
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		recorder.Write(start.Add(time.Duration(i)*100*time.Millisecond), []byte(
+			`{"channel":"ticker","market":"BTC-PERP","type":"update",`+
+				`"data":{"bid":1,"ask":2,"last":1,"time":1609459200}}`))
+	}
+	assert.Nil(t, recorder.Close())
+
+	replayer := NewWSReplayer(path, nil)
+	begin := time.Now()
+	assert.Nil(t, replayer.Replay(context.Background(), 2))
+	assert.True(t, time.Since(begin) >= 100*time.Millisecond)
+
+	ch := make(chan Response)
+	replayer = NewWSReplayer(path, ch)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, context.Canceled, replayer.Replay(ctx, 0))
+	_, ok := <-ch
+	assert.False(t, ok)
+}
@@ -0,0 +1,258 @@
+package util
+
+import (
+	"hash/crc32"
+	"math/bits"
+)
+
+// maxBookLevel is the height of skip lists, enough for thousands of levels.
+const maxBookLevel = 12
+
+type bookNode struct {
+	price float64
+	size  float64
+	next  [maxBookLevel]*bookNode
+}
+
+// bookSide is a side of an orderbook in a skip list sorted from the best
+// price. Removed nodes are reused so updates do not allocate once the side has
+// been full.
+type bookSide struct {
+	head   bookNode
+	level  int
+	length int
+	// bids are sorted descending
+	desc bool
+	free *bookNode
+	// xorshift state for node levels
+	seed uint64
+}
+
+func (s *bookSide) better(a, b float64) bool {
+	if s.desc {
+		return a > b
+	}
+	return a < b
+}
+
+// find fills path with the last node before price at each level and returns
+// the node of price, or nil.
+func (s *bookSide) find(price float64, path *[maxBookLevel]*bookNode) *bookNode {
+	x := &s.head
+	for i := s.level - 1; i >= 0; i-- {
+		for x.next[i] != nil && s.better(x.next[i].price, price) {
+			x = x.next[i]
+		}
+		path[i] = x
+	}
+	if x = x.next[0]; x != nil && x.price == price {
+		return x
+	}
+	return nil
+}
+func (s *bookSide) last() *bookNode {
+	x := &s.head
+	for i := s.level - 1; i >= 0; i-- {
+		for x.next[i] != nil {
+			x = x.next[i]
+		}
+	}
+	if x == &s.head {
+		return nil
+	}
+	return x
+}
+func (s *bookSide) randomLevel() int {
+	s.seed ^= s.seed << 13
+	s.seed ^= s.seed >> 7
+	s.seed ^= s.seed << 17
+	return 1 + bits.TrailingZeros64(s.seed|1<<(maxBookLevel-1))
+}
+
+// set sets the size of price, removing it if size is 0. Levels beyond depth
+// are dropped.
+func (s *bookSide) set(price, size float64, depth int) {
+	var path [maxBookLevel]*bookNode
+	node := s.find(price, &path)
+	if node != nil {
+		if size != 0 {
+			node.size = size
+		} else {
+			s.remove(node, &path)
+		}
+		return
+	}
+	if size == 0 {
+		return
+	}
+	if s.length >= depth {
+		last := s.last()
+		if last == nil || !s.better(price, last.price) {
+			return
+		}
+		// path may pass through last, so find again after removing it
+		s.delete(last.price)
+		s.find(price, &path)
+	}
+	level := s.randomLevel()
+	for i := s.level; i < level; i++ {
+		path[i] = &s.head
+	}
+	if level > s.level {
+		s.level = level
+	}
+	node = s.free
+	if node != nil {
+		s.free = node.next[0]
+		node.next = [maxBookLevel]*bookNode{}
+	} else {
+		node = &bookNode{}
+	}
+	node.price, node.size = price, size
+	for i := 0; i < level; i++ {
+		node.next[i] = path[i].next[i]
+		path[i].next[i] = node
+	}
+	s.length++
+}
+
+// update removes levels first so they make room for new ones.
+func (s *bookSide) update(levels [][]float64, depth int) {
+	for _, level := range levels {
+		if level[1] == 0 {
+			s.delete(level[0])
+		}
+	}
+	for _, level := range levels {
+		if level[1] != 0 {
+			s.set(level[0], level[1], depth)
+		}
+	}
+}
+func (s *bookSide) delete(price float64) {
+	var path [maxBookLevel]*bookNode
+	if node := s.find(price, &path); node != nil {
+		s.remove(node, &path)
+	}
+}
+func (s *bookSide) remove(node *bookNode, path *[maxBookLevel]*bookNode) {
+	for i := 0; i < s.level && path[i].next[i] == node; i++ {
+		path[i].next[i] = node.next[i]
+	}
+	for s.level > 0 && s.head.next[s.level-1] == nil {
+		s.level--
+	}
+	node.next[0] = s.free
+	s.free = node
+	s.length--
+}
+func (s *bookSide) reset() {
+	for x := s.head.next[0]; x != nil; {
+		next := x.next[0]
+		x.next[0] = s.free
+		s.free = x
+		x = next
+	}
+	s.head.next = [maxBookLevel]*bookNode{}
+	s.level = 0
+	s.length = 0
+}
+func (s *bookSide) appendRows(rows []Row) []Row {
+	for x := s.head.next[0]; x != nil; x = x.next[0] {
+		rows = append(rows, Row{Price: D(x.price), Size: D(x.size)})
+	}
+	return rows
+}
+
+// Book is an orderbook for incremental updates, each level is set in
+// O(log n) without allocation. It keeps at most depth levels on each side,
+// levels dropped beyond depth are not restored when better levels are removed.
+// Levels are kept in float64, which round trips the numbers in messages, and
+// converted to exact rows when they are read.
+type Book struct {
+	bids  bookSide
+	asks  bookSide
+	depth int
+	// reused to format checksums
+	buf []byte
+}
+
+// NewBook creates a book of depth levels, OrderbookDepth if depth is not
+// positive.
+func NewBook(depth int) *Book {
+	if depth <= 0 {
+		depth = OrderbookDepth
+	}
+	return &Book{
+		bids:  bookSide{desc: true, seed: 0x9e3779b97f4a7c15},
+		asks:  bookSide{seed: 0xbf58476d1ce4e5b9},
+		depth: depth,
+	}
+}
+func (b *Book) Depth() int {
+	return b.depth
+}
+
+// Update sets levels of [price, size], levels of size 0 are removed. The
+// result is the same as MergeOrderbook.
+func (b *Book) Update(bids, asks [][]float64) {
+	b.bids.update(bids, b.depth)
+	b.asks.update(asks, b.depth)
+}
+
+// Reset empties the book, keeping its memory for new levels.
+func (b *Book) Reset() {
+	b.bids.reset()
+	b.asks.reset()
+}
+
+// AppendBids appends bids from the best to rows.
+func (b *Book) AppendBids(rows []Row) []Row {
+	return b.bids.appendRows(rows)
+}
+func (b *Book) AppendAsks(rows []Row) []Row {
+	return b.asks.appendRows(rows)
+}
+
+// Best returns the best bid and ask prices, ok is false if a side is empty.
+func (b *Book) Best() (bid, ask float64, ok bool) {
+	bestBid, bestAsk := b.bids.head.next[0], b.asks.head.next[0]
+	if bestBid == nil || bestAsk == nil {
+		return 0, 0, false
+	}
+	return bestBid.price, bestAsk.price, true
+}
+
+// Checksum is the same as Orderbook().Checksum() without allocation.
+func (b *Book) Checksum() uint32 {
+	buf := b.buf[:0]
+	bid, ask := b.bids.head.next[0], b.asks.head.next[0]
+	for i := 0; i < OrderbookDepth && (bid != nil || ask != nil); i++ {
+		if bid != nil {
+			buf = appendChecksumLevel(buf, bid)
+			bid = bid.next[0]
+		}
+		if ask != nil {
+			buf = appendChecksumLevel(buf, ask)
+			ask = ask.next[0]
+		}
+	}
+	b.buf = buf
+	return crc32.ChecksumIEEE(buf)
+}
+func appendChecksumLevel(buf []byte, node *bookNode) []byte {
+	if len(buf) > 0 {
+		buf = append(buf, ':')
+	}
+	buf = appendPyFloat(buf, node.price)
+	buf = append(buf, ':')
+	return appendPyFloat(buf, node.size)
+}
+
+// Orderbook returns a copy of the book.
+func (b *Book) Orderbook() *Orderbook {
+	return &Orderbook{
+		Bids: b.AppendBids(make([]Row, 0, b.bids.length)),
+		Asks: b.AppendAsks(make([]Row, 0, b.asks.length)),
+	}
+}
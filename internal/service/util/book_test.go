@@ -0,0 +1,115 @@
+package util
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// randomLevels returns n levels of distinct prices from mid, a third of which
+// are removals.
+func randomLevels(r *rand.Rand, mid float64, n int) [][]float64 {
+	levels := make([][]float64, n)
+	for i, offset := range r.Perm(200)[:n] {
+		size := float64(1 + r.Intn(10))
+		if r.Intn(3) == 0 {
+			size = 0
+		}
+		levels[i] = []float64{mid + float64(offset), size}
+	}
+	return levels
+}
+
+func TestBookMatchesMergeOrderbook(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	book := NewBook(0)
+	var bids, asks []Row
+	for i := 0; i < 1000; i++ {
+		newBids, newAsks := randomLevels(r, 800, 5), randomLevels(r, 1001, 5)
+		book.Update(newBids, newAsks)
+		bids = *MergeOrderbook(bids, newBids, "bids")
+		asks = *MergeOrderbook(asks, newAsks, "asks")
+		ob := book.Orderbook()
+		if !assert.Equal(t, bids, ob.Bids) || !assert.Equal(t, asks, ob.Asks) ||
+			!assert.Equal(t, ob.Checksum(), book.Checksum()) {
+			return
+		}
+	}
+}
+
+func TestBookDepth(t *testing.T) {
+	book := NewBook(2)
+	assert.Equal(t, 2, book.Depth())
+	book.Update([][]float64{{99, 1}, {100, 1}, {98, 1}}, [][]float64{{103, 1}})
+	// levels worse than the depth are dropped
+	book.Update([][]float64{{97, 1}}, [][]float64{{102, 1}, {101, 1}})
+	ob := book.Orderbook()
+	assert.Equal(t, rows(100, 1, 99, 1), ob.Bids)
+	assert.Equal(t, rows(101, 1, 102, 1), ob.Asks)
+	book.Update([][]float64{{100, 0}}, nil)
+	assert.Equal(t, rows(99, 1), book.AppendBids(nil))
+	bid, ask, ok := book.Best()
+	assert.True(t, ok)
+	assert.Equal(t, 99.0, bid)
+	assert.Equal(t, 101.0, ask)
+
+	book.Reset()
+	_, _, ok = book.Best()
+	assert.False(t, ok)
+	assert.Equal(t, &Orderbook{Bids: []Row{}, Asks: []Row{}}, book.Orderbook())
+	book.Update([][]float64{{1, 2}}, nil)
+	assert.Equal(t, rows(1, 2), book.AppendBids(nil))
+}
+
+func TestBookUpdateAllocs(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	book := NewBook(0)
+	for i := 0; i < 1000; i++ {
+		book.Update(randomLevels(r, 800, 5), randomLevels(r, 1001, 5))
+	}
+	updates := make([][][]float64, 100)
+	for i := range updates {
+		updates[i] = randomLevels(r, 800, 5)
+	}
+	i := 0
+	allocs := testing.AllocsPerRun(1000, func() {
+		book.Update(updates[i%len(updates)], nil)
+		book.Checksum()
+		i++
+	})
+	assert.Equal(t, 0.0, allocs)
+}
+
+// benchmarks of an update of 3 levels to a full book
+func benchmarkUpdates() ([][]float64, [][][]float64) {
+	r := rand.New(rand.NewSource(1))
+	var partial [][]float64
+	for i := 0; i < OrderbookDepth; i++ {
+		partial = append(partial, []float64{float64(1000 - i), 1})
+	}
+	updates := make([][][]float64, 1024)
+	for i := range updates {
+		updates[i] = randomLevels(r, 850, 3)
+	}
+	return partial, updates
+}
+func BenchmarkMergeOrderbook(b *testing.B) {
+	partial, updates := benchmarkUpdates()
+	bids := *MergeOrderbook([]Row{}, partial, "bids")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		bids = *MergeOrderbook(bids, updates[i%len(updates)], "bids")
+	}
+}
+func BenchmarkBookUpdate(b *testing.B) {
+	partial, updates := benchmarkUpdates()
+	book := NewBook(0)
+	book.Update(partial, nil)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		book.Update(updates[i%len(updates)], nil)
+	}
+}
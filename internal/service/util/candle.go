@@ -2,6 +2,7 @@ package util
 
 import (
 	"fmt"
+	"math"
 	"time"
 )
 
@@ -62,3 +63,71 @@ func (candle *Candle) String() string {
 	return color(fmt.Sprintf("o: %.2f, h: %.2f, l: %.2f, c: %.2f, time: %s",
 		candle.Open, candle.High, candle.Low, candle.Close, candle.StartTime))
 }
+
+// CandleBuilder builds candles of a resolution in seconds from trades. The
+// first candle misses trades before the first one added, candles without
+// trades are flat at the previous close like FTX candles.
+type CandleBuilder struct {
+	resolution int64
+	// unix time of the open candle, 0 before any trade
+	start    int64
+	hasTrade bool
+	open     float64
+	high     float64
+	low      float64
+	close    float64
+	volume   float64
+}
+
+func NewCandleBuilder(resolution int) *CandleBuilder {
+	return &CandleBuilder{resolution: int64(resolution)}
+}
+
+// Add adds trade to the open candle and returns candles closed before it.
+// Trades later than the open candle start are added to it.
+func (b *CandleBuilder) Add(trade *Trade) []*Candle {
+	t := trade.GetTime().Unix()
+	var closed []*Candle
+	if b.start == 0 {
+		b.start = t - t%b.resolution
+	} else {
+		closed = b.Close(time.Unix(t, 0))
+	}
+	if !b.hasTrade {
+		b.hasTrade = true
+		b.open, b.high, b.low = trade.Price, trade.Price, trade.Price
+		b.volume = 0
+	}
+	b.high = math.Max(b.high, trade.Price)
+	b.low = math.Min(b.low, trade.Price)
+	b.close = trade.Price
+	// FTX candle volume is in USD
+	b.volume += trade.Price * trade.Size
+	return closed
+}
+
+// Close returns candles ending at or before t.
+func (b *CandleBuilder) Close(t time.Time) []*Candle {
+	var closed []*Candle
+	for b.start != 0 && b.start+b.resolution <= t.Unix() {
+		if !b.hasTrade {
+			// flat at the previous close
+			b.open, b.high, b.low, b.volume = b.close, b.close, b.close, 0
+		}
+		startTime := time.Unix(b.start, 0).UTC().Format(time.RFC3339)
+		closed = append(closed, NewCandle(
+			b.open, b.high, b.low, b.close, b.volume, startTime))
+		b.hasTrade = false
+		b.start += b.resolution
+	}
+	return closed
+}
+
+// NextClose returns when the open candle closes, or the zero time before any
+// trade.
+func (b *CandleBuilder) NextClose() time.Time {
+	if b.start == 0 {
+		return time.Time{}
+	}
+	return time.Unix(b.start+b.resolution, 0)
+}
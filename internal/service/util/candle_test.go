@@ -0,0 +1,46 @@
+package util
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTrade(price, size float64, t string) *Trade {
+	return &Trade{Price: price, Size: size, Time: t}
+}
+
+func TestCandleBuilder(t *testing.T) {
+	b := NewCandleBuilder(60)
+	assert.True(t, b.NextClose().IsZero())
+	assert.Empty(t, b.Close(time.Unix(1609459260, 0)))
+	// 2021-01-01T00:00:00Z is 1609459200
+	assert.Empty(t, b.Add(newTrade(100, 1, "2021-01-01T00:00:10.5+00:00")))
+	assert.Empty(t, b.Add(newTrade(105, 2, "2021-01-01T00:00:20+00:00")))
+	assert.Empty(t, b.Add(newTrade(98, 1, "2021-01-01T00:00:59.999+00:00")))
+	assert.Equal(t, time.Unix(1609459260, 0), b.NextClose())
+	assert.Empty(t, b.Close(time.Unix(1609459259, 0)))
+
+	candles := b.Close(time.Unix(1609459260, 0))
+	assert.Len(t, candles, 1)
+	assert.Equal(t, 100.0, candles[0].Open)
+	assert.Equal(t, 105.0, candles[0].High)
+	assert.Equal(t, 98.0, candles[0].Low)
+	assert.Equal(t, 98.0, candles[0].Close)
+	assert.Equal(t, 100.0+210+98, candles[0].Volume)
+	assert.Equal(t, int64(1609459200), candles[0].GetTime().Unix())
+
+	// a late trade goes to the open candle
+	assert.Empty(t, b.Add(newTrade(97, 1, "2021-01-01T00:00:59.999+00:00")))
+	// a trade two candles later closes the open candle and a flat one
+	candles = b.Add(newTrade(110, 1, "2021-01-01T00:03:30+00:00"))
+	assert.Len(t, candles, 2)
+	assert.Equal(t, 97.0, candles[0].Open)
+	assert.Equal(t, 97.0, candles[0].Close)
+	assert.Equal(t, int64(1609459260), candles[0].GetTime().Unix())
+	assert.Equal(t, &Candle{Open: 97, High: 97, Low: 97, Close: 97,
+		StartTime: candles[1].StartTime}, candles[1])
+	assert.Equal(t, int64(1609459320), candles[1].GetTime().Unix())
+	assert.Equal(t, time.Unix(1609459440, 0), b.NextClose())
+}
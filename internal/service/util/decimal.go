@@ -0,0 +1,33 @@
+package util
+
+import "github.com/shopspring/decimal"
+
+// D converts f to a decimal of its shortest representation, so 0.1 is
+// exactly 0.1.
+func D(f float64) decimal.Decimal {
+	return decimal.NewFromFloat(f)
+}
+
+// F64 converts d to the nearest float64.
+func F64(d decimal.Decimal) float64 {
+	f, _ := d.Float64()
+	return f
+}
+
+// RoundToIncrement rounds d to the nearest multiple of increment, d is kept if
+// increment is not positive.
+func RoundToIncrement(d, increment decimal.Decimal) decimal.Decimal {
+	if !increment.IsPositive() {
+		return d
+	}
+	return d.Div(increment).Round(0).Mul(increment)
+}
+
+// FloorToIncrement rounds d toward zero to a multiple of increment.
+func FloorToIncrement(d, increment decimal.Decimal) decimal.Decimal {
+	if !increment.IsPositive() {
+		return d
+	}
+	q, _ := d.QuoRem(increment, 0)
+	return q.Mul(increment)
+}
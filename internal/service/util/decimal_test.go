@@ -0,0 +1,42 @@
+package util
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRoundToIncrement(t *testing.T) {
+	assert.Equal(t, "33001", RoundToIncrement(D(33000.5), D(1)).String())
+	assert.Equal(t, "0.3", RoundToIncrement(D(0.1).Add(D(0.2)), D(0.1)).String())
+	assert.Equal(t, "2.5", RoundToIncrement(D(2.5), D(0)).String())
+	assert.Equal(t, "0.1234", FloorToIncrement(D(0.12349), D(0.0001)).String())
+	assert.Equal(t, "-0.1234", FloorToIncrement(D(-0.12349), D(0.0001)).String())
+}
+
+func TestOrderRound(t *testing.T) {
+	o := &Order{Market: "BTC-PERP", Type: "stop", Size: D(0.00999),
+		TriggerPrice: D(31999.6)}
+	assert.Nil(t, o.Round(D(1), D(0.001), D(0.001)))
+	assert.Equal(t, "32000", o.TriggerPrice.String())
+	assert.Equal(t, "0.009", o.Size.String())
+	// the minimum provide size is only for orders resting on the book
+	o = &Order{Market: "BTC-PERP", Type: "market", Size: D(0.0009)}
+	assert.Nil(t, o.Round(D(1), D(0.0001), D(0.001)))
+	o = &Order{Market: "BTC-PERP", Type: "limit", Ioc: true, Size: D(0.0009)}
+	assert.Nil(t, o.Round(D(1), D(0.0001), D(0.001)))
+	o = &Order{Market: "BTC-PERP", Type: "limit", Size: D(0.0009)}
+	assert.NotNil(t, o.Round(D(1), D(0.0001), D(0.001)))
+	o = &Order{Market: "BTC-PERP", Type: "market", Size: D(0.00009)}
+	assert.NotNil(t, o.Round(D(1), D(0.0001), D(0)))
+}
+
+func TestOrderCreateMapNumbers(t *testing.T) {
+	o := &Order{Market: "BTC-PERP", Side: "buy", Type: "limit",
+		Price: D(0.1).Add(D(0.2)), Size: D(0.1)}
+	body, err := json.Marshal(o.CreateMap())
+	assert.Nil(t, err)
+	assert.Contains(t, string(body), `"price":0.3,`)
+	assert.Contains(t, string(body), `"size":0.1,`)
+}
@@ -0,0 +1,140 @@
+package util
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type FixtureMode int
+
+const (
+	// FixtureReplay serves responses from fixture files without network
+	FixtureReplay FixtureMode = iota
+	// FixtureRecord sends requests and saves responses to fixture files
+	FixtureRecord
+)
+
+type fixture struct {
+	Method     string          `json:"method"`
+	URL        string          `json:"url"`
+	StatusCode int             `json:"statusCode"`
+	Body       json.RawMessage `json:"body"`
+}
+
+// FixtureTransport is a http.RoundTripper recording responses to or replaying
+// responses from dir. A fixture is keyed by method, path and query, so host,
+// headers and request body do not matter.
+type FixtureTransport struct {
+	tag  string
+	mode FixtureMode
+	dir  string
+	// next sends requests in record mode
+	next http.RoundTripper
+}
+
+func NewFixtureTransport(mode FixtureMode, dir string) *FixtureTransport {
+	return &FixtureTransport{
+		tag:  "FixtureTransport",
+		mode: mode,
+		dir:  dir,
+		next: http.DefaultTransport,
+	}
+}
+
+// FixtureName returns the file name of the fixture for req.
+func FixtureName(req *http.Request) string {
+	key := req.Method + strings.ReplaceAll(req.URL.Path, "/", "_")
+	if req.URL.RawQuery != "" {
+		key += "_" + req.URL.RawQuery
+	}
+	name := []byte(key)
+	for i, c := range name {
+		isAlnum := c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' ||
+			c >= '0' && c <= '9'
+		if !isAlnum && c != '-' && c != '.' && c != '=' {
+			name[i] = '_'
+		}
+	}
+	if len(name) > 120 {
+		sum := sha1.Sum([]byte(key))
+		name = append(name[:100], "_"+hex.EncodeToString(sum[:5])...)
+	}
+	return string(name) + ".json"
+}
+func (ft *FixtureTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	path := filepath.Join(ft.dir, FixtureName(req))
+	if ft.mode == FixtureRecord {
+		return ft.record(req, path)
+	}
+	return ft.replay(req, path)
+}
+func (ft *FixtureTransport) record(req *http.Request,
+	path string) (*http.Response, error) {
+	res, err := ft.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	res.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if !json.Valid(body) {
+		Warning(ft.tag, "skip recording non JSON response of", req.URL.String())
+		return res, nil
+	}
+	f := fixture{
+		Method:     req.Method,
+		URL:        req.URL.RequestURI(),
+		StatusCode: res.StatusCode,
+		Body:       body,
+	}
+	content, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(ft.dir, 0755); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(path, content, 0644); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+func (ft *FixtureTransport) replay(req *http.Request,
+	path string) (*http.Response, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("no fixture for %s %s: %v",
+			req.Method, req.URL.RequestURI(), err)
+	}
+	var f fixture
+	if err := json.Unmarshal(content, &f); err != nil {
+		return nil, fmt.Errorf("bad fixture %s: %v", path, err)
+	}
+	// bodies are indented in fixture files for review
+	var body bytes.Buffer
+	if err := json.Compact(&body, f.Body); err != nil {
+		return nil, fmt.Errorf("bad fixture %s: %v", path, err)
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", f.StatusCode, http.StatusText(f.StatusCode)),
+		StatusCode:    f.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"application/json"}},
+		Body:          ioutil.NopCloser(&body),
+		ContentLength: int64(body.Len()),
+		Request:       req,
+	}, nil
+}
@@ -0,0 +1,58 @@
+package util
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFixtureName(t *testing.T) {
+	req := httptest.NewRequest("GET",
+		"https://ftx.com/api/markets/BTC/USD/candles?resolution=60&limit=2", nil)
+	assert.Equal(t, "GET_api_markets_BTC_USD_candles_resolution=60_limit=2.json",
+		FixtureName(req))
+}
+
+func TestFixtureRecordReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fixtures")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Query().Get("a") == "2" {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"error":"bad a"}`))
+				return
+			}
+			w.Write([]byte(`{"a":1}`))
+		}))
+	rc := newTestRestClient()
+	rc.SetTransport(NewFixtureTransport(FixtureRecord, dir))
+	var res testResult
+	assert.Nil(t, rc.Get(ts.URL+"/path?a=1", nil, nil, &res))
+	assert.Equal(t, 1, res.A)
+	assert.NotNil(t, rc.Get(ts.URL+"/path?a=2", nil, nil, &res))
+	files, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	assert.Equal(t, 2, len(files))
+	ts.Close()
+
+	rc = newTestRestClient()
+	rc.SetTransport(NewFixtureTransport(FixtureReplay, dir))
+	res = testResult{}
+	// host does not matter when replaying
+	assert.Nil(t, rc.Get("http://other.invalid/path?a=1", nil, nil, &res))
+	assert.Equal(t, 1, res.A)
+	err = rc.Get(ts.URL+"/path?a=2", nil, nil, &res)
+	statusErr, ok := err.(*StatusError)
+	assert.True(t, ok)
+	assert.Equal(t, http.StatusBadRequest, statusErr.StatusCode)
+	assert.Equal(t, `{"error":"bad a"}`, string(statusErr.Body))
+	err = rc.Get(ts.URL+"/path?a=3", nil, nil, &res)
+	_, ok = err.(*TransportError)
+	assert.True(t, ok)
+}
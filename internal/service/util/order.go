@@ -1,28 +1,44 @@
 package util
 
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
 type Order struct {
-	Market     string  `json:"market"`
-	Side       string  `json:"side"`
-	Price      float64 `json:"price"`
-	Type       string  `json:"type"`
-	Size       float64 `json:"size"`
-	ReduceOnly bool    `json:"reduceOnly"`
-	Ioc        bool    `json:"ioc"`
-	PostOnly   bool    `json:"postOnly"`
-	ClientId   *string `json:"clientId"`
+	Market     string          `json:"market"`
+	Side       string          `json:"side"`
+	Price      decimal.Decimal `json:"price"`
+	Type       string          `json:"type"`
+	Size       decimal.Decimal `json:"size"`
+	ReduceOnly bool            `json:"reduceOnly"`
+	Ioc        bool            `json:"ioc"`
+	PostOnly   bool            `json:"postOnly"`
+	ClientId   *string         `json:"clientId"`
 	// for conditional order
 	// market: true or false
 	// limit: false
 	RetryUntilFilled bool `json:"retryUntilFilled"`
 
 	// for stop and take profit
-	TriggerPrice float64 `json:"triggerPrice"`
+	TriggerPrice decimal.Decimal `json:"triggerPrice"`
 	// specified for limit, otherwise market
-	OrderPrice float64 `json:"orderPrice"`
+	OrderPrice decimal.Decimal `json:"orderPrice"`
 
 	// for trailing stop
 	// negative for sell, positive for buy
-	TrailValue float64 `json:"trailValue"`
+	TrailValue decimal.Decimal `json:"trailValue"`
+}
+
+// number sends d as a JSON number, decimals are strings by default.
+func number(d decimal.Decimal) json.Number {
+	return json.Number(d.String())
 }
 
 func (o *Order) CreateMap() map[string]interface{} {
@@ -30,34 +46,159 @@ func (o *Order) CreateMap() map[string]interface{} {
 	if o.Type == "limit" || o.Type == "market" {
 		result["market"] = o.Market
 		result["side"] = o.Side
-		if o.Price > 0 {
-			result["price"] = o.Price
+		if o.Price.IsPositive() {
+			result["price"] = number(o.Price)
 		} else {
 			result["price"] = nil
 		}
 		result["type"] = o.Type
-		result["size"] = o.Size
+		result["size"] = number(o.Size)
 		result["reduceOnly"] = o.ReduceOnly
-		//result["ioc"] = o.Ioc
-		//result["postOnly"] = o.PostOnly
-		//result["clientID"] = o.ClientID
+		result["ioc"] = o.Ioc
+		result["postOnly"] = o.PostOnly
+		if o.ClientId != nil {
+			result["clientId"] = *o.ClientId
+		}
 	} else if o.Type == "stop" || o.Type == "takeProfit" ||
 		o.Type == "trailingStop" {
 		result["market"] = o.Market
 		result["side"] = o.Side
-		result["size"] = o.Size
+		result["size"] = number(o.Size)
 		result["type"] = o.Type
 		result["reduceOnly"] = o.ReduceOnly
 		result["retryUntilFilled"] = o.RetryUntilFilled
 		if o.Type == "trailingStop" {
-			result["trailValue"] = o.TrailValue
+			result["trailValue"] = number(o.TrailValue)
 		} else {
-			result["triggerPrice"] = o.TriggerPrice
-			if o.OrderPrice > 0 {
+			result["triggerPrice"] = number(o.TriggerPrice)
+			if o.OrderPrice.IsPositive() {
 				result["retryUntilFilled"] = false
-				result["orderPrice"] = o.OrderPrice
+				result["orderPrice"] = number(o.OrderPrice)
 			}
 		}
 	}
 	return result
 }
+
+// Rests reports whether the order may rest on the book as a maker, which is
+// a limit order without ioc.
+func (o *Order) Rests() bool {
+	return o.Type == "limit" && !o.Ioc
+}
+
+// Round rounds prices to the nearest priceIncrement and the size down to
+// sizeIncrement, so the order is never larger than intended. An error is
+// returned if the rounded size is zero, or smaller than minProvideSize for
+// orders which may rest on the book.
+func (o *Order) Round(priceIncrement, sizeIncrement,
+	minProvideSize decimal.Decimal) error {
+	o.Price = RoundToIncrement(o.Price, priceIncrement)
+	o.TriggerPrice = RoundToIncrement(o.TriggerPrice, priceIncrement)
+	o.OrderPrice = RoundToIncrement(o.OrderPrice, priceIncrement)
+	o.TrailValue = RoundToIncrement(o.TrailValue, priceIncrement)
+	o.Size = FloorToIncrement(o.Size, sizeIncrement)
+	minSize := sizeIncrement
+	if o.Rests() && minProvideSize.GreaterThan(minSize) {
+		minSize = minProvideSize
+	}
+	if !o.Size.IsPositive() || o.Size.LessThan(minSize) {
+		return errors.New("order size " + o.Size.String() + " of " + o.Market +
+			" is smaller than " + minSize.String())
+	}
+	return nil
+}
+
+// NewClientID returns a random id for the exchange to tell a resubmitted order
+// from a new one.
+func NewClientID() string {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		// unlikely, fall back to time which is unique enough in one process
+		return fmt.Sprintf("cf-%d", time.Now().UnixNano())
+	}
+	return "cf-" + hex.EncodeToString(b)
+}
+
+// OrderStatus is an order as reported by the exchange.
+type OrderStatus struct {
+	ID            int64   `json:"id"`
+	ClientID      string  `json:"clientId"`
+	Market        string  `json:"market"`
+	Type          string  `json:"type"`
+	Side          string  `json:"side"`
+	Price         float64 `json:"price"`
+	Size          float64 `json:"size"`
+	FilledSize    float64 `json:"filledSize"`
+	RemainingSize float64 `json:"remainingSize"`
+	AvgFillPrice  float64 `json:"avgFillPrice"`
+	// new, open or closed
+	Status     string `json:"status"`
+	ReduceOnly bool   `json:"reduceOnly"`
+	Ioc        bool   `json:"ioc"`
+	PostOnly   bool   `json:"postOnly"`
+	CreatedAt  string `json:"createdAt"`
+}
+
+func (o *OrderStatus) IsClosed() bool {
+	return o.Status == "closed"
+}
+
+// IsFilled reports whether the order is closed with its whole size filled.
+func (o *OrderStatus) IsFilled() bool {
+	return o.IsClosed() && o.FilledSize >= o.Size
+}
+
+// Fill is a trade of one of our orders.
+type Fill struct {
+	ID      int64   `json:"id"`
+	OrderID int64   `json:"orderId"`
+	Market  string  `json:"market"`
+	Side    string  `json:"side"`
+	Price   float64 `json:"price"`
+	Size    float64 `json:"size"`
+	Fee     float64 `json:"fee"`
+	FeeRate float64 `json:"feeRate"`
+	// maker or taker
+	Liquidity string `json:"liquidity"`
+	Time      string `json:"time"`
+}
+
+// TriggerOrderStatus is a conditional order as reported by the exchange.
+type TriggerOrderStatus struct {
+	ID     int64  `json:"id"`
+	Market string `json:"market"`
+	// stop, trailing_stop or take_profit
+	Type         string  `json:"type"`
+	Side         string  `json:"side"`
+	Size         float64 `json:"size"`
+	TriggerPrice float64 `json:"triggerPrice"`
+	OrderPrice   float64 `json:"orderPrice"`
+	TrailValue   float64 `json:"trailValue"`
+	// type of the order placed when triggered, market or limit
+	OrderType        string  `json:"orderType"`
+	FilledSize       float64 `json:"filledSize"`
+	AvgFillPrice     float64 `json:"avgFillPrice"`
+	ReduceOnly       bool    `json:"reduceOnly"`
+	RetryUntilFilled bool    `json:"retryUntilFilled"`
+	// open, cancelled or triggered
+	Status      string `json:"status"`
+	TriggeredAt string `json:"triggeredAt"`
+	CreatedAt   string `json:"createdAt"`
+}
+
+func (o *TriggerOrderStatus) IsOpen() bool {
+	return o.Status == "open"
+}
+func (o *TriggerOrderStatus) IsTriggered() bool {
+	return o.Status == "triggered"
+}
+
+// Trigger is an order placed when a conditional order is triggered.
+type Trigger struct {
+	Time       string  `json:"time"`
+	OrderID    int64   `json:"orderId"`
+	OrderSize  float64 `json:"orderSize"`
+	FilledSize float64 `json:"filledSize"`
+	// reason if the order cannot be placed
+	Error string `json:"error"`
+}
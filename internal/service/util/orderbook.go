@@ -1,19 +1,32 @@
 package util
 
 import (
+	"bytes"
 	"errors"
+	"hash/crc32"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/shopspring/decimal"
 )
 
+// OrderbookDepth is the number of levels kept and covered by checksums.
+const OrderbookDepth = 100
+
+var two = decimal.NewFromInt(2)
+
+// Row is a level of an orderbook in exact decimals as sent by the exchange.
 type Row struct {
-	Price float64
-	Size  float64
+	Price decimal.Decimal
+	Size  decimal.Decimal
 }
 type Orderbook struct {
 	Bids []Row
 	Asks []Row
 }
 
-func (ob *Orderbook) Add(side string, price, size float64) {
+func (ob *Orderbook) Add(side string, price, size decimal.Decimal) {
 	row := Row{Price: price, Size: size}
 	if side == "bid" {
 		ob.Bids = append(ob.Bids, row)
@@ -21,25 +34,248 @@ func (ob *Orderbook) Add(side string, price, size float64) {
 		ob.Asks = append(ob.Asks, row)
 	}
 }
+
+// bestPrice returns the price of the top of rows, it is an error if the price
+// is not positive, e.g. a null ask or bid sent by the exchange.
+func bestPrice(rows []Row, side string) (decimal.Decimal, error) {
+	if len(rows) < 1 {
+		return decimal.Zero, errors.New("No available " + side + " orderbook")
+	}
+	if !rows[0].Price.IsPositive() {
+		return decimal.Zero, errors.New("Invalid " + side + " price " +
+			rows[0].Price.String())
+	}
+	return rows[0].Price, nil
+}
 func (ob *Orderbook) GetMarketBuyPrice() (float64, error) {
-	if len(ob.Asks) < 1 {
-		return -1, errors.New("No available ask orderbook")
+	price, err := bestPrice(ob.Asks, "ask")
+	if err != nil {
+		return -1, err
 	}
-	return ob.Asks[0].Price, nil
+	return F64(price), nil
 }
 func (ob *Orderbook) GetMarketSellPrice() (float64, error) {
+	price, err := bestPrice(ob.Bids, "bid")
+	if err != nil {
+		return -1, err
+	}
+	return F64(price), nil
+}
+
+// GetSpreadRate returns the spread of the top levels relative to the mid
+// price.
+func (ob *Orderbook) GetSpreadRate() (float64, error) {
+	bid, err := bestPrice(ob.Bids, "bid")
+	if err != nil {
+		return -1, err
+	}
+	ask, err := bestPrice(ob.Asks, "ask")
+	if err != nil {
+		return -1, err
+	}
+	return F64(ask.Sub(bid).Div(ask.Add(bid).Div(two))), nil
+}
+
+// GetImbalance returns (bid size - ask size) / (bid size + ask size) of the
+// top levels on each side, from -1 (all asks) to 1 (all bids).
+func (ob *Orderbook) GetImbalance(levels int) (float64, error) {
+	bidSize, askSize := decimal.Zero, decimal.Zero
+	for i := 0; i < levels && i < len(ob.Bids); i++ {
+		bidSize = bidSize.Add(ob.Bids[i].Size)
+	}
+	for i := 0; i < levels && i < len(ob.Asks); i++ {
+		askSize = askSize.Add(ob.Asks[i].Size)
+	}
+	total := bidSize.Add(askSize)
+	if total.IsZero() {
+		return 0, errors.New("No available orderbook")
+	}
+	return F64(bidSize.Sub(askSize).Div(total)), nil
+}
+
+// GetMicroprice returns the mid price weighted by the opposite top sizes,
+// which leans to the side more likely to move next.
+func (ob *Orderbook) GetMicroprice() (float64, error) {
+	if len(ob.Bids) < 1 || len(ob.Asks) < 1 {
+		return -1, errors.New("No available orderbook")
+	}
+	bid, ask := ob.Bids[0], ob.Asks[0]
+	if !bid.Size.Add(ask.Size).IsPositive() {
+		return -1, errors.New("No available orderbook size")
+	}
+	return F64(bid.Price.Mul(ask.Size).Add(ask.Price.Mul(bid.Size)).
+		Div(bid.Size.Add(ask.Size))), nil
+}
+
+// GetMarketBuyPriceForSize returns the average price of a market buy of size
+// walking the asks, or an error if the asks are not deep enough.
+func (ob *Orderbook) GetMarketBuyPriceForSize(size float64) (float64, error) {
+	return walkOrderbook(ob.Asks, size, false, "ask")
+}
+func (ob *Orderbook) GetMarketSellPriceForSize(size float64) (float64, error) {
+	return walkOrderbook(ob.Bids, size, false, "bid")
+}
+
+// GetMarketBuyPriceForValue is GetMarketBuyPriceForSize with size in quote
+// currency, e.g. USD.
+func (ob *Orderbook) GetMarketBuyPriceForValue(value float64) (float64, error) {
+	return walkOrderbook(ob.Asks, value, true, "ask")
+}
+func (ob *Orderbook) GetMarketSellPriceForValue(value float64) (float64, error) {
+	return walkOrderbook(ob.Bids, value, true, "bid")
+}
+
+// GetBuySlippage returns the rate the average price of a market buy of size
+// is worse than the best ask.
+func (ob *Orderbook) GetBuySlippage(size float64) (float64, error) {
+	price, err := ob.GetMarketBuyPriceForSize(size)
+	if err != nil {
+		return -1, err
+	}
+	best := F64(ob.Asks[0].Price)
+	return (price - best) / best, nil
+}
+func (ob *Orderbook) GetSellSlippage(size float64) (float64, error) {
+	price, err := ob.GetMarketSellPriceForSize(size)
+	if err != nil {
+		return -1, err
+	}
+	best := F64(ob.Bids[0].Price)
+	return (best - price) / best, nil
+}
+
+// GetBidDepth returns the total size of bids within bps basis points of the
+// best bid.
+func (ob *Orderbook) GetBidDepth(bps float64) float64 {
 	if len(ob.Bids) < 1 {
-		return -1, errors.New("No available bid orderbook")
+		return 0
+	}
+	limit := ob.Bids[0].Price.Mul(decimal.New(1, 0).Sub(D(bps).Shift(-4)))
+	depth := decimal.Zero
+	for _, row := range ob.Bids {
+		if row.Price.LessThan(limit) {
+			break
+		}
+		depth = depth.Add(row.Size)
+	}
+	return F64(depth)
+}
+func (ob *Orderbook) GetAskDepth(bps float64) float64 {
+	if len(ob.Asks) < 1 {
+		return 0
+	}
+	limit := ob.Asks[0].Price.Mul(decimal.New(1, 0).Add(D(bps).Shift(-4)))
+	depth := decimal.Zero
+	for _, row := range ob.Asks {
+		if row.Price.GreaterThan(limit) {
+			break
+		}
+		depth = depth.Add(row.Size)
+	}
+	return F64(depth)
+}
+
+// walkOrderbook fills amount from the best of rows and returns the average
+// price, amount is in quote currency if byValue.
+func walkOrderbook(rows []Row, amount float64, byValue bool,
+	side string) (float64, error) {
+	best, err := bestPrice(rows, side)
+	if err != nil {
+		return -1, err
+	}
+	if amount <= 0 {
+		return F64(best), nil
+	}
+	size, value, left := decimal.Zero, decimal.Zero, D(amount)
+	for _, row := range rows {
+		filled := row.Size
+		if byValue {
+			filled = row.Size.Mul(row.Price)
+		}
+		if filled.GreaterThanOrEqual(left) {
+			if byValue {
+				size = size.Add(left.Div(row.Price))
+				value = value.Add(left)
+			} else {
+				size = size.Add(left)
+				value = value.Add(left.Mul(row.Price))
+			}
+			return F64(value.Div(size)), nil
+		}
+		size = size.Add(row.Size)
+		value = value.Add(row.Size.Mul(row.Price))
+		left = left.Sub(filled)
 	}
-	return ob.Bids[0].Price, nil
+	return -1, errors.New("Not enough " + side + " orderbook for " +
+		strconv.FormatFloat(amount, 'f', -1, 64))
 }
 
+// Checksum is the CRC32 of the top levels FTX sends with orderbook messages,
+// computed on "bid0 price:bid0 size:ask0 price:ask0 size:bid1 price:..."
+// with numbers formatted like Python floats.
+func (ob *Orderbook) Checksum() uint32 {
+	var parts []string
+	for i := 0; i < OrderbookDepth; i++ {
+		if i < len(ob.Bids) {
+			parts = append(parts, pyDecimal(ob.Bids[i].Price),
+				pyDecimal(ob.Bids[i].Size))
+		}
+		if i < len(ob.Asks) {
+			parts = append(parts, pyDecimal(ob.Asks[i].Price),
+				pyDecimal(ob.Asks[i].Size))
+		}
+	}
+	return crc32.ChecksumIEEE([]byte(strings.Join(parts, ":")))
+}
+
+// pyFloat formats f like str(float) in Python, e.g. 1.0, 0.0001 and 1e-05.
+func pyFloat(f float64) string {
+	return string(appendPyFloat(nil, f))
+}
+
+// appendPyFloat appends f formatted by pyFloat to dst.
+func appendPyFloat(dst []byte, f float64) []byte {
+	start := len(dst)
+	dst = strconv.AppendFloat(dst, f, 'e', -1, 64)
+	// the exponent is signed, e.g. e-05
+	e := start + bytes.IndexByte(dst[start:], 'e')
+	exp := 0
+	for _, c := range dst[e+2:] {
+		exp = exp*10 + int(c-'0')
+	}
+	if dst[e+1] == '-' {
+		exp = -exp
+	}
+	if f != 0 && (exp < -4 || exp >= 16) {
+		return dst
+	}
+	dst = strconv.AppendFloat(dst[:start], f, 'f', -1, 64)
+	if bytes.IndexByte(dst[start:], '.') < 0 {
+		dst = append(dst, ".0"...)
+	}
+	return dst
+}
+
+// pyDecimal formats d like the Python float FTX parsed it to.
+func pyDecimal(d decimal.Decimal) string {
+	return pyFloat(F64(d))
+}
+
+// MergeOrderbook merges new levels into original, which is sorted by price,
+// descending for bids and ascending for asks. Levels of size 0 are removed.
 func MergeOrderbook(original []Row, new [][]float64, orderbookType string) *[]Row {
 	var convertNewObj []Row
 	for _, elem := range new {
-		orderbookRow := Row{elem[0], elem[1]}
+		orderbookRow := Row{D(elem[0]), D(elem[1])}
 		convertNewObj = append(convertNewObj, orderbookRow)
 	}
+	// updates are not guaranteed to be sorted
+	sort.SliceStable(convertNewObj, func(i, j int) bool {
+		if orderbookType == "bids" {
+			return convertNewObj[i].Price.GreaterThan(convertNewObj[j].Price)
+		}
+		return convertNewObj[i].Price.LessThan(convertNewObj[j].Price)
+	})
 
 	var result []Row
 	originalStartIndex, newStartIndex := 0, 0
@@ -47,17 +283,17 @@ func MergeOrderbook(original []Row, new [][]float64, orderbookType string) *[]Ro
 
 	if orderbookType == "bids" {
 		for originalStartIndex < originalLen && newStartIndex < newLen {
-			if original[originalStartIndex].Price == convertNewObj[newStartIndex].Price {
-				if convertNewObj[newStartIndex].Size != 0 {
+			if original[originalStartIndex].Price.Equal(convertNewObj[newStartIndex].Price) {
+				if !convertNewObj[newStartIndex].Size.IsZero() {
 					result = append(result, convertNewObj[newStartIndex])
 				}
 				originalStartIndex++
 				newStartIndex++
-			} else if original[originalStartIndex].Price > convertNewObj[newStartIndex].Price {
+			} else if original[originalStartIndex].Price.GreaterThan(convertNewObj[newStartIndex].Price) {
 				result = append(result, original[originalStartIndex])
 				originalStartIndex++
 			} else {
-				if convertNewObj[newStartIndex].Size != 0 {
+				if !convertNewObj[newStartIndex].Size.IsZero() {
 					result = append(result, convertNewObj[newStartIndex])
 				}
 				newStartIndex++
@@ -65,14 +301,14 @@ func MergeOrderbook(original []Row, new [][]float64, orderbookType string) *[]Ro
 		}
 	} else if orderbookType == "asks" {
 		for originalStartIndex < originalLen && newStartIndex < newLen {
-			if original[originalStartIndex].Price == convertNewObj[newStartIndex].Price {
-				if convertNewObj[newStartIndex].Size != 0 {
+			if original[originalStartIndex].Price.Equal(convertNewObj[newStartIndex].Price) {
+				if !convertNewObj[newStartIndex].Size.IsZero() {
 					result = append(result, convertNewObj[newStartIndex])
 				}
 				originalStartIndex++
 				newStartIndex++
-			} else if original[originalStartIndex].Price > convertNewObj[newStartIndex].Price {
-				if convertNewObj[newStartIndex].Size != 0 {
+			} else if original[originalStartIndex].Price.GreaterThan(convertNewObj[newStartIndex].Price) {
+				if !convertNewObj[newStartIndex].Size.IsZero() {
 					result = append(result, convertNewObj[newStartIndex])
 				}
 				newStartIndex++
@@ -89,14 +325,14 @@ func MergeOrderbook(original []Row, new [][]float64, orderbookType string) *[]Ro
 	}
 
 	for newStartIndex < newLen {
-		if convertNewObj[newStartIndex].Size != 0 {
+		if !convertNewObj[newStartIndex].Size.IsZero() {
 			result = append(result, convertNewObj[newStartIndex])
 		}
 		newStartIndex++
 	}
 
-	if len(result) > 50 {
-		result = result[:50]
+	if len(result) > OrderbookDepth {
+		result = result[:OrderbookDepth]
 	}
 
 	return &result
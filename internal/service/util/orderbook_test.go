@@ -19,26 +19,26 @@ type AsksTestSuite struct {
 
 func (suite *BidsTestSuite) SetupTest() {
 	suite.original = []Row{
-		{49017, 0.3089},
-		{49016, 0.3831},
-		{49014, 18.35},
-		{49008, 0.0547},
-		{49007, 0.139},
-		{49006, 0.307},
+		{D(49017), D(0.3089)},
+		{D(49016), D(0.3831)},
+		{D(49014), D(18.35)},
+		{D(49008), D(0.0547)},
+		{D(49007), D(0.139)},
+		{D(49006), D(0.307)},
 	}
 }
 
 func (suite *AsksTestSuite) SetupTest() {
 	suite.original = []Row{
-		{49018, 1.3912},
-		{49034, 0.2137},
-		{49036, 0.1836},
-		{49037, 1.0918},
-		{49038, 2.0355},
-		{49040, 0.6653},
-		{49041, 0.82},
-		{49042, 36.2009},
-		{49043, 0.8139},
+		{D(49018), D(1.3912)},
+		{D(49034), D(0.2137)},
+		{D(49036), D(0.1836)},
+		{D(49037), D(1.0918)},
+		{D(49038), D(2.0355)},
+		{D(49040), D(0.6653)},
+		{D(49041), D(0.82)},
+		{D(49042), D(36.2009)},
+		{D(49043), D(0.8139)},
 	}
 }
 
@@ -52,15 +52,15 @@ func (suite *BidsTestSuite) TestWithNormalCase() {
 	}
 
 	expectation := []Row{
-		{49017, 0.3671},
-		{49016, 0.3831},
-		{49014, 18.35},
-		{49008, 0.007},
-		{49007, 0.139},
-		{49006, 0.307},
-		{48988, 0.848},
-		{48984, 0.5409},
-		{48967, 36.2488},
+		{D(49017), D(0.3671)},
+		{D(49016), D(0.3831)},
+		{D(49014), D(18.35)},
+		{D(49008), D(0.007)},
+		{D(49007), D(0.139)},
+		{D(49006), D(0.307)},
+		{D(48988), D(0.848)},
+		{D(48984), D(0.5409)},
+		{D(48967), D(36.2488)},
 	}
 
 	got := *MergeOrderbook(suite.original, new, "bids")
@@ -81,13 +81,13 @@ func (suite *BidsTestSuite) TestWithZeroCase() {
 	}
 
 	expectation := []Row{
-		{49017, 0.3671},
-		{49016, 0.3831},
-		{49014, 18.35},
-		{49008, 0.007},
-		{49007, 0.139},
-		{48988, 0.848},
-		{48967, 36.2488},
+		{D(49017), D(0.3671)},
+		{D(49016), D(0.3831)},
+		{D(49014), D(18.35)},
+		{D(49008), D(0.007)},
+		{D(49007), D(0.139)},
+		{D(48988), D(0.848)},
+		{D(48967), D(36.2488)},
 	}
 
 	got := *MergeOrderbook(suite.original, new, "bids")
@@ -102,14 +102,14 @@ func (suite *BidsTestSuite) TestWithoutSamePrice() {
 	}
 
 	expectation := []Row{
-		{49017, 0.3089},
-		{49016, 0.3831},
-		{49014, 18.35},
-		{49008, 0.0547},
-		{49007, 0.139},
-		{49006, 0.307},
-		{49002, 0.82},
-		{49000, 0.24},
+		{D(49017), D(0.3089)},
+		{D(49016), D(0.3831)},
+		{D(49014), D(18.35)},
+		{D(49008), D(0.0547)},
+		{D(49007), D(0.139)},
+		{D(49006), D(0.307)},
+		{D(49002), D(0.82)},
+		{D(49000), D(0.24)},
 	}
 
 	got := *MergeOrderbook(suite.original, new, "bids")
@@ -126,16 +126,16 @@ func (suite *AsksTestSuite) TestWithNormalCase() {
 	}
 
 	expectation := []Row{
-		{49018, 1.8},
-		{49034, 0.2137},
-		{49036, 0.15},
-		{49037, 1.0918},
-		{49038, 2.0355},
-		{49040, 0.6653},
-		{49041, 0.6189},
-		{49042, 36.2009},
-		{49043, 0.8139},
-		{49081, 0.001},
+		{D(49018), D(1.8)},
+		{D(49034), D(0.2137)},
+		{D(49036), D(0.15)},
+		{D(49037), D(1.0918)},
+		{D(49038), D(2.0355)},
+		{D(49040), D(0.6653)},
+		{D(49041), D(0.6189)},
+		{D(49042), D(36.2009)},
+		{D(49043), D(0.8139)},
+		{D(49081), D(0.001)},
 	}
 
 	got := *MergeOrderbook(suite.original, new, "asks")
@@ -155,15 +155,15 @@ func (suite *AsksTestSuite) TestWithZeroCase() {
 	}
 
 	expectation := []Row{
-		{49018, 1.8},
-		{49034, 0.2137},
-		{49036, 0.15},
-		{49037, 1.0918},
-		{49038, 2.0355},
-		{49041, 0.6189},
-		{49042, 36.2009},
-		{49043, 0.8139},
-		{49081, 0.001},
+		{D(49018), D(1.8)},
+		{D(49034), D(0.2137)},
+		{D(49036), D(0.15)},
+		{D(49037), D(1.0918)},
+		{D(49038), D(2.0355)},
+		{D(49041), D(0.6189)},
+		{D(49042), D(36.2009)},
+		{D(49043), D(0.8139)},
+		{D(49081), D(0.001)},
 	}
 
 	got := *MergeOrderbook(suite.original, new, "asks")
@@ -178,17 +178,17 @@ func (suite *AsksTestSuite) TestWithoutSamePrice() {
 	}
 
 	expectation := []Row{
-		{49015, 0.08},
-		{49017, 0.001},
-		{49018, 1.3912},
-		{49034, 0.2137},
-		{49036, 0.1836},
-		{49037, 1.0918},
-		{49038, 2.0355},
-		{49040, 0.6653},
-		{49041, 0.82},
-		{49042, 36.2009},
-		{49043, 0.8139},
+		{D(49015), D(0.08)},
+		{D(49017), D(0.001)},
+		{D(49018), D(1.3912)},
+		{D(49034), D(0.2137)},
+		{D(49036), D(0.1836)},
+		{D(49037), D(1.0918)},
+		{D(49038), D(2.0355)},
+		{D(49040), D(0.6653)},
+		{D(49041), D(0.82)},
+		{D(49042), D(36.2009)},
+		{D(49043), D(0.8139)},
 	}
 
 	got := *MergeOrderbook(suite.original, new, "asks")
@@ -203,3 +203,162 @@ func TestMergeOrderbookWhenBidsTestSuite(t *testing.T) {
 func TestMergeOrderbookWhenAsksTestSuite(t *testing.T) {
 	suite.Run(t, new(AsksTestSuite))
 }
+
+func (suite *BidsTestSuite) TestWithUnsortedUpdate() {
+	new := [][]float64{
+		{49008, 0},
+		{49020, 1},
+		{49015, 2},
+	}
+
+	expectation := []Row{
+		{D(49020), D(1)},
+		{D(49017), D(0.3089)},
+		{D(49016), D(0.3831)},
+		{D(49015), D(2)},
+		{D(49014), D(18.35)},
+		{D(49007), D(0.139)},
+		{D(49006), D(0.307)},
+	}
+
+	got := *MergeOrderbook(suite.original, new, "bids")
+	assert.Equal(suite.T(), expectation, got)
+}
+
+// rows makes rows of price and size pairs.
+func rows(levels ...float64) []Row {
+	var result []Row
+	for i := 0; i+1 < len(levels); i += 2 {
+		result = append(result, Row{Price: D(levels[i]), Size: D(levels[i+1])})
+	}
+	return result
+}
+
+func TestOrderbookChecksum(t *testing.T) {
+	ob := Orderbook{
+		Bids: rows(5000.5, 10, 4995, 5.5),
+		Asks: rows(5001, 0.0001, 5002.5, 1.5e-05, 5003, 12345678),
+	}
+	// zlib.crc32(b"5000.5:10.0:5001.0:0.0001:4995.0:5.5:5002.5:1.5e-05:5003.0:12345678.0")
+	assert.Equal(t, uint32(2030063172), ob.Checksum())
+	ob.Asks[2].Size = D(12345679)
+	assert.NotEqual(t, uint32(2030063172), ob.Checksum())
+}
+
+func TestPyFloat(t *testing.T) {
+	cases := map[float64]string{
+		0:                   "0.0",
+		1:                   "1.0",
+		0.30000000000000004: "0.30000000000000004",
+		0.0001:              "0.0001",
+		0.00001234:          "1.234e-05",
+		1e16:                "1e+16",
+		123456789012345678:  "1.2345678901234568e+17",
+		9999.5:              "9999.5",
+	}
+	for f, s := range cases {
+		assert.Equal(t, s, pyFloat(f))
+	}
+}
+
+func TestMergeOrderbookDepth(t *testing.T) {
+	var bids [][]float64
+	for i := 0; i < OrderbookDepth+10; i++ {
+		bids = append(bids, []float64{float64(1000 - i), 1})
+	}
+	got := *MergeOrderbook([]Row{}, bids, "bids")
+	assert.Len(t, got, OrderbookDepth)
+	assert.Equal(t, Row{Price: D(1000), Size: D(1)}, got[0])
+}
+
+func TestOrderbookPriceForSize(t *testing.T) {
+	ob := Orderbook{
+		Bids: rows(100, 1, 99, 2, 90, 5),
+		Asks: rows(101, 1, 102, 3),
+	}
+	price, err := ob.GetMarketSellPriceForSize(0.5)
+	assert.Nil(t, err)
+	assert.Equal(t, 100.0, price)
+	price, err = ob.GetMarketSellPriceForSize(2)
+	assert.Nil(t, err)
+	assert.Equal(t, 99.5, price)
+	price, err = ob.GetMarketBuyPriceForSize(4)
+	assert.Nil(t, err)
+	assert.Equal(t, 101.75, price)
+	_, err = ob.GetMarketBuyPriceForSize(5)
+	assert.NotNil(t, err)
+	// 101 + 204 USD buys 3 at 101.67
+	price, err = ob.GetMarketBuyPriceForValue(305)
+	assert.Nil(t, err)
+	assert.InDelta(t, 305.0/3, price, 1e-9)
+	price, err = ob.GetMarketSellPriceForValue(100)
+	assert.Nil(t, err)
+	assert.Equal(t, 100.0, price)
+	_, err = (&Orderbook{}).GetMarketSellPriceForValue(100)
+	assert.NotNil(t, err)
+
+	slippage, err := ob.GetBuySlippage(4)
+	assert.Nil(t, err)
+	assert.InDelta(t, 0.75/101, slippage, 1e-12)
+	slippage, err = ob.GetSellSlippage(3)
+	assert.Nil(t, err)
+	assert.InDelta(t, (100-298.0/3)/100, slippage, 1e-12)
+}
+
+func TestOrderbookInvalidPrice(t *testing.T) {
+	// a null ask or bid of a ticker is parsed as 0
+	ob := Orderbook{Bids: rows(0, 0), Asks: rows(0, 0)}
+	_, err := ob.GetMarketBuyPrice()
+	assert.NotNil(t, err)
+	_, err = ob.GetMarketSellPrice()
+	assert.NotNil(t, err)
+	_, err = ob.GetSpreadRate()
+	assert.NotNil(t, err)
+	_, err = ob.GetMicroprice()
+	assert.NotNil(t, err)
+	_, err = ob.GetMarketBuyPriceForValue(100)
+	assert.NotNil(t, err)
+}
+
+func TestOrderbookDepth(t *testing.T) {
+	ob := Orderbook{
+		Bids: rows(100, 1, 99, 2, 90, 5),
+		Asks: rows(101, 1, 102, 3),
+	}
+	assert.Equal(t, 1.0, ob.GetBidDepth(0))
+	assert.Equal(t, 3.0, ob.GetBidDepth(150))
+	assert.Equal(t, 8.0, ob.GetBidDepth(1500))
+	assert.Equal(t, 1.0, ob.GetAskDepth(50))
+	assert.Equal(t, 4.0, ob.GetAskDepth(100))
+	assert.Equal(t, 0.0, (&Orderbook{}).GetAskDepth(100))
+	// sizes are summed exactly
+	ob = Orderbook{Bids: rows(100, 0.1, 99, 0.2)}
+	assert.Equal(t, 0.3, ob.GetBidDepth(100))
+}
+
+func TestOrderbookFeatures(t *testing.T) {
+	ob := Orderbook{
+		Bids: rows(99, 3, 98, 1),
+		Asks: rows(101, 1, 102, 5),
+	}
+	spread, err := ob.GetSpreadRate()
+	assert.Nil(t, err)
+	assert.Equal(t, 0.02, spread)
+	imbalance, err := ob.GetImbalance(1)
+	assert.Nil(t, err)
+	assert.Equal(t, 0.5, imbalance)
+	imbalance, _ = ob.GetImbalance(10)
+	assert.Equal(t, -0.2, imbalance)
+	// pulled to the ask by the larger bid
+	microprice, err := ob.GetMicroprice()
+	assert.Nil(t, err)
+	assert.Equal(t, 100.5, microprice)
+
+	empty := Orderbook{}
+	_, err = empty.GetSpreadRate()
+	assert.NotNil(t, err)
+	_, err = empty.GetImbalance(5)
+	assert.NotNil(t, err)
+	_, err = empty.GetMicroprice()
+	assert.NotNil(t, err)
+}
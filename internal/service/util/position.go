@@ -1,24 +1,46 @@
 package util
 
-import "fmt"
+import (
+	"fmt"
+
+	"github.com/shopspring/decimal"
+)
 
 type Position struct {
 	Market    string
 	Side      string
-	Size      float64
-	OpenPrice float64
+	Size      decimal.Decimal
+	OpenPrice decimal.Decimal
 }
 
 const tag = "Position"
 
-func NewPosition(side string, size float64, openPrice float64) *Position {
+func NewPosition(side string, size, openPrice decimal.Decimal) *Position {
 	return &Position{Side: side, Size: size, OpenPrice: openPrice}
 }
-func (pos *Position) Close(closePrice float64) float64 {
-	roi := (closePrice - pos.OpenPrice) / pos.OpenPrice
+
+// ROI returns the return of the position closed at closePrice, it is an error
+// if either price is not positive.
+func (pos *Position) ROI(closePrice decimal.Decimal) (float64, error) {
+	if !pos.OpenPrice.IsPositive() || !closePrice.IsPositive() {
+		return 0, fmt.Errorf("invalid prices to close %s, open: %s, close: %s",
+			pos.Side, pos.OpenPrice, closePrice)
+	}
+	roi := F64(closePrice.Sub(pos.OpenPrice).Div(pos.OpenPrice))
 	if pos.Side == "short" {
 		roi *= -1
 	}
+	return roi, nil
+}
+
+// Close logs and returns the ROI of the position closed at closePrice, which
+// is 0 if the prices are invalid.
+func (pos *Position) Close(closePrice decimal.Decimal) float64 {
+	roi, err := pos.ROI(closePrice)
+	if err != nil {
+		Error(tag, err.Error())
+		return 0
+	}
 	roiStr := PF64(roi * 100)
 	if roi > 0 {
 		roiStr = Green(roiStr)
@@ -26,11 +48,11 @@ func (pos *Position) Close(closePrice float64) float64 {
 		roiStr = Red(roiStr)
 	}
 	Info(tag, fmt.Sprintf(
-		"close %s, open price: %.2f, current price: %.2f, ROI: %s",
-		pos.Side, pos.OpenPrice, closePrice, roiStr))
+		"close %s, open price: %s, current price: %s, ROI: %s",
+		pos.Side, pos.OpenPrice.StringFixed(2), closePrice.StringFixed(2), roiStr))
 	return roi
 }
 func (pos *Position) String() string {
-	return fmt.Sprintf("Market: %s, Side: %s, Size: %f, OpenPrice: %f",
+	return fmt.Sprintf("Market: %s, Side: %s, Size: %s, OpenPrice: %s",
 		pos.Market, pos.Side, pos.Size, pos.OpenPrice)
 }
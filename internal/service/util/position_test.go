@@ -0,0 +1,22 @@
+package util
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPositionROI(t *testing.T) {
+	pos := NewPosition("short", D(1), D(100))
+	roi, err := pos.ROI(D(90))
+	assert.Nil(t, err)
+	assert.InDelta(t, 0.1, roi, 1e-12)
+	assert.InDelta(t, 0.1, pos.Close(D(90)), 1e-12)
+	// a position opened at a null price cannot be closed with a ROI
+	pos = NewPosition("long", D(1), D(0))
+	_, err = pos.ROI(D(90))
+	assert.NotNil(t, err)
+	assert.Equal(t, 0.0, pos.Close(D(90)))
+	_, err = NewPosition("long", D(1), D(100)).ROI(D(0))
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,54 @@
+package util
+
+import (
+	"sync"
+	"time"
+)
+
+// TokenBucket allows rate requests per second on average with bursts of at
+// most burst requests.
+type TokenBucket struct {
+	mutex  sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func NewTokenBucket(rate float64, burst int) *TokenBucket {
+	return &TokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// Reserve takes a token and returns how long the caller should wait before
+// using it. Tokens can be borrowed from the future, so concurrent callers are
+// served in order.
+func (tb *TokenBucket) Reserve() time.Duration {
+	tb.mutex.Lock()
+	defer tb.mutex.Unlock()
+	now := time.Now()
+	tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+	if tb.tokens > tb.burst {
+		tb.tokens = tb.burst
+	}
+	tb.last = now
+	tb.tokens--
+	if tb.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-tb.tokens / tb.rate * float64(time.Second))
+}
+
+// Wait blocks until a token is available and reports whether it had to wait.
+func (tb *TokenBucket) Wait() bool {
+	d := tb.Reserve()
+	if d <= 0 {
+		return false
+	}
+	time.Sleep(d)
+	return true
+}
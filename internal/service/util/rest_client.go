@@ -1,69 +1,273 @@
 package util
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"math/rand"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// TransportError means the request is not sent or no response is received.
+type TransportError struct {
+	Method string
+	URL    string
+	Err    error
+}
+
+func (e *TransportError) Error() string {
+	return fmt.Sprintf("%s %s: %v", e.Method, e.URL, e.Err)
+}
+func (e *TransportError) Unwrap() error {
+	return e.Err
+}
+
+// StatusError means the server responds with a non-2xx status code.
+type StatusError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s %s: status %d: %s",
+		e.Method, e.URL, e.StatusCode, string(e.Body))
+}
+
+// DecodeError means the response body cannot be decoded into the result.
+type DecodeError struct {
+	Method string
+	URL    string
+	Err    error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("%s %s: decode response: %v", e.Method, e.URL, e.Err)
+}
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// RestClientMetrics counts requests since the client is created.
+type RestClientMetrics struct {
+	// requests sent, including retries
+	Requests int64
+	// requests delayed by a rate limiter
+	Throttled int64
+	// responses with status 429
+	RateLimited int64
+	// requests sent again after a failure
+	Retried int64
+	// requests failed after all retries
+	Failed int64
+}
+
+type endpointLimiter struct {
+	prefix string
+	bucket *TokenBucket
+}
+
 type RestClient struct {
-	tag    string
-	client *http.Client
+	metrics RestClientMetrics
+	tag     string
+	client  *http.Client
+	// limiters are applied to requests whose path has the prefix, the one with
+	// empty prefix is applied to all requests
+	limitersMutex sync.RWMutex
+	limiters      []endpointLimiter
+	maxRetries    int
+	minBackoff    time.Duration
+	maxBackoff    time.Duration
 }
 
 func NewRestClient() *RestClient {
 	return &RestClient{
-		tag:    "RestClient",
-		client: &http.Client{},
+		tag:        "RestClient",
+		client:     &http.Client{Timeout: 10 * time.Second},
+		maxRetries: 3,
+		minBackoff: 200 * time.Millisecond,
+		maxBackoff: 5 * time.Second,
 	}
 }
-func (rc *RestClient) do(req *http.Request, v interface{}) {
-	res, err := rc.client.Do(req)
-	if err != nil {
-		Error(rc.tag, err.Error())
+
+// SetLimit sets a budget of rate requests per second with bursts of burst for
+// request paths starting with endpoint. Empty endpoint sets a budget shared by
+// all requests.
+func (rc *RestClient) SetLimit(endpoint string, rate float64, burst int) {
+	rc.limitersMutex.Lock()
+	defer rc.limitersMutex.Unlock()
+	bucket := NewTokenBucket(rate, burst)
+	for i := range rc.limiters {
+		if rc.limiters[i].prefix == endpoint {
+			rc.limiters[i].bucket = bucket
+			return
+		}
 	}
-	defer res.Body.Close()
-	err = json.NewDecoder(res.Body).Decode(v)
-	if err != nil {
-		Error(rc.tag, err.Error())
+	rc.limiters = append(rc.limiters, endpointLimiter{endpoint, bucket})
+}
+
+// SetRetry sets how many times a failed request is retried and the range of
+// the exponential backoff between retries.
+func (rc *RestClient) SetRetry(maxRetries int, minBackoff, maxBackoff time.Duration) {
+	rc.maxRetries = maxRetries
+	rc.minBackoff = minBackoff
+	rc.maxBackoff = maxBackoff
+}
+
+// SetTransport replaces the transport used to send requests.
+func (rc *RestClient) SetTransport(transport http.RoundTripper) {
+	rc.client.Transport = transport
+}
+func (rc *RestClient) Metrics() RestClientMetrics {
+	return RestClientMetrics{
+		Requests:    atomic.LoadInt64(&rc.metrics.Requests),
+		Throttled:   atomic.LoadInt64(&rc.metrics.Throttled),
+		RateLimited: atomic.LoadInt64(&rc.metrics.RateLimited),
+		Retried:     atomic.LoadInt64(&rc.metrics.Retried),
+		Failed:      atomic.LoadInt64(&rc.metrics.Failed),
 	}
 }
-func (rc *RestClient) Get(url string, header *http.Header, body io.Reader,
-	v interface{}) {
-	req, err := http.NewRequest("GET", url, body)
-	if err != nil {
-		Error(rc.tag, err.Error())
+
+// wait blocks until every limiter matching path allows a request.
+func (rc *RestClient) wait(path string) {
+	rc.limitersMutex.RLock()
+	var buckets []*TokenBucket
+	for _, l := range rc.limiters {
+		if strings.HasPrefix(path, l.prefix) {
+			buckets = append(buckets, l.bucket)
+		}
 	}
-	if header != nil {
-		req.Header = *header
+	rc.limitersMutex.RUnlock()
+	throttled := false
+	for _, bucket := range buckets {
+		if bucket.Wait() {
+			throttled = true
+		}
+	}
+	if throttled {
+		atomic.AddInt64(&rc.metrics.Throttled, 1)
 	}
-	req.Header.Add("Content-Type", "application/json")
-	req.Header.Add("Accept", "application/json")
-	rc.do(req, v)
 }
-func (rc *RestClient) Post(url string, header *http.Header, body io.Reader,
-	v interface{}) {
-	req, err := http.NewRequest("POST", url, body)
-	if err != nil {
-		Error(rc.tag, err.Error())
+
+// backoff returns a random duration up to minBackoff * 2^attempt, capped by
+// maxBackoff (full jitter).
+func (rc *RestClient) backoff(attempt int) time.Duration {
+	d := rc.minBackoff << uint(attempt)
+	if d > rc.maxBackoff || d <= 0 {
+		d = rc.maxBackoff
+	}
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
+
+// shouldRetry reports whether err is worth retrying and the least time to
+// wait before that. Requests other than GET and DELETE are only retried on
+// 429 since they may have taken effect.
+func shouldRetry(method string, err error) (bool, time.Duration) {
+	idempotent := method == "GET" || method == "DELETE"
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		if statusErr.StatusCode == http.StatusTooManyRequests {
+			retryAfter, _ := strconv.Atoi(statusErr.Header.Get("Retry-After"))
+			return true, time.Duration(retryAfter) * time.Second
+		}
+		return idempotent && statusErr.StatusCode >= 500, 0
 	}
-	if header != nil {
-		req.Header = *header
+	var transportErr *TransportError
+	if errors.As(err, &transportErr) {
+		return idempotent, 0
 	}
-	req.Header.Add("Content-Type", "application/json")
-	req.Header.Add("Accept", "application/json")
-	rc.do(req, v)
+	return false, 0
 }
-func (rc *RestClient) Delete(url string, header *http.Header, body io.Reader,
-	v interface{}) {
-	req, err := http.NewRequest("DELETE", url, body)
+func (rc *RestClient) do(req *http.Request, v interface{}) error {
+	atomic.AddInt64(&rc.metrics.Requests, 1)
+	res, err := rc.client.Do(req)
 	if err != nil {
-		Error(rc.tag, err.Error())
+		return &TransportError{Method: req.Method, URL: req.URL.String(), Err: err}
 	}
-	if header != nil {
-		req.Header = *header
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		if res.StatusCode == http.StatusTooManyRequests {
+			atomic.AddInt64(&rc.metrics.RateLimited, 1)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		return &StatusError{
+			Method:     req.Method,
+			URL:        req.URL.String(),
+			StatusCode: res.StatusCode,
+			Header:     res.Header,
+			Body:       body,
+		}
+	}
+	if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+		return &DecodeError{Method: req.Method, URL: req.URL.String(), Err: err}
 	}
-	req.Header.Add("Content-Type", "application/json")
-	req.Header.Add("Accept", "application/json")
-	rc.do(req, v)
+	return nil
+}
+
+// Send is Get, Post or Delete by method with the header made by header for
+// each attempt, so signed headers with timestamps are fresh on retries.
+func (rc *RestClient) Send(method, url string, header func() *http.Header,
+	body io.Reader, v interface{}) error {
+	var bodyBytes []byte
+	if body != nil {
+		var err error
+		if bodyBytes, err = ioutil.ReadAll(body); err != nil {
+			return &TransportError{Method: method, URL: url, Err: err}
+		}
+	}
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequest(method, url, bytes.NewReader(bodyBytes))
+		if err != nil {
+			return &TransportError{Method: method, URL: url, Err: err}
+		}
+		if header != nil {
+			if h := header(); h != nil {
+				req.Header = h.Clone()
+			}
+		}
+		req.Header.Add("Content-Type", "application/json")
+		req.Header.Add("Accept", "application/json")
+		rc.wait(req.URL.Path)
+		err = rc.do(req, v)
+		if err == nil {
+			return nil
+		}
+		retry, retryAfter := shouldRetry(method, err)
+		if !retry || attempt >= rc.maxRetries {
+			atomic.AddInt64(&rc.metrics.Failed, 1)
+			return err
+		}
+		wait := rc.backoff(attempt)
+		if wait < retryAfter {
+			wait = retryAfter
+		}
+		Warning(rc.tag, fmt.Sprintf("retry in %s: %s", wait, err))
+		atomic.AddInt64(&rc.metrics.Retried, 1)
+		time.Sleep(wait)
+	}
+}
+func (rc *RestClient) Get(url string, header *http.Header, body io.Reader,
+	v interface{}) error {
+	return rc.Send("GET", url, fixedHeader(header), body, v)
+}
+func (rc *RestClient) Post(url string, header *http.Header, body io.Reader,
+	v interface{}) error {
+	return rc.Send("POST", url, fixedHeader(header), body, v)
+}
+func (rc *RestClient) Delete(url string, header *http.Header, body io.Reader,
+	v interface{}) error {
+	return rc.Send("DELETE", url, fixedHeader(header), body, v)
+}
+func fixedHeader(header *http.Header) func() *http.Header {
+	return func() *http.Header { return header }
 }
@@ -0,0 +1,174 @@
+package util
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testResult struct {
+	A int `json:"a"`
+}
+
+// newTestServer responds statuses in order and then 200 with {"a": 1}
+func newTestServer(statuses ...int) (*httptest.Server, *int64) {
+	var count int64
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			i := atomic.AddInt64(&count, 1) - 1
+			if int(i) < len(statuses) {
+				if statuses[i] == http.StatusTooManyRequests {
+					w.Header().Set("Retry-After", "0")
+				}
+				w.WriteHeader(statuses[i])
+				w.Write([]byte(`{"success":false,"error":"oops"}`))
+				return
+			}
+			w.Write([]byte(`{"a":1}`))
+		}))
+	return ts, &count
+}
+func newTestRestClient() *RestClient {
+	rc := NewRestClient()
+	rc.SetRetry(3, time.Millisecond, 5*time.Millisecond)
+	return rc
+}
+
+func TestRestClientRetryServerError(t *testing.T) {
+	ts, count := newTestServer(500, 502)
+	defer ts.Close()
+	rc := newTestRestClient()
+	var res testResult
+	err := rc.Get(ts.URL, nil, nil, &res)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, res.A)
+	assert.Equal(t, int64(3), *count)
+	metrics := rc.Metrics()
+	assert.Equal(t, int64(3), metrics.Requests)
+	assert.Equal(t, int64(2), metrics.Retried)
+	assert.Equal(t, int64(0), metrics.Failed)
+}
+
+func TestRestClientNoRetryPostServerError(t *testing.T) {
+	ts, count := newTestServer(500)
+	defer ts.Close()
+	rc := newTestRestClient()
+	var res testResult
+	err := rc.Post(ts.URL, nil, nil, &res)
+	var statusErr *StatusError
+	assert.True(t, errors.As(err, &statusErr))
+	assert.Equal(t, 500, statusErr.StatusCode)
+	assert.Equal(t, `{"success":false,"error":"oops"}`, string(statusErr.Body))
+	assert.Equal(t, int64(1), *count)
+	assert.Equal(t, int64(1), rc.Metrics().Failed)
+}
+
+func TestRestClientRetryTooManyRequests(t *testing.T) {
+	ts, count := newTestServer(429)
+	defer ts.Close()
+	rc := newTestRestClient()
+	var res testResult
+	err := rc.Post(ts.URL, nil, nil, &res)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), *count)
+	assert.Equal(t, int64(1), rc.Metrics().RateLimited)
+	assert.Equal(t, int64(1), rc.Metrics().Retried)
+}
+
+func TestRestClientGiveUp(t *testing.T) {
+	ts, count := newTestServer(500, 500, 500, 500, 500)
+	defer ts.Close()
+	rc := newTestRestClient()
+	var res testResult
+	err := rc.Get(ts.URL, nil, nil, &res)
+	var statusErr *StatusError
+	assert.True(t, errors.As(err, &statusErr))
+	assert.Equal(t, int64(4), *count)
+	assert.Equal(t, int64(1), rc.Metrics().Failed)
+}
+
+func TestRestClientNoRetryClientError(t *testing.T) {
+	ts, count := newTestServer(404)
+	defer ts.Close()
+	rc := newTestRestClient()
+	var res testResult
+	err := rc.Get(ts.URL, nil, nil, &res)
+	var statusErr *StatusError
+	assert.True(t, errors.As(err, &statusErr))
+	assert.Equal(t, 404, statusErr.StatusCode)
+	assert.Equal(t, int64(1), *count)
+}
+
+func TestRestClientDecodeError(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`not json`))
+		}))
+	defer ts.Close()
+	var res testResult
+	err := newTestRestClient().Get(ts.URL, nil, nil, &res)
+	var decodeErr *DecodeError
+	assert.True(t, errors.As(err, &decodeErr))
+}
+
+func TestRestClientTransportError(t *testing.T) {
+	ts, _ := newTestServer()
+	ts.Close()
+	rc := newTestRestClient()
+	var res testResult
+	err := rc.Get(ts.URL, nil, nil, &res)
+	var transportErr *TransportError
+	assert.True(t, errors.As(err, &transportErr))
+	assert.Equal(t, int64(4), rc.Metrics().Requests)
+}
+
+func TestRestClientRateLimit(t *testing.T) {
+	ts, _ := newTestServer()
+	defer ts.Close()
+	rc := newTestRestClient()
+	rc.SetLimit("/limited", 20, 1)
+	start := time.Now()
+	var res testResult
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, rc.Get(ts.URL+"/limited", nil, nil, &res))
+	}
+	// the first request uses the burst, the other two wait 50ms each
+	assert.True(t, time.Since(start) >= 90*time.Millisecond)
+	assert.Equal(t, int64(2), rc.Metrics().Throttled)
+	// other endpoints are not limited
+	assert.Nil(t, rc.Get(ts.URL+"/other", nil, nil, &res))
+	assert.Equal(t, int64(2), rc.Metrics().Throttled)
+}
+
+func TestRestClientSendHeaderPerAttempt(t *testing.T) {
+	var attempts int64
+	headers := make(chan string, 2)
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			headers <- r.Header.Get("X-Attempt")
+			if atomic.AddInt64(&attempts, 1) == 1 {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			w.Write([]byte(`{"a":1}`))
+		}))
+	defer ts.Close()
+	rc := newTestRestClient()
+	made := 0
+	var res testResult
+	err := rc.Send("GET", ts.URL, func() *http.Header {
+		made++
+		header := http.Header{}
+		header.Set("X-Attempt", strconv.Itoa(made))
+		return &header
+	}, nil, &res)
+	assert.Nil(t, err)
+	assert.Equal(t, "1", <-headers)
+	assert.Equal(t, "2", <-headers)
+}
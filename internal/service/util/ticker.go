@@ -0,0 +1,23 @@
+package util
+
+import (
+	"time"
+)
+
+// Ticker is the best bid and ask and the last trade price of a market.
+type Ticker struct {
+	Market  string
+	Bid     float64
+	Ask     float64
+	BidSize float64
+	AskSize float64
+	Last    float64
+	// Time is when the exchange makes the change, ReceivedAt is when it is
+	// received
+	Time       time.Time
+	ReceivedAt time.Time
+}
+
+func (ticker *Ticker) GetMid() float64 {
+	return (ticker.Bid + ticker.Ask) / 2
+}
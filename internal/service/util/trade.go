@@ -0,0 +1,19 @@
+package util
+
+import (
+	"time"
+)
+
+type Trade struct {
+	ID          int64   `json:"id"`
+	Price       float64 `json:"price"`
+	Size        float64 `json:"size"`
+	Side        string  `json:"side"`
+	Liquidation bool    `json:"liquidation"`
+	Time        string  `json:"time"`
+}
+
+func (trade *Trade) GetTime() time.Time {
+	tradeTime, _ := time.Parse(time.RFC3339Nano, trade.Time)
+	return tradeTime
+}
@@ -1,43 +1,40 @@
 package util
 
-import "fmt"
+import (
+	"fmt"
+
+	"github.com/shopspring/decimal"
+)
 
 type Wallet struct {
 	tag      string
-	balances map[string]float64
+	balances map[string]decimal.Decimal
 }
 
 func NewWallet() *Wallet {
 	return &Wallet{
 		tag:      "Wallet",
-		balances: make(map[string]float64),
+		balances: make(map[string]decimal.Decimal),
 	}
 }
 
-func (w *Wallet) Increase(coin string, amount float64) {
-	if _, exist := w.balances[coin]; !exist {
-		w.balances[coin] = amount
-		return
-	}
-	w.balances[coin] += amount
+func (w *Wallet) Increase(coin string, amount decimal.Decimal) {
+	w.balances[coin] = w.balances[coin].Add(amount)
 }
-func (w *Wallet) Decrease(coin string, amount float64) {
-	if _, exist := w.balances[coin]; !exist || w.balances[coin] < amount {
+func (w *Wallet) Decrease(coin string, amount decimal.Decimal) {
+	if _, exist := w.balances[coin]; !exist || w.balances[coin].LessThan(amount) {
 		Error(w.tag, "Not enough balance for "+coin)
 		return
 	}
-	w.balances[coin] -= amount
+	w.balances[coin] = w.balances[coin].Sub(amount)
 }
-func (w *Wallet) GetBalance(coin string) float64 {
-	if _, exist := w.balances[coin]; !exist {
-		return 0
-	}
+func (w *Wallet) GetBalance(coin string) decimal.Decimal {
 	return w.balances[coin]
 }
 func (w *Wallet) String() string {
 	result := ""
 	for coin, balance := range w.balances {
-		result += fmt.Sprintf("%s: %f ", coin, balance)
+		result += fmt.Sprintf("%s: %s ", coin, balance)
 	}
 	return result
 }
@@ -1,7 +1,6 @@
 /*
 // TODO:
 // 1. tests and DB
-// 2. consider having exchange interface, signal provider interface
 // 3. auto-backtesting and parameter optimization with report to notifier
 // 4. funding rate arbitrage
 */
@@ -10,7 +9,9 @@ package main
 import (
 	"fmt"
 	"os"
+	"os/signal"
 	"sync"
+	"syscall"
 	"time"
 
 	"crypto-flash/internal/apm"
@@ -35,6 +36,39 @@ const (
 func init() {
 	_ = godotenv.Load()
 }
+
+// stopOnExit stops strategies and waits for them on interrupt, then closes
+// recorder if any before exiting, otherwise the recording is truncated.
+func stopOnExit(strategies []character.Strategy, running *sync.WaitGroup,
+	recorder *exchange.WSRecorder) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-c
+		for _, s := range strategies {
+			util.Info(tag, "stop "+s.Name())
+			s.Stop()
+		}
+		running.Wait()
+		if recorder != nil {
+			if err := recorder.Close(); err != nil {
+				util.Error(tag, "cannot close recording", err.Error())
+			}
+		}
+		os.Exit(0)
+	}()
+}
+func uniqueMarkets(markets []string) []string {
+	var result []string
+	seen := make(map[string]bool)
+	for _, market := range markets {
+		if market != "" && !seen[market] {
+			seen[market] = true
+			result = append(result, market)
+		}
+	}
+	return result
+}
 func main() {
 	config := config.Load("config.json", tag)
 	value, exist := os.LookupEnv("ENV")
@@ -53,45 +87,84 @@ func main() {
 		n = nil
 	}
 	// create bots
-	// TODO: some resource like orderbooks should be shared between FTX instance
-	ftx := exchange.NewFTX("", "", "")
-	fra := character.NewFRArb(ftx, nil, "", nil)
-	exchange.SubscribeOrderbook(fra.GetRequiredPairs())
-	orderbooks := exchange.GetOrderbookRes()
+	var opts []exchange.FTXOption
+	var recorder *exchange.WSRecorder
+	if config.WSRecord != "" {
+		var err error
+		recorder, err = exchange.NewWSRecorder(config.WSRecord)
+		if err != nil {
+			util.Error(tag, "cannot record websocket", err.Error())
+		} else {
+			opts = append(opts, exchange.WithWSRecorder(recorder))
+		}
+	}
+	orderbooks := exchange.NewOrderbookStore()
+	var strategies []character.Strategy
+	var markets []string
 	for _, bot := range config.Bots {
 		if bot.Mode == "backtest" {
 			ftx := exchange.NewFTX("", "", "")
-			rs := character.NewResTrend(ftx, nil)
+			s, err := character.NewStrategy(bot.Strategy, character.StrategyConfig{
+				Exchange: ftx, Owner: bot.Owner, Orderbooks: orderbooks})
+			if err != nil {
+				util.Error(tag, "cannot create strategy", err.Error())
+				continue
+			}
+			if !character.CanBacktest(bot.Strategy) {
+				util.Error(tag, "strategy "+bot.Strategy+" cannot be backtested")
+				continue
+			}
 			//endTime, _ := time.Parse(time.RFC3339, "2019-12-01T05:00:00+00:00")
 			endTime := time.Now()
 			d := util.Duration{Day: -60}
 			startTime := endTime.Add(d.GetTimeDuration())
-			roi := rs.Backtest(startTime.Unix(), endTime.Unix())
+			roi := s.Backtest(startTime.Unix(), endTime.Unix())
 			annual := util.CalcAnnualFromROI(roi, -d.GetTimeDuration().Seconds())
-			fmt.Printf("Annual: %.2f%%", annual*100)
+			fmt.Printf("%s annual: %.2f%%\n", s.Name(), annual*100)
 		} else if bot.Mode == "simulate" || bot.Mode == "trade" {
 			if bot.Mode == "trade" && (bot.Key == "" || bot.Secret == "") {
 				continue
 			}
-			if bot.Verbose && n != nil {
-				n.AddUser(bot.Owner, bot.TelegramID)
-				n.Send(tag, bot.Owner, fmt.Sprintf("Crypto Flash v%s initialized. Update: \n%s", version, update))
-			}
 			ftx := exchange.NewFTX("", "", "")
 			if bot.Mode == "trade" {
 				ftx = exchange.NewFTX(bot.Key, bot.Secret, bot.SubAccount)
 			}
-			// TODO: make a strategy interface so we can select strategy by config
-			if bot.Strategy == "fr_arbitrage" {
-				fra := character.NewFRArb(ftx, n, bot.Owner, orderbooks)
-				go fra.Start()
-			} else if bot.Strategy == "fr_arbitrage_fork" {
-				fra := character.NewFRArbFork(ftx, n, bot.Owner, orderbooks)
-				go fra.Start()
+			s, err := character.NewStrategy(bot.Strategy, character.StrategyConfig{
+				Exchange: ftx, Notifier: n, Owner: bot.Owner, Orderbooks: orderbooks})
+			if err != nil {
+				util.Error(tag, "cannot create strategy", err.Error())
+				continue
 			}
-			wg.Add(1)
+			if bot.Verbose && n != nil {
+				n.AddUser(bot.Owner, bot.TelegramID)
+				n.Send(tag, bot.Owner, fmt.Sprintf("Crypto Flash v%s initialized. Update: \n%s", version, update))
+			}
+			// traders follow signals of the strategy with the account
+			if signaler, ok := s.(character.Signaler); ok && bot.Mode == "trade" {
+				signalChan := make(chan *util.Signal)
+				signaler.SubSignal(signalChan)
+				trader := character.NewTrader(bot.Owner, ftx, n)
+				go trader.Start(signalChan)
+			}
+			strategies = append(strategies, s)
+			markets = append(markets, s.RequiredMarkets()...)
 		}
 	}
+	// orderbooks are shared between bots
+	ftx := exchange.NewFTX("", "", "", opts...)
+	if err := ftx.SubscribeOrderbook(orderbooks, uniqueMarkets(markets)); err != nil {
+		util.Error(tag, "cannot subscribe orderbook", err.Error())
+	}
+	var running sync.WaitGroup
+	for _, s := range strategies {
+		running.Add(1)
+		go func(s character.Strategy) {
+			defer running.Done()
+			s.Start()
+		}(s)
+	}
+	stopOnExit(strategies, &running, recorder)
+	running.Wait()
 	wg.Wait()
 	/*
 		var n *character.Notifier